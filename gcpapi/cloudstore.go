@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"net/http"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 
 	"github.com/Khan/districts-jobs/pkg/errors"
@@ -30,6 +34,51 @@ func NewCloudStorageClient(
 	return gcsClient, errors.Wrap(cErr, "Unable to get New Cloud Storage client")
 }
 
+// EnsureBucket creates the bucket in the given project and location,
+// unless it exists already.
+func EnsureBucket(
+	ctx context.Context,
+	gcsClient *storage.Client,
+	projectID,
+	bucket,
+	location string,
+) error {
+	return ensureBucket(ctx, stiface.AdaptClient(gcsClient), projectID, bucket, location)
+}
+
+// ensureBucket is EnsureBucket on a stiface.Client.
+func ensureBucket(
+	ctx context.Context,
+	gcsClient stiface.Client,
+	projectID,
+	bucket,
+	location string,
+) error {
+	bh := gcsClient.Bucket(bucket)
+	_, err := bh.Attrs(ctx)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, storage.ErrBucketNotExist) {
+		return errors.Wrapf(err, "Unable to get BucketAttrs for bucket %v", bucket)
+	}
+
+	err = bh.Create(ctx, projectID, &storage.BucketAttrs{Location: location})
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		// Someone else created it since we checked, which is fine.
+		return nil
+	}
+	return errors.Wrapf(err, "Unable to Create bucket %v", bucket)
+}
+
+// UploadOptions holds the optional settings for UploadFileWithOptions.
+type UploadOptions struct {
+	// Metadata is attached to the object as custom metadata, e.g. to
+	// record where the file came from.
+	Metadata map[string]string
+}
+
 // UploadFile uploads an object given the name and bytes.
 func UploadFile(
 	ctx context.Context,
@@ -38,6 +87,36 @@ func UploadFile(
 	objectName string,
 	fileBytes []byte,
 	modTime time.Time,
+) error {
+	return UploadFileWithOptions(
+		ctx, gcsClient, bucket, objectName, fileBytes, modTime, UploadOptions{})
+}
+
+// UploadFileWithOptions is UploadFile, but with optional settings such as
+// custom object metadata.
+func UploadFileWithOptions(
+	ctx context.Context,
+	gcsClient *storage.Client,
+	bucket,
+	objectName string,
+	fileBytes []byte,
+	modTime time.Time,
+	opts UploadOptions,
+) error {
+	return uploadFile(
+		ctx, stiface.AdaptClient(gcsClient), bucket, objectName, fileBytes, modTime, opts)
+}
+
+// uploadFile is UploadFileWithOptions on a stiface.Client, so that it can
+// be tested against the GCS fake.
+func uploadFile(
+	ctx context.Context,
+	gcsClient stiface.Client,
+	bucket,
+	objectName string,
+	fileBytes []byte,
+	modTime time.Time,
+	opts UploadOptions,
 ) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*180)
 	defer cancel()
@@ -60,6 +139,7 @@ func UploadFile(
 		// we need to preserve the modTime as a CustomTime attribute to enable the DataTeam
 		// KhanFlow pipeline to determine if the files have changed.
 		CustomTime: modTime,
+		Metadata:   opts.Metadata,
 	})
 	if err != nil {
 		return errors.Wrapf(
@@ -72,6 +152,147 @@ func UploadFile(
 	return nil
 }
 
+// UploadFiles uploads many files, given their names and bytes, using up to
+// concurrency uploads at once.  Files that fail to upload are returned in
+// the map of per-file errors, and also cause a summary error.
+func UploadFiles(
+	ctx context.Context,
+	gcsClient *storage.Client,
+	bucket string,
+	files map[string][]byte,
+	concurrency int,
+) (map[string]error, error) {
+	return uploadFiles(ctx, stiface.AdaptClient(gcsClient), bucket, files, concurrency)
+}
+
+// uploadFiles is UploadFiles on a stiface.Client.
+func uploadFiles(
+	ctx context.Context,
+	gcsClient stiface.Client,
+	bucket string,
+	files map[string][]byte,
+	concurrency int,
+) (map[string]error, error) {
+	if concurrency < 1 {
+		return nil, errors.InvalidInput(
+			"concurrency must be positive", errors.Fields{"concurrency": concurrency})
+	}
+
+	names := make(chan string)
+	var mu sync.Mutex
+	fileErrors := map[string]error{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				err := uploadFile(
+					ctx, gcsClient, bucket, name, files[name], time.Time{}, UploadOptions{})
+				if err != nil {
+					mu.Lock()
+					fileErrors[name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for name := range files {
+		names <- name
+	}
+	close(names)
+	wg.Wait()
+
+	if len(fileErrors) > 0 {
+		return fileErrors, errors.Newf(
+			"%d of %d files failed to upload to bucket %v",
+			len(fileErrors), len(files), bucket)
+	}
+	return fileErrors, nil
+}
+
+// DownloadFile returns the bytes of an object given the name, along with
+// its attributes (including any custom metadata).
+func DownloadFile(
+	ctx context.Context,
+	gcsClient *storage.Client,
+	bucket,
+	objectName string,
+) ([]byte, *storage.ObjectAttrs, error) {
+	return downloadFile(ctx, stiface.AdaptClient(gcsClient), bucket, objectName)
+}
+
+// downloadFile is DownloadFile on a stiface.Client.
+func downloadFile(
+	ctx context.Context,
+	gcsClient stiface.Client,
+	bucket,
+	objectName string,
+) ([]byte, *storage.ObjectAttrs, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*180)
+	defer cancel()
+
+	o := gcsClient.Bucket(bucket).Object(objectName)
+
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrapf(
+			err, "Unable to get ObjectAttrs for objectName %v", objectName)
+	}
+
+	rc, err := o.NewReader(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrapf(
+			err, "Unable to create storage Reader for objectName %v", objectName)
+	}
+	defer rc.Close()
+
+	fileBytes, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, nil, errors.Newf("io.ReadAll: %w", err)
+	}
+	return fileBytes, attrs, nil
+}
+
+// CopyObject copies an object, which may be in another bucket.  The copy
+// keeps the source's attributes, such as its content type and custom time.
+func CopyObject(
+	ctx context.Context,
+	gcsClient *storage.Client,
+	srcBucket,
+	srcObj,
+	dstBucket,
+	dstObj string,
+) (*storage.ObjectAttrs, error) {
+	return copyObject(
+		ctx, stiface.AdaptClient(gcsClient), srcBucket, srcObj, dstBucket, dstObj)
+}
+
+// copyObject is CopyObject on a stiface.Client.
+func copyObject(
+	ctx context.Context,
+	gcsClient stiface.Client,
+	srcBucket,
+	srcObj,
+	dstBucket,
+	dstObj string,
+) (*storage.ObjectAttrs, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*180)
+	defer cancel()
+
+	src := gcsClient.Bucket(srcBucket).Object(srcObj)
+	dst := gcsClient.Bucket(dstBucket).Object(dstObj)
+
+	attrs, err := dst.CopierFrom(src).Run(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "Unable to copy objectName %v/%v to %v/%v",
+			srcBucket, srcObj, dstBucket, dstObj)
+	}
+	return attrs, nil
+}
+
 // UploadCSVFile uploads an object given the name and bytes.
 func UploadCSVFile(
 	ctx context.Context,
@@ -101,7 +322,7 @@ func UploadCSVFile(
 		ContentDisposition: "attachment;filename=" + filepath.Base(objectName),
 	}
 	if _, err := o.Update(ctx, objectAttrsToUpdate); err != nil {
-		return errors.Wrapf(err, "ObjectHandle(%q).Update: %v", objectName)
+		return errors.Wrapf(err, "ObjectHandle(%q).Update", objectName)
 	}
 	return nil
 }
@@ -0,0 +1,145 @@
+package gcpapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	gcsfake "github.com/StevenACoffman/gcp-emulator-pool/gcpapi/storage/storagetest"
+)
+
+func TestUploadMetadataRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	fc := &gcsfake.GCSClient{}
+	fc.AddTestBucket("bucket", gcsfake.NewBucketHandle())
+
+	modTime := time.Date(2021, 3, 9, 11, 6, 57, 0, time.UTC)
+	metadata := map[string]string{"source": "roster-sync", "run": "42"}
+	err := uploadFile(ctx, fc, "bucket", "dir/file.csv", []byte("a,b\n"), modTime,
+		UploadOptions{Metadata: metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, attrs, err := downloadFile(ctx, fc, "bucket", "dir/file.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a,b\n" {
+		t.Errorf("Got %q, want %q", data, "a,b\n")
+	}
+	if !reflect.DeepEqual(attrs.Metadata, metadata) {
+		t.Errorf("Got metadata %v, want %v", attrs.Metadata, metadata)
+	}
+	if !attrs.CustomTime.Equal(modTime) {
+		t.Errorf("Got CustomTime %v, want %v", attrs.CustomTime, modTime)
+	}
+}
+
+func TestEnsureBucket(t *testing.T) {
+	ctx := context.Background()
+	fc := &gcsfake.GCSClient{}
+
+	if err := ensureBucket(ctx, fc, "project", "bucket", "US"); err != nil {
+		t.Fatal(err)
+	}
+	created := fc.Bucket("bucket")
+	attrs, err := created.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Location != "US" {
+		t.Errorf("Got location %q, want %q", attrs.Location, "US")
+	}
+
+	// The second call finds the bucket and leaves it alone.
+	if err := ensureBucket(ctx, fc, "project", "bucket", "EU"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fc.Bucket("bucket"); got != created {
+		t.Errorf("Got bucket %v, want the existing %v", got, created)
+	}
+	attrs, err = created.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Location != "US" {
+		t.Errorf("Got location %q after the second call, want %q", attrs.Location, "US")
+	}
+}
+
+func TestCopyObject(t *testing.T) {
+	ctx := context.Background()
+	fc := &gcsfake.GCSClient{}
+	fc.AddTestBucket("src", gcsfake.NewBucketHandle())
+	fc.AddTestBucket("dst", gcsfake.NewBucketHandle())
+
+	modTime := time.Date(2021, 3, 9, 11, 6, 57, 0, time.UTC)
+	err := uploadFile(ctx, fc, "src", "file.csv", []byte("a,b\n"), modTime, UploadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := copyObject(ctx, fc, "src", "file.csv", "dst", "copy.csv"); err != nil {
+		t.Fatal(err)
+	}
+
+	srcData, srcAttrs, err := downloadFile(ctx, fc, "src", "file.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstData, dstAttrs, err := downloadFile(ctx, fc, "dst", "copy.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dstData) != string(srcData) {
+		t.Errorf("Got %q, want %q", dstData, srcData)
+	}
+	if dstAttrs.ContentType != srcAttrs.ContentType {
+		t.Errorf("Got ContentType %q, want %q", dstAttrs.ContentType, srcAttrs.ContentType)
+	}
+	if !dstAttrs.CustomTime.Equal(modTime) {
+		t.Errorf("Got CustomTime %v, want %v", dstAttrs.CustomTime, modTime)
+	}
+}
+
+func TestUploadFiles(t *testing.T) {
+	ctx := context.Background()
+	fc := &gcsfake.GCSClient{}
+	bh := gcsfake.NewBucketHandle()
+	fc.AddTestBucket("bucket", bh)
+
+	files := make(map[string][]byte, 50)
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("file-%02d.csv", i)] = []byte(fmt.Sprintf("%d\n", i))
+	}
+	// One object that can't be written.
+	bh.Objs["file-07.csv"] = &gcsfake.ObjectHandle{
+		Name:           "file-07.csv",
+		Bucket:         bh,
+		Data:           new(bytes.Buffer),
+		WritesMustFail: true,
+	}
+
+	fileErrors, err := uploadFiles(ctx, fc, "bucket", files, 8)
+	if err == nil {
+		t.Errorf("Got no error, want one for file-07.csv")
+	}
+	if len(fileErrors) != 1 || fileErrors["file-07.csv"] == nil {
+		t.Errorf("Got per-file errors %v, want just file-07.csv", fileErrors)
+	}
+	for name, want := range files {
+		if name == "file-07.csv" {
+			continue
+		}
+		got, _, err := downloadFile(ctx, fc, "bucket", name)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+		} else if string(got) != string(want) {
+			t.Errorf("%v: got %q, want %q", name, got, want)
+		}
+	}
+}
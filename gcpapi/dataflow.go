@@ -2,6 +2,10 @@ package gcpapi
 
 import (
 	"context"
+	"path"
+	"regexp"
+	"strings"
+	"time"
 
 	"golang.org/x/oauth2/google"
 	dataflow "google.golang.org/api/dataflow/v1b3"
@@ -10,23 +14,51 @@ import (
 	"github.com/Khan/districts-jobs/pkg/errors"
 )
 
+// defaultClient is google.DefaultClient, swapped out in tests.
+var defaultClient = google.DefaultClient
+
+// DataflowOption configures NewDataflowService.
+type DataflowOption func(*dataflowConfig)
+
+type dataflowConfig struct {
+	scopes []string
+}
+
+// WithDataflowScopes requests the given OAuth scopes, e.g.
+// dataflow.ComputeScope, instead of dataflow.CloudPlatformScope.
+func WithDataflowScopes(scopes ...string) DataflowOption {
+	return func(cfg *dataflowConfig) {
+		cfg.scopes = scopes
+	}
+}
+
+// NewDataflowService returns a Dataflow service authorized by the given
+// service account credentials, or by Application Default Credentials if
+// credentials is empty.  It requests dataflow.CloudPlatformScope unless
+// WithDataflowScopes says otherwise.
 func NewDataflowService(
 	ctx context.Context,
 	credentials []byte,
+	opts ...DataflowOption,
 ) (*dataflow.Service, error) {
-	oauthClient, err := google.DefaultClient(ctx, dataflow.CloudPlatformScope)
-	if err != nil {
-		return nil, errors.Wrap(err, "Unable to get New Dataflow client")
+	cfg := dataflowConfig{scopes: []string{dataflow.CloudPlatformScope}}
+	for _, opt := range opts {
+		opt(&cfg)
 	}
+
 	var dataflowService *dataflow.Service
 	var sErr error
 	if len(credentials) > 0 {
 		dataflowService, sErr = dataflow.NewService(
 			ctx,
-			option.WithHTTPClient(oauthClient),
 			option.WithCredentialsJSON(credentials),
+			option.WithScopes(cfg.scopes...),
 		)
 	} else {
+		oauthClient, err := defaultClient(ctx, cfg.scopes...)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to get New Dataflow client")
+		}
 		dataflowService, sErr = dataflow.NewService(
 			ctx,
 			option.WithHTTPClient(oauthClient),
@@ -34,3 +66,118 @@ func NewDataflowService(
 	}
 	return dataflowService, errors.Wrap(sErr, "Unable to get New Dataflow client")
 }
+
+// LaunchClassicTemplate launches a job from the classic template stored at
+// gcsTemplatePath, which must be a gs:// URL.  The job is named after the
+// template and the current time.
+func LaunchClassicTemplate(
+	ctx context.Context,
+	svc *dataflow.Service,
+	projectID,
+	region,
+	gcsTemplatePath string,
+	params map[string]string,
+	env *dataflow.RuntimeEnvironment,
+) (*dataflow.Job, error) {
+	if !strings.HasPrefix(gcsTemplatePath, "gs://") ||
+		len(gcsTemplatePath) == len("gs://") {
+		return nil, errors.InvalidInput(
+			"Dataflow template path must be a gs:// URL",
+			errors.Fields{"gcsTemplatePath": gcsTemplatePath})
+	}
+
+	resp, err := svc.Projects.Locations.Templates.Launch(
+		projectID,
+		region,
+		&dataflow.LaunchTemplateParameters{
+			JobName:     templateJobName(gcsTemplatePath, time.Now()),
+			Parameters:  params,
+			Environment: env,
+		},
+	).GcsPath(gcsTemplatePath).Context(ctx).Do()
+	if err != nil {
+		return nil, errors.Wrapf(
+			err, "Unable to launch Dataflow template %v", gcsTemplatePath)
+	}
+	return resp.Job, nil
+}
+
+var invalidJobNameChars = regexp.MustCompile(`[^-a-z0-9]+`)
+
+// templateJobName returns a job name, valid for Dataflow, made from the
+// template's file name and the launch time.
+func templateJobName(gcsTemplatePath string, now time.Time) string {
+	name := strings.ToLower(path.Base(gcsTemplatePath))
+	name = strings.Trim(invalidJobNameChars.ReplaceAllString(name, "-"), "-")
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "template-" + name
+	}
+	return strings.TrimSuffix(name, "-") + "-" + now.UTC().Format("20060102-150405")
+}
+
+// terminalJobStates are the Dataflow job states that a job never leaves.
+var terminalJobStates = map[string]bool{
+	"JOB_STATE_DONE":      true,
+	"JOB_STATE_FAILED":    true,
+	"JOB_STATE_CANCELLED": true,
+	"JOB_STATE_UPDATED":   true,
+	"JOB_STATE_DRAINED":   true,
+}
+
+// CancelJobsByName cancels every job in the region whose name starts with
+// namePrefix and that hasn't already finished.  It returns the IDs of the
+// jobs it cancelled.
+func CancelJobsByName(
+	ctx context.Context,
+	svc *dataflow.Service,
+	projectID,
+	region,
+	namePrefix string,
+) ([]string, error) {
+	var toCancel []string
+	err := svc.Projects.Locations.Jobs.List(projectID, region).Pages(ctx,
+		func(resp *dataflow.ListJobsResponse) error {
+			for _, job := range resp.Jobs {
+				if strings.HasPrefix(job.Name, namePrefix) &&
+					!terminalJobStates[job.CurrentState] {
+					toCancel = append(toCancel, job.Id)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to list Dataflow jobs in %v", region)
+	}
+
+	cancelled := make([]string, 0, len(toCancel))
+	for _, jobID := range toCancel {
+		_, err := svc.Projects.Locations.Jobs.Update(
+			projectID,
+			region,
+			jobID,
+			&dataflow.Job{RequestedState: "JOB_STATE_CANCELLED"},
+		).Context(ctx).Do()
+		if err != nil {
+			return cancelled, errors.Wrapf(err, "Unable to cancel Dataflow job %v", jobID)
+		}
+		cancelled = append(cancelled, jobID)
+	}
+	return cancelled, nil
+}
+
+// GetJobMetrics returns the metrics of a job, e.g. its element counts.
+func GetJobMetrics(
+	ctx context.Context,
+	svc *dataflow.Service,
+	projectID,
+	region,
+	jobID string,
+) (*dataflow.JobMetrics, error) {
+	metrics, err := svc.Projects.Locations.Jobs.GetMetrics(projectID, region, jobID).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to get metrics for Dataflow job %v", jobID)
+	}
+	return metrics, nil
+}
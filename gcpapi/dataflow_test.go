@@ -0,0 +1,207 @@
+package gcpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	dataflow "google.golang.org/api/dataflow/v1b3"
+	"google.golang.org/api/option"
+)
+
+// stubTransport records each request and answers it with handler.
+type stubTransport struct {
+	requests []*http.Request
+	bodies   [][]byte
+	handler  func(*http.Request) (int, interface{})
+}
+
+func (st *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	st.requests = append(st.requests, req)
+	st.bodies = append(st.bodies, body)
+
+	code, resp := st.handler(req)
+	respBody, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(respBody)),
+		Request:    req,
+	}, nil
+}
+
+func newStubDataflowService(t *testing.T, st *stubTransport) *dataflow.Service {
+	svc, err := dataflow.NewService(context.Background(),
+		option.WithHTTPClient(&http.Client{Transport: st}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestLaunchClassicTemplate(t *testing.T) {
+	ctx := context.Background()
+	st := &stubTransport{handler: func(*http.Request) (int, interface{}) {
+		return http.StatusOK, &dataflow.LaunchTemplateResponse{
+			Job: &dataflow.Job{Id: "job-1"},
+		}
+	}}
+	svc := newStubDataflowService(t, st)
+
+	params := map[string]string{"input": "gs://bucket/in.csv"}
+	env := &dataflow.RuntimeEnvironment{MaxWorkers: 3}
+	job, err := LaunchClassicTemplate(ctx, svc, "project", "us-central1",
+		"gs://templates/Word_Count", params, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Id != "job-1" {
+		t.Errorf("Got job %q, want %q", job.Id, "job-1")
+	}
+
+	if len(st.requests) != 1 {
+		t.Fatalf("Got %d requests, want 1", len(st.requests))
+	}
+	req := st.requests[0]
+	wantPath := "/v1b3/projects/project/locations/us-central1/templates:launch"
+	if req.URL.Path != wantPath {
+		t.Errorf("Got path %q, want %q", req.URL.Path, wantPath)
+	}
+	if got := req.URL.Query().Get("gcsPath"); got != "gs://templates/Word_Count" {
+		t.Errorf("Got gcsPath %q, want %q", got, "gs://templates/Word_Count")
+	}
+	var sent dataflow.LaunchTemplateParameters
+	if err := json.Unmarshal(st.bodies[0], &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Parameters["input"] != "gs://bucket/in.csv" {
+		t.Errorf("Got parameters %v, want %v", sent.Parameters, params)
+	}
+	if sent.Environment == nil || sent.Environment.MaxWorkers != 3 {
+		t.Errorf("Got environment %+v, want %+v", sent.Environment, env)
+	}
+	if !strings.HasPrefix(sent.JobName, "word-count-") ||
+		invalidJobNameChars.MatchString(sent.JobName) {
+		t.Errorf("Got job name %q, want one starting with %q", sent.JobName, "word-count-")
+	}
+
+	// Template paths must be in GCS.
+	_, err = LaunchClassicTemplate(ctx, svc, "project", "us-central1",
+		"/local/Word_Count", params, env)
+	if err == nil {
+		t.Errorf("Got no error for a local template path")
+	}
+	if len(st.requests) != 1 {
+		t.Errorf("Got %d requests, want no more after an invalid path", len(st.requests))
+	}
+}
+
+func TestCancelJobsByName(t *testing.T) {
+	ctx := context.Background()
+	st := &stubTransport{handler: func(req *http.Request) (int, interface{}) {
+		if req.Method == http.MethodGet {
+			return http.StatusOK, &dataflow.ListJobsResponse{Jobs: []*dataflow.Job{
+				{Id: "1", Name: "nightly-import-a", CurrentState: "JOB_STATE_RUNNING"},
+				{Id: "2", Name: "nightly-import-b", CurrentState: "JOB_STATE_DONE"},
+				{Id: "3", Name: "weekly-export", CurrentState: "JOB_STATE_RUNNING"},
+				{Id: "4", Name: "nightly-import-c", CurrentState: "JOB_STATE_PENDING"},
+				{Id: "5", Name: "nightly-import-d", CurrentState: "JOB_STATE_CANCELLED"},
+			}}
+		}
+		return http.StatusOK, &dataflow.Job{}
+	}}
+	svc := newStubDataflowService(t, st)
+
+	cancelled, err := CancelJobsByName(ctx, svc, "project", "us-central1", "nightly-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1", "4"}; !reflect.DeepEqual(cancelled, want) {
+		t.Errorf("Got cancelled %v, want %v", cancelled, want)
+	}
+
+	// One list and two updates.
+	if len(st.requests) != 3 {
+		t.Fatalf("Got %d requests, want 3", len(st.requests))
+	}
+	for i, jobID := range cancelled {
+		req := st.requests[i+1]
+		wantPath := "/v1b3/projects/project/locations/us-central1/jobs/" + jobID
+		if req.Method != http.MethodPut || req.URL.Path != wantPath {
+			t.Errorf("Got %v %v, want PUT %v", req.Method, req.URL.Path, wantPath)
+		}
+		var sent dataflow.Job
+		if err := json.Unmarshal(st.bodies[i+1], &sent); err != nil {
+			t.Fatal(err)
+		}
+		if sent.RequestedState != "JOB_STATE_CANCELLED" {
+			t.Errorf("Got requested state %q, want JOB_STATE_CANCELLED", sent.RequestedState)
+		}
+	}
+}
+
+func TestGetJobMetrics(t *testing.T) {
+	ctx := context.Background()
+	st := &stubTransport{handler: func(*http.Request) (int, interface{}) {
+		return http.StatusOK, &dataflow.JobMetrics{Metrics: []*dataflow.MetricUpdate{
+			{Name: &dataflow.MetricStructuredName{Name: "ElementCount"}, Scalar: 42},
+		}}
+	}}
+	svc := newStubDataflowService(t, st)
+
+	metrics, err := GetJobMetrics(ctx, svc, "project", "us-central1", "job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantPath := "/v1b3/projects/project/locations/us-central1/jobs/job-1/metrics"
+	if got := st.requests[0].URL.Path; got != wantPath {
+		t.Errorf("Got path %q, want %q", got, wantPath)
+	}
+	if len(metrics.Metrics) != 1 {
+		t.Fatalf("Got %d metrics, want 1", len(metrics.Metrics))
+	}
+	m := metrics.Metrics[0]
+	if m.Name.Name != "ElementCount" || m.Scalar != float64(42) {
+		t.Errorf("Got metric %v=%v, want ElementCount=42", m.Name.Name, m.Scalar)
+	}
+}
+
+func TestNewDataflowServiceScopes(t *testing.T) {
+	ctx := context.Background()
+	var gotScopes []string
+	defer func(orig func(context.Context, ...string) (*http.Client, error)) {
+		defaultClient = orig
+	}(defaultClient)
+	defaultClient = func(_ context.Context, scopes ...string) (*http.Client, error) {
+		gotScopes = scopes
+		return &http.Client{}, nil
+	}
+
+	if _, err := NewDataflowService(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{dataflow.CloudPlatformScope}; !reflect.DeepEqual(gotScopes, want) {
+		t.Errorf("Got default scopes %v, want %v", gotScopes, want)
+	}
+
+	_, err := NewDataflowService(ctx, nil, WithDataflowScopes(dataflow.ComputeScope))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{dataflow.ComputeScope}; !reflect.DeepEqual(gotScopes, want) {
+		t.Errorf("Got scopes %v, want %v", gotScopes, want)
+	}
+}
@@ -0,0 +1,23 @@
+// Package dscommon holds what is shared between the datastore test
+// doubles in dsfake and dsmock, so that tests can be written once and
+// run against either backend.
+package dscommon
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+)
+
+// TestDatastore is the minimal set of operations supported by both
+// dsmock.Client and dsfake.TestClient.
+type TestDatastore interface {
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	Delete(ctx context.Context, key *datastore.Key) error
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+	// Reset removes every stored entity.
+	Reset(ctx context.Context) error
+	// GetKeys lists all keys currently stored, in no particular order.
+	GetKeys() []datastore.Key
+}
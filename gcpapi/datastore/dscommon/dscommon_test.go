@@ -0,0 +1,84 @@
+package dscommon_test
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+
+	"github.com/StevenACoffman/gcp-emulator-pool/gcpapi/datastore/dscommon"
+	dsifake "github.com/StevenACoffman/gcp-emulator-pool/gcpapi/datastore/dsfake"
+	"github.com/StevenACoffman/gcp-emulator-pool/gcpapi/datastore/dsmock"
+)
+
+var (
+	_ dscommon.TestDatastore = (*dsmock.Client)(nil)
+	_ dscommon.TestDatastore = (*dsifake.TestClient)(nil)
+)
+
+type Object struct {
+	Value string
+}
+
+func TestBackends(t *testing.T) {
+	ctx := context.Background()
+	backends := map[string]dscommon.TestDatastore{
+		"dsmock": dsmock.NewClient(),
+		"dsfake": dsifake.NewTestClient(ctx),
+	}
+	for name, client := range backends {
+		t.Run(name, func(t *testing.T) {
+			testBackend(ctx, t, client)
+		})
+	}
+}
+
+func testBackend(ctx context.Context, t *testing.T, client dscommon.TestDatastore) {
+	k1 := datastore.NameKey("Object", "o1", nil)
+	k2 := datastore.NameKey("Object", "o2", nil)
+	k3 := datastore.NameKey("Object", "o3", nil)
+
+	if _, err := client.Put(ctx, k1, &Object{"o1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(ctx, k2, &Object{"o2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Object
+	if err := client.Get(ctx, k1, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Value != "o1" {
+		t.Errorf("Got %q, want %q", got.Value, "o1")
+	}
+	if err := client.Get(ctx, k3, &got); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Got %v, want ErrNoSuchEntity", err)
+	}
+
+	objs := make([]Object, 2)
+	if err := client.GetMulti(ctx, []*datastore.Key{k1, k2}, objs); err != nil {
+		t.Fatal(err)
+	}
+	if objs[0].Value != "o1" || objs[1].Value != "o2" {
+		t.Errorf("Got %v, want [o1 o2]", objs)
+	}
+
+	if got := len(client.GetKeys()); got != 2 {
+		t.Errorf("Got %d keys, want 2", got)
+	}
+
+	if err := client.Delete(ctx, k1); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Get(ctx, k1, &got); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Got %v after Delete, want ErrNoSuchEntity", err)
+	}
+
+	if err := client.Reset(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(client.GetKeys()); got != 0 {
+		t.Errorf("Got %d keys after Reset, want 0", got)
+	}
+}
@@ -1,6 +1,7 @@
 // Package dsifake implements a fake Datastore
 // per https://github.com/googleapis/google-cloud-go/blob/master/testing.md
-// The crude key value store does not currently support transactions
+// The crude key value store only validates transactions; it doesn't
+// isolate them.
 package dsifake
 
 import (
@@ -8,17 +9,22 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
 	"google.golang.org/api/option"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -32,10 +38,36 @@ type FakeDatastore struct {
 	datastorepb.UnimplementedDatastoreServer // For unimplemented methods
 	lock                                     sync.Mutex
 	objects                                  map[string][]byte
+	// lookupLimit is the most keys a single Lookup will resolve; the
+	// rest are returned as deferred.  Zero means no limit.
+	lookupLimit int
+	// transactions holds the tokens of transactions that have begun but
+	// not yet been committed or rolled back.
+	transactions map[string]bool
+	nextTxID     int
+	// contention is the probability that a transactional commit fails
+	// with Aborted, as if it had conflicted with another transaction.
+	contention float64
+	rng        *rand.Rand
+	// addr is the address the fake's gRPC server listens on.
+	addr string
 }
 
-// NewClient returns a fake client that uses the FakeDatastore.
+// Addr returns the address of the fake's gRPC server, so that tests can
+// dial additional clients that share its data.
+func (c *FakeDatastore) Addr() string {
+	return c.addr
+}
+
+// NewClient returns a fake client that uses the FakeDatastore, for the
+// project "dsfake".
 func NewClient(ctx context.Context) (*datastore.Client, *FakeDatastore) {
+	return NewClientWithProject(ctx, "dsfake")
+}
+
+// NewClientWithProject is like NewClient, but the client is for the given
+// project, so that its keys are partitioned by that project ID.
+func NewClientWithProject(ctx context.Context, projectID string) (*datastore.Client, *FakeDatastore) {
 	cctx, cancel := context.WithCancel(ctx)
 	// defer cancel()
 	if flag.Lookup("test.v") == nil {
@@ -43,7 +75,10 @@ func NewClient(ctx context.Context) (*datastore.Client, *FakeDatastore) {
 	}
 
 	// Setup the fake server.
-	fakeDatastore := &FakeDatastore{objects: make(map[string][]byte, 10)}
+	fakeDatastore := &FakeDatastore{
+		objects:      make(map[string][]byte, 10),
+		transactions: map[string]bool{},
+	}
 	l, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		panic(err)
@@ -51,6 +86,7 @@ func NewClient(ctx context.Context) (*datastore.Client, *FakeDatastore) {
 	gsrv := grpc.NewServer()
 	datastorepb.RegisterDatastoreServer(gsrv, fakeDatastore)
 	fakeServerAddr := l.Addr().String()
+	fakeDatastore.addr = fakeServerAddr
 
 	go func() {
 		if err := gsrv.Serve(l); err != nil {
@@ -70,7 +106,7 @@ func NewClient(ctx context.Context) (*datastore.Client, *FakeDatastore) {
 
 	// Create a client.
 	client, err := datastore.NewClient(cctx,
-		"dsfake",
+		projectID,
 		option.WithEndpoint(fakeServerAddr),
 		option.WithoutAuthentication(),
 		option.WithGRPCDialOption(grpc.WithInsecure()),
@@ -82,6 +118,73 @@ func NewClient(ctx context.Context) (*datastore.Client, *FakeDatastore) {
 	return client, fakeDatastore
 }
 
+// TestClient pairs a datastore client with the FakeDatastore it talks
+// to, so that it can be used wherever a dscommon.TestDatastore is
+// expected.
+type TestClient struct {
+	*datastore.Client
+	Fake *FakeDatastore
+}
+
+// NewTestClient returns a TestClient backed by a new FakeDatastore.
+func NewTestClient(ctx context.Context) *TestClient {
+	client, fake := NewClient(ctx)
+	return &TestClient{Client: client, Fake: fake}
+}
+
+// Reset removes every entity saved in the fake.
+func (c *TestClient) Reset(_ context.Context) error {
+	c.Fake.Reset()
+	return nil
+}
+
+// GetKeys lists all keys saved in the fake.
+func (c *TestClient) GetKeys() []datastore.Key {
+	dsKeys := c.Fake.GetDSKeys()
+	keys := make([]datastore.Key, 0, len(dsKeys))
+	for _, k := range dsKeys {
+		if k != nil {
+			keys = append(keys, *k)
+		}
+	}
+	return keys
+}
+
+// Reset removes every entity saved in the fake.
+func (c *FakeDatastore) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.objects = make(map[string][]byte, 10)
+}
+
+// BulkLoad stores entities directly in the fake, bypassing the gRPC
+// layer, which is much faster than Put when seeding a lot of test data.
+// Each value must be a *datastorepb.Entity; its Key is set from the map
+// key.  Existing entities with the same keys are overwritten.
+func (c *FakeDatastore) BulkLoad(entities map[*datastore.Key]proto.Message) error {
+	encoded := make(map[string][]byte, len(entities))
+	for k, m := range entities {
+		e, ok := m.(*datastorepb.Entity)
+		if !ok {
+			return fmt.Errorf("dsifake: BulkLoad got %T for key %v, want *datastorepb.Entity", m, k)
+		}
+		e = proto.Clone(e).(*datastorepb.Entity)
+		e.Key = keyToProto(k)
+		b, err := proto.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("dsifake: BulkLoad could not marshal key %v: %w", k, err)
+		}
+		encoded[protoKeyToKeyName(e.Key)] = b
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name, b := range encoded {
+		c.objects[name] = b
+	}
+	return nil
+}
+
 // GetDSKeys lists all keys saved in the fake client.
 func (c *FakeDatastore) GetDSKeys() []*datastore.Key {
 	c.lock.Lock()
@@ -101,6 +204,23 @@ func (c *FakeDatastore) GetDSKeys() []*datastore.Key {
 	return keys
 }
 
+// CountByKind returns the number of entities saved in the fake, by kind.
+func (c *FakeDatastore) CountByKind() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := map[string]int{}
+	for _, v := range c.objects {
+		var e datastorepb.Entity
+		if err := proto.Unmarshal(v, &e); err != nil {
+			continue
+		}
+		if path := e.GetKey().GetPath(); len(path) > 0 {
+			counts[path[len(path)-1].Kind]++
+		}
+	}
+	return counts
+}
+
 func (c *FakeDatastore) GetMap() map[string][]byte {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -116,40 +236,98 @@ func (c *FakeDatastore) Commit(
 	_ context.Context,
 	in *datastorepb.CommitRequest,
 ) (*datastorepb.CommitResponse, error) {
-	keys := make([]*datastorepb.Key, 0, len(in.GetMutations()))
+	if err := c.endTransaction(in.GetMode(), in.GetTransaction()); err != nil {
+		return nil, err
+	}
+
+	// Marshal everything up front, so that a bad mutation fails the
+	// whole commit rather than being silently skipped.
+	mutations := in.GetMutations()
+	encoded := make([][]byte, len(mutations))
+	var marshalErrs []string
+	for i, v := range mutations {
+		var entity *datastorepb.Entity
+		switch op := v.GetOperation().(type) {
+		case *datastorepb.Mutation_Insert:
+			entity = op.Insert
+		case *datastorepb.Mutation_Update:
+			entity = op.Update
+		case *datastorepb.Mutation_Upsert:
+			entity = op.Upsert
+		default:
+			continue
+		}
+		// The client leaves the project out of keys; fill it in from the
+		// request, as datastore does.
+		setProject(entity.Key, in.GetProjectId())
+		b, err := proto.Marshal(entity)
+		if err != nil {
+			marshalErrs = append(marshalErrs, fmt.Sprintf("mutation %d: %v", i, err))
+			continue
+		}
+		encoded[i] = b
+	}
+	if len(marshalErrs) > 0 {
+		return nil, status.Errorf(codes.Internal,
+			"dsifake: could not marshal entities: %s", strings.Join(marshalErrs, "; "))
+	}
+
+	keys := make([]*datastorepb.Key, 0, len(mutations))
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	// Mutations are staged in changes (where nil means deleted) and only
+	// applied once they have all succeeded, so that commits are atomic.
+	changes := map[string][]byte{}
+	exists := func(name string) bool {
+		if b, ok := changes[name]; ok {
+			return b != nil
+		}
+		_, ok := c.objects[name]
+		return ok
+	}
 	// c.OutputObjects()
-	for _, v := range in.GetMutations() {
+	for i, v := range mutations {
 		switch op := v.GetOperation().(type) {
+		case *datastorepb.Mutation_Insert:
+			pbKey := op.Insert.Key
+			name := protoKeyToKeyName(pbKey)
+			if exists(name) {
+				return nil, status.Errorf(codes.AlreadyExists,
+					"dsifake: entity already exists: %v", protoToKey(pbKey))
+			}
+			keys = append(keys, pbKey)
+			changes[name] = encoded[i]
+
 		case *datastorepb.Mutation_Update:
 			pbKey := op.Update.Key
-
-			_, ok := c.objects[protoKeyToKeyName(pbKey)]
-			if ok {
-				if b, marshalErr := proto.Marshal(op.Update); marshalErr == nil {
-					keys = append(keys, pbKey)
-					c.objects[protoKeyToKeyName(pbKey)] = b
-				}
+			name := protoKeyToKeyName(pbKey)
+			if exists(name) {
+				keys = append(keys, pbKey)
+				changes[name] = encoded[i]
 			}
 
 		case *datastorepb.Mutation_Upsert:
 			pbKey := op.Upsert.Key
-			if b, err := proto.Marshal(op.Upsert); err == nil {
-				keys = append(keys, pbKey)
-				c.objects[protoKeyToKeyName(pbKey)] = b
-			}
+			keys = append(keys, pbKey)
+			changes[protoKeyToKeyName(pbKey)] = encoded[i]
 
 		case *datastorepb.Mutation_Delete:
 			pbKey := op.Delete
-			_, ok := c.objects[protoKeyToKeyName(pbKey)]
-			if ok {
+			name := protoKeyToKeyName(pbKey)
+			if exists(name) {
 				keys = append(keys, op.Delete)
-				delete(c.objects, protoKeyToKeyName(pbKey))
+				changes[name] = nil
 			}
 
 		}
 	}
+	for name, b := range changes {
+		if b == nil {
+			delete(c.objects, name)
+		} else {
+			c.objects[name] = b
+		}
+	}
 
 	var mutationResults []*datastorepb.MutationResult
 	for i := range keys {
@@ -169,6 +347,84 @@ func (c *FakeDatastore) Commit(
 	return &response, nil
 }
 
+// BeginTransaction starts a new transaction.  The fake doesn't isolate
+// transactions from each other; it just hands out a token which Commit
+// or Rollback must then be called with.
+func (c *FakeDatastore) BeginTransaction(
+	_ context.Context,
+	_ *datastorepb.BeginTransactionRequest,
+) (*datastorepb.BeginTransactionResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nextTxID++
+	tx := []byte(fmt.Sprintf("tx%d", c.nextTxID))
+	c.transactions[string(tx)] = true
+	return &datastorepb.BeginTransactionResponse{Transaction: tx}, nil
+}
+
+// Rollback abandons a transaction.
+func (c *FakeDatastore) Rollback(
+	_ context.Context,
+	in *datastorepb.RollbackRequest,
+) (*datastorepb.RollbackResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.transactions[string(in.GetTransaction())] {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"dsifake: unknown transaction %q", in.GetTransaction())
+	}
+	delete(c.transactions, string(in.GetTransaction()))
+	return &datastorepb.RollbackResponse{}, nil
+}
+
+// endTransaction checks that a commit's transaction token matches its
+// mode, as the real API does, and ends the transaction if there is one.
+func (c *FakeDatastore) endTransaction(mode datastorepb.CommitRequest_Mode, tx []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if mode != datastorepb.CommitRequest_TRANSACTIONAL {
+		if len(tx) > 0 {
+			return status.Errorf(codes.InvalidArgument,
+				"dsifake: transaction set on a non-transactional commit")
+		}
+		return nil
+	}
+	if !c.transactions[string(tx)] {
+		return status.Errorf(codes.InvalidArgument,
+			"dsifake: transactional commit without a valid transaction: %q", tx)
+	}
+	delete(c.transactions, string(tx))
+	if c.contention > 0 && c.rng.Float64() < c.contention {
+		return status.Errorf(codes.Aborted, "dsifake: injected transaction contention")
+	}
+	return nil
+}
+
+// WithInjectedContention makes each transactional commit fail with
+// Aborted with probability prob, simulating conflicts with concurrent
+// transactions, so that client retry logic can be tested.  An aborted
+// commit makes no changes.  It returns c, for chaining.
+func (c *FakeDatastore) WithInjectedContention(prob float64) *FakeDatastore {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.contention = prob
+	if c.rng == nil {
+		c.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return c
+}
+
+// SetLookupLimit sets the most keys a single Lookup RPC will resolve.
+// Any keys beyond the limit are returned in LookupResponse.Deferred, as
+// the real datastore does for large batches, so that the client's
+// deferred-retry handling is exercised.  Zero (the default) means no
+// limit.
+func (c *FakeDatastore) SetLookupLimit(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lookupLimit = n
+}
+
 func (c *FakeDatastore) Lookup(
 	_ context.Context,
 	in *datastorepb.LookupRequest,
@@ -176,6 +432,7 @@ func (c *FakeDatastore) Lookup(
 	pbKeys := in.GetKeys()
 	found := make([]*datastorepb.EntityResult, 0, len(pbKeys))
 	var missing []*datastorepb.EntityResult
+	var deferred []*datastorepb.Key
 	response := datastorepb.LookupResponse{
 		Found:    nil,
 		Missing:  nil,
@@ -186,6 +443,11 @@ func (c *FakeDatastore) Lookup(
 	defer c.lock.Unlock()
 	// c.OutputObjects()
 
+	if c.lookupLimit > 0 && len(pbKeys) > c.lookupLimit {
+		deferred = pbKeys[c.lookupLimit:]
+		pbKeys = pbKeys[:c.lookupLimit]
+	}
+
 	for i := range pbKeys {
 		v, ok := c.objects[protoKeyToKeyName(pbKeys[i])]
 		if ok {
@@ -202,6 +464,7 @@ func (c *FakeDatastore) Lookup(
 	}
 	response.Found = found
 	response.Missing = missing
+	response.Deferred = deferred
 
 	return &response, nil
 }
@@ -242,26 +505,41 @@ func entityResultFromEntity(e *datastorepb.Entity) *datastorepb.EntityResult {
 }
 
 // protoKeyToKeyName decodes a protocol buffer representation of a key into an
-// equivalent *datastore.Key string.
+// equivalent *datastore.Key string.  Every element of the path is
+// included, so that keys with the same kind and name but different
+// ancestors don't collide.
 func protoKeyToKeyName(p *datastorepb.Key) string {
 	var namespace string
 	if partition := p.PartitionId; partition != nil {
 		namespace = partition.NamespaceId
 	}
-	keyName, kind := getKeyNameAndKindFromPath(p.Path)
+	parts := make([]string, 0, 1+2*len(p.Path))
+	parts = append(parts, strconv.Quote(namespace))
+	for _, el := range p.Path {
+		parts = append(parts, strconv.Quote(el.Kind), strconv.Quote(pathElementName(el)))
+	}
+	return strings.Join(parts, "/")
+}
 
-	return fmt.Sprintf("%s/%s/%s", namespace, kind, keyName)
+// setProject sets the project ID in the partition of k.
+func setProject(k *datastorepb.Key, projectID string) {
+	if k == nil {
+		return
+	}
+	if k.PartitionId == nil {
+		k.PartitionId = &datastorepb.PartitionId{}
+	}
+	k.PartitionId.ProjectId = projectID
 }
 
-func getKeyNameAndKindFromPath(path []*datastorepb.Key_PathElement) (name string, kind string) {
-	for _, el := range path {
-		kind = el.Kind
-		name = el.GetName()
-		if name != "" && el.GetId() != 0 {
-			name = strconv.FormatInt(el.GetId(), 10)
-		}
+// pathElementName returns the ID or the name of a key path element,
+// prefixed with "id:" or "name:" so that IDKey(kind, 5, nil) and
+// NameKey(kind, "5", nil) are stored as distinct entities.
+func pathElementName(el *datastorepb.Key_PathElement) string {
+	if el.GetId() != 0 {
+		return "id:" + strconv.FormatInt(el.GetId(), 10)
 	}
-	return name, kind
+	return "name:" + el.GetName()
 }
 
 func protoToKey(p *datastorepb.Key) *datastore.Key {
@@ -283,42 +561,74 @@ func protoToKey(p *datastorepb.Key) *datastore.Key {
 	return key
 }
 
-// WhyInvalidKey returns why the key is valid. useful for debugging
+// keyToProto converts a *datastore.Key to its protocol buffer
+// representation, as the datastore client would send it.
+func keyToProto(k *datastore.Key) *datastorepb.Key {
+	if k == nil {
+		return nil
+	}
+	namespace := k.Namespace
+	var path []*datastorepb.Key_PathElement
+	for ; k != nil; k = k.Parent {
+		el := &datastorepb.Key_PathElement{Kind: k.Kind}
+		if k.ID != 0 {
+			el.IdType = &datastorepb.Key_PathElement_Id{Id: k.ID}
+		} else if k.Name != "" {
+			el.IdType = &datastorepb.Key_PathElement_Name{Name: k.Name}
+		}
+		path = append([]*datastorepb.Key_PathElement{el}, path...)
+	}
+	return &datastorepb.Key{
+		PartitionId: &datastorepb.PartitionId{NamespaceId: namespace},
+		Path:        path,
+	}
+}
+
+// WhyInvalidKey prints why the key is invalid, if it is.  Useful for
+// debugging; tests should use KeyValidationError.
 func WhyInvalidKey(k *datastore.Key) {
+	for _, problem := range keyProblems(k) {
+		fmt.Fprintln(os.Stdout, "\n**"+problem)
+	}
+}
+
+// KeyValidationError returns an error listing everything wrong with the
+// key, or nil if it is valid.
+func KeyValidationError(k *datastore.Key) error {
+	problems := keyProblems(k)
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("dsifake: invalid key %v: %s", k, strings.Join(problems, "; "))
+}
+
+func keyProblems(k *datastore.Key) []string {
 	if k == nil {
-		fmt.Fprintln(os.Stdout, "\n**key was nil")
+		return []string{"key was nil"}
 	}
+	var problems []string
 	for ; k != nil; k = k.Parent {
 		if k.Kind == "" {
-			fmt.Fprintln(os.Stdout, "\n**key had empty Kind")
+			problems = append(problems, "key had empty Kind")
 		}
 		if k.Name != "" && k.ID != 0 {
-			fmt.Fprintln(os.Stdout, "\n**key had empty Name or ID = 0")
+			problems = append(problems, "key had both a Name and an ID")
 		}
 
 		if k.Parent != nil {
 			if k.Parent.Incomplete() {
-				fmt.Fprintln(os.Stdout, "\n**key had incomplete parent")
+				problems = append(problems, "key had incomplete parent")
 			}
 			if k.Parent.Namespace != k.Namespace {
-				fmt.Fprintln(os.Stdout, "\n**key had different namespace from parent")
+				problems = append(problems, "key had different namespace from parent")
 			}
 		}
 	}
+	return problems
 }
 
 /* TODO(steve): implement remaining methods as necessary
 
-func (c *FakeDatastore) RunQuery(context.Context, *datastorepb.RunQueryRequest) (*datastorepb.RunQueryResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method RunQuery not implemented")
-}
-func (c *FakeDatastore) BeginTransaction(context.Context, *datastorepb.BeginTransactionRequest) (*datastorepb.BeginTransactionResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method BeginTransaction not implemented")
-}
-
-func (c *FakeDatastore) Rollback(context.Context, *datastorepb.RollbackRequest) (*datastorepb.RollbackResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method Rollback not implemented")
-}
 func (c *FakeDatastore) AllocateIds(context.Context, *datastorepb.AllocateIdsRequest) (*datastorepb.AllocateIdsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method AllocateIds not implemented")
 }
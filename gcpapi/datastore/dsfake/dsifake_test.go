@@ -2,10 +2,19 @@ package dsifake
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"reflect"
+	"strings"
 	"testing"
 
 	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+	"google.golang.org/api/option"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func init() {
@@ -134,3 +143,458 @@ func contains(s []Object, e Object) bool {
 	}
 	return false
 }
+
+func bulkEntities(kind string, n int) map[*datastore.Key]proto.Message {
+	entities := make(map[*datastore.Key]proto.Message, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("o%d", i)
+		entities[datastore.NameKey(kind, name, nil)] = &datastorepb.Entity{
+			Properties: map[string]*datastorepb.Value{
+				"Value": {ValueType: &datastorepb.Value_StringValue{StringValue: name}},
+			},
+		}
+	}
+	return entities
+}
+
+func TestBulkLoad(t *testing.T) {
+	ctx := context.Background()
+	client, fakeDS := NewClient(ctx)
+
+	const kind = "TestBulkLoad"
+	const n = 10000
+	must(t, fakeDS.BulkLoad(bulkEntities(kind, n)))
+
+	if got := len(fakeDS.GetDSKeys()); got != n {
+		t.Fatalf("Got %d keys, want %d", got, n)
+	}
+	for _, i := range []int{0, 1, 4999, n - 1} {
+		name := fmt.Sprintf("o%d", i)
+		var o Object
+		must(t, client.Get(ctx, datastore.NameKey(kind, name, nil), &o))
+		if o.Value != name {
+			t.Errorf("Got %q, want %q", o.Value, name)
+		}
+	}
+
+	err := fakeDS.BulkLoad(map[*datastore.Key]proto.Message{
+		datastore.NameKey(kind, "bad", nil): &datastorepb.Key{},
+	})
+	if err == nil {
+		t.Error("Expected an error loading a non-Entity message")
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	_, fakeDS := NewClient(context.Background())
+	entities := bulkEntities("BenchmarkBulkLoad", 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := fakeDS.BulkLoad(entities); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAncestorKeysDontCollide(t *testing.T) {
+	ctx := context.Background()
+	client, fakeDS := NewClient(ctx)
+
+	const kind = "TestAncestorKeys"
+	parent1 := datastore.NameKey("Parent", "p1", nil)
+	parent2 := datastore.NameKey("Parent", "p2", nil)
+	k1 := datastore.NameKey(kind, "child", parent1)
+	k2 := datastore.NameKey(kind, "child", parent2)
+	k3 := datastore.NameKey(kind, "child", nil)
+
+	for _, k := range []*datastore.Key{k1, k2, k3} {
+		_, err := client.Put(ctx, k, &Object{k.String()})
+		must(t, err)
+	}
+	if got := len(fakeDS.GetDSKeys()); got != 3 {
+		t.Fatalf("Got %d keys, want 3", got)
+	}
+	for _, k := range []*datastore.Key{k1, k2, k3} {
+		var o Object
+		must(t, client.Get(ctx, k, &o))
+		if o.Value != k.String() {
+			t.Errorf("Got %q for key %v, want %q", o.Value, k, k.String())
+		}
+	}
+
+	must(t, client.Delete(ctx, k1))
+	var o Object
+	must(t, client.Get(ctx, k2, &o))
+	if err := client.Get(ctx, k1, &o); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Got %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestIDAndNameKeysAreDistinct(t *testing.T) {
+	ctx := context.Background()
+	client, fakeDS := NewClient(ctx)
+
+	const kind = "TestIDAndNameKeys"
+	nameKey := datastore.NameKey(kind, "5", nil)
+	idKey := datastore.IDKey(kind, 5, nil)
+
+	_, err := client.Put(ctx, nameKey, &Object{"name"})
+	must(t, err)
+	_, err = client.Put(ctx, idKey, &Object{"id"})
+	must(t, err)
+
+	if got := len(fakeDS.GetDSKeys()); got != 2 {
+		t.Fatalf("Got %d keys, want 2", got)
+	}
+	var o Object
+	must(t, client.Get(ctx, nameKey, &o))
+	if o.Value != "name" {
+		t.Errorf("Got %q for the name key, want %q", o.Value, "name")
+	}
+	must(t, client.Get(ctx, idKey, &o))
+	if o.Value != "id" {
+		t.Errorf("Got %q for the ID key, want %q", o.Value, "id")
+	}
+}
+
+func TestLookupDeferred(t *testing.T) {
+	ctx := context.Background()
+	client, fakeDS := NewClient(ctx)
+	fakeDS.SetLookupLimit(2)
+
+	const kind = "TestLookupDeferred"
+	var keys []*datastore.Key
+	for i := 0; i < 5; i++ {
+		k := datastore.NameKey(kind, fmt.Sprintf("o%d", i), nil)
+		_, err := client.Put(ctx, k, &Object{k.Name})
+		must(t, err)
+		keys = append(keys, k)
+	}
+
+	var pbKeys []*datastorepb.Key
+	for _, k := range keys {
+		pbKeys = append(pbKeys, keyToProto(k))
+	}
+	res, err := fakeDS.Lookup(ctx, &datastorepb.LookupRequest{Keys: pbKeys})
+	must(t, err)
+	if len(res.Found) != 2 || len(res.Deferred) != 3 {
+		t.Fatalf("Got %d found and %d deferred, want 2 and 3", len(res.Found), len(res.Deferred))
+	}
+	res, err = fakeDS.Lookup(ctx, &datastorepb.LookupRequest{Keys: res.Deferred})
+	must(t, err)
+	if len(res.Found) != 2 || len(res.Deferred) != 1 {
+		t.Fatalf("Got %d found and %d deferred, want 2 and 1", len(res.Found), len(res.Deferred))
+	}
+
+	// The client retries deferred keys until they're all resolved.
+	objs := make([]Object, len(keys))
+	must(t, client.GetMulti(ctx, keys, objs))
+	for i, k := range keys {
+		if objs[i].Value != k.Name {
+			t.Errorf("Got %q, want %q", objs[i].Value, k.Name)
+		}
+	}
+}
+
+func TestCommitMarshalError(t *testing.T) {
+	ctx := context.Background()
+	_, fakeDS := NewClient(ctx)
+
+	good := &datastorepb.Entity{Key: keyToProto(datastore.NameKey("TestCommit", "good", nil))}
+	bad := &datastorepb.Entity{
+		Key: keyToProto(datastore.NameKey("TestCommit", "bad", nil)),
+		Properties: map[string]*datastorepb.Value{
+			// Invalid UTF-8 can't be marshalled into a proto3 string.
+			"Value": {ValueType: &datastorepb.Value_StringValue{StringValue: "\xff"}},
+		},
+	}
+	_, err := fakeDS.Commit(ctx, &datastorepb.CommitRequest{
+		Mutations: []*datastorepb.Mutation{
+			{Operation: &datastorepb.Mutation_Upsert{Upsert: good}},
+			{Operation: &datastorepb.Mutation_Upsert{Upsert: bad}},
+		},
+	})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("Got %v, want an Internal error", err)
+	}
+	if !strings.Contains(err.Error(), "mutation 1") {
+		t.Errorf("Got %v, want it to mention the bad mutation", err)
+	}
+	if got := len(fakeDS.GetDSKeys()); got != 0 {
+		t.Errorf("Got %d keys after a failed commit, want 0", got)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	ctx := context.Background()
+	client, fakeDS := NewClient(ctx)
+
+	k1 := datastore.NameKey("TestInsert", "o1", nil)
+	k2 := datastore.NameKey("TestInsert", "o2", nil)
+	_, err := client.Mutate(ctx, datastore.NewInsert(k1, &Object{"o1"}))
+	must(t, err)
+	var o Object
+	must(t, client.Get(ctx, k1, &o))
+	if o.Value != "o1" {
+		t.Errorf("Got %q, want %q", o.Value, "o1")
+	}
+
+	// Inserting an existing key fails the whole batch.
+	_, err = client.Mutate(ctx,
+		datastore.NewInsert(k2, &Object{"o2"}),
+		datastore.NewInsert(k1, &Object{"o1-again"}),
+	)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Got %v, want AlreadyExists", err)
+	}
+	must(t, client.Get(ctx, k1, &o))
+	if o.Value != "o1" {
+		t.Errorf("Got %q after a failed insert, want %q", o.Value, "o1")
+	}
+	if got := len(fakeDS.GetDSKeys()); got != 1 {
+		t.Errorf("Got %d keys, want 1", got)
+	}
+}
+
+func TestCountByKind(t *testing.T) {
+	ctx := context.Background()
+	client, fakeDS := NewClient(ctx)
+
+	parent := datastore.NameKey("Parent", "p", nil)
+	keys := []*datastore.Key{
+		datastore.NameKey("Apple", "a1", nil),
+		datastore.NameKey("Apple", "a2", nil),
+		datastore.NameKey("Apple", "a3", parent),
+		datastore.NameKey("Banana", "b1", nil),
+	}
+	for _, k := range keys {
+		_, err := client.Put(ctx, k, &Object{k.Name})
+		must(t, err)
+	}
+
+	got := fakeDS.CountByKind()
+	want := map[string]int{"Apple": 3, "Banana": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+func TestTransactionalCommit(t *testing.T) {
+	ctx := context.Background()
+	client, fakeDS := NewClient(ctx)
+
+	upsert := &datastorepb.Mutation{Operation: &datastorepb.Mutation_Upsert{
+		Upsert: &datastorepb.Entity{Key: keyToProto(datastore.NameKey("TestTx", "o1", nil))},
+	}}
+
+	// A transactional commit must have begun a transaction.
+	_, err := fakeDS.Commit(ctx, &datastorepb.CommitRequest{
+		Mode:      datastorepb.CommitRequest_TRANSACTIONAL,
+		Mutations: []*datastorepb.Mutation{upsert},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Got %v without a transaction, want InvalidArgument", err)
+	}
+	_, err = fakeDS.Commit(ctx, &datastorepb.CommitRequest{
+		Mode:                datastorepb.CommitRequest_TRANSACTIONAL,
+		TransactionSelector: &datastorepb.CommitRequest_Transaction{Transaction: []byte("bogus")},
+		Mutations:           []*datastorepb.Mutation{upsert},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Got %v with an unknown transaction, want InvalidArgument", err)
+	}
+	if got := len(fakeDS.GetDSKeys()); got != 0 {
+		t.Errorf("Got %d keys after rejected commits, want 0", got)
+	}
+
+	// A non-transactional commit must not have a transaction.
+	res, err := fakeDS.BeginTransaction(ctx, &datastorepb.BeginTransactionRequest{})
+	must(t, err)
+	_, err = fakeDS.Commit(ctx, &datastorepb.CommitRequest{
+		Mode:                datastorepb.CommitRequest_NON_TRANSACTIONAL,
+		TransactionSelector: &datastorepb.CommitRequest_Transaction{Transaction: res.Transaction},
+		Mutations:           []*datastorepb.Mutation{upsert},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Got %v for a non-transactional commit, want InvalidArgument", err)
+	}
+
+	// The client's transactions go through BeginTransaction.
+	k := datastore.NameKey("TestTx", "o2", nil)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		_, err := tx.Put(k, &Object{"o2"})
+		return err
+	})
+	must(t, err)
+	var o Object
+	must(t, client.Get(ctx, k, &o))
+	if o.Value != "o2" {
+		t.Errorf("Got %q, want %q", o.Value, "o2")
+	}
+
+	// Rolled-back transactions can't be committed.
+	res, err = fakeDS.BeginTransaction(ctx, &datastorepb.BeginTransactionRequest{})
+	must(t, err)
+	_, err = fakeDS.Rollback(ctx, &datastorepb.RollbackRequest{Transaction: res.Transaction})
+	must(t, err)
+	_, err = fakeDS.Commit(ctx, &datastorepb.CommitRequest{
+		Mode:                datastorepb.CommitRequest_TRANSACTIONAL,
+		TransactionSelector: &datastorepb.CommitRequest_Transaction{Transaction: res.Transaction},
+		Mutations:           []*datastorepb.Mutation{upsert},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Got %v after Rollback, want InvalidArgument", err)
+	}
+}
+
+func TestSecondClient(t *testing.T) {
+	ctx := context.Background()
+	client, fakeDS := NewClient(ctx)
+
+	k := datastore.NameKey("TestSecond", "o1", nil)
+	_, err := client.Put(ctx, k, &Object{"o1"})
+	must(t, err)
+
+	other, err := datastore.NewClient(ctx,
+		"dsfake",
+		option.WithEndpoint(fakeDS.Addr()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	)
+	must(t, err)
+	defer other.Close()
+
+	var o Object
+	must(t, other.Get(ctx, k, &o))
+	if o.Value != "o1" {
+		t.Errorf("Got %q, want %q", o.Value, "o1")
+	}
+}
+
+type sizedObject struct {
+	Value string
+	Size  int
+}
+
+func TestRunQuery(t *testing.T) {
+	ctx := context.Background()
+	client, _ := NewClient(ctx)
+
+	const kind = "TestRunQuery"
+	for i, value := range []string{"a", "b", "c", "d"} {
+		k := datastore.NameKey(kind, value, nil)
+		_, err := client.Put(ctx, k, &sizedObject{Value: value, Size: i})
+		must(t, err)
+	}
+
+	var objs []sizedObject
+	q := datastore.NewQuery(kind).Filter("Size >=", 1).Order("-Size").Offset(1).Limit(2)
+	keys, err := client.GetAll(ctx, q, &objs)
+	must(t, err)
+	want := []sizedObject{{"c", 2}, {"b", 1}}
+	if !reflect.DeepEqual(objs, want) || len(keys) != 2 || keys[0].Name != "c" {
+		t.Errorf("Got %v (keys %v), want %v", objs, keys, want)
+	}
+
+	n, err := client.Count(ctx, datastore.NewQuery(kind).Filter("Value =", "a"))
+	must(t, err)
+	if n != 1 {
+		t.Errorf("Got count %d, want 1", n)
+	}
+
+	objs = nil
+	_, err = client.GetAll(ctx, datastore.NewQuery(kind).Project("Size").Order("Size"), &objs)
+	must(t, err)
+	if len(objs) != 4 || objs[3] != (sizedObject{Size: 3}) {
+		t.Errorf("Got projection %v, want 4 results ending in {\"\", 3}", objs)
+	}
+
+	_, err = readQuery(&datastorepb.Query{Filter: &datastorepb.Filter{}}, "")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Got %v for an empty filter, want InvalidArgument", err)
+	}
+}
+
+func TestNewClientWithProject(t *testing.T) {
+	ctx := context.Background()
+	const project = "my-project"
+	client, fakeDS := NewClientWithProject(ctx, project)
+
+	k := datastore.NameKey("TestProject", "o1", nil)
+	k.Namespace = "ns"
+	_, err := client.Put(ctx, k, &Object{"o1"})
+	must(t, err)
+
+	for name, b := range fakeDS.GetMap() {
+		var e datastorepb.Entity
+		must(t, proto.Unmarshal(b, &e))
+		partition := e.Key.GetPartitionId()
+		if partition.GetProjectId() != project || partition.GetNamespaceId() != "ns" {
+			t.Errorf("Got partition %v for %v, want project %q, namespace \"ns\"",
+				partition, name, project)
+		}
+	}
+
+	var o Object
+	must(t, client.Get(ctx, k, &o))
+	keys, err := client.GetAll(ctx, datastore.NewQuery("TestProject").Namespace("ns").KeysOnly(), nil)
+	must(t, err)
+	if o.Value != "o1" || len(keys) != 1 || !keys[0].Equal(k) {
+		t.Errorf("Got %v and keys %v, want o1 and [%v]", o, keys, k)
+	}
+}
+
+func TestKeyValidationError(t *testing.T) {
+	if err := KeyValidationError(datastore.NameKey("Kind", "o1", nil)); err != nil {
+		t.Errorf("Got %v for a valid key", err)
+	}
+	if err := KeyValidationError(datastore.NameKey("", "o1", nil)); err == nil ||
+		!strings.Contains(err.Error(), "empty Kind") {
+		t.Errorf("Got %v for a key with no kind, want an empty Kind error", err)
+	}
+	if err := KeyValidationError(nil); err == nil {
+		t.Errorf("Got no error for a nil key")
+	}
+}
+
+func TestInjectedContention(t *testing.T) {
+	ctx := context.Background()
+	client, fakeDS := NewClient(ctx)
+
+	k := datastore.NameKey("TestContention", "counter", nil)
+	_, err := client.Put(ctx, k, &sizedObject{Value: "counter"})
+	must(t, err)
+
+	increment := func(attempts *int) func(tx *datastore.Transaction) error {
+		return func(tx *datastore.Transaction) error {
+			*attempts++
+			var o sizedObject
+			if err := tx.Get(k, &o); err != nil {
+				return err
+			}
+			o.Size++
+			_, err := tx.Put(k, &o)
+			return err
+		}
+	}
+
+	// Every commit conflicts, so the client eventually gives up.
+	fakeDS.WithInjectedContention(1)
+	attempts := 0
+	_, err = client.RunInTransaction(ctx, increment(&attempts), datastore.MaxAttempts(3))
+	if err != datastore.ErrConcurrentTransaction || attempts != 3 {
+		t.Errorf("Got %v after %d attempts, want ErrConcurrentTransaction after 3", err, attempts)
+	}
+
+	// With some contention, retrying gets there.
+	fakeDS.WithInjectedContention(0.5)
+	for i := 0; i < 10; i++ {
+		_, err = client.RunInTransaction(ctx, increment(&attempts), datastore.MaxAttempts(50))
+		must(t, err)
+	}
+	var o sizedObject
+	must(t, client.Get(ctx, k, &o))
+	if o.Size != 10 {
+		t.Errorf("Got %d after 10 increments, want 10 (aborted commits shouldn't apply)", o.Size)
+	}
+}
@@ -0,0 +1,235 @@
+package dsifake
+
+// This file implements RunQuery, using the shared query engine in
+// dsquery.  Queries may filter, order, project, offset and limit, but not
+// use cursors, GQL, or be distinct.  All the results are returned in a
+// single batch.
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/StevenACoffman/gcp-emulator-pool/gcpapi/datastore/internal/dsquery"
+)
+
+// filterOps maps the datastore API's filter operators to dsquery's.
+// HAS_ANCESTOR is handled separately.
+var filterOps = map[datastorepb.PropertyFilter_Operator]dsquery.Op{
+	datastorepb.PropertyFilter_LESS_THAN:             dsquery.LessThan,
+	datastorepb.PropertyFilter_LESS_THAN_OR_EQUAL:    dsquery.LessEq,
+	datastorepb.PropertyFilter_GREATER_THAN:          dsquery.GreaterThan,
+	datastorepb.PropertyFilter_GREATER_THAN_OR_EQUAL: dsquery.GreaterEq,
+	datastorepb.PropertyFilter_EQUAL:                 dsquery.Equal,
+	datastorepb.PropertyFilter_IN:                    dsquery.In,
+	datastorepb.PropertyFilter_NOT_EQUAL:             dsquery.NotEqual,
+	datastorepb.PropertyFilter_NOT_IN:                dsquery.NotIn,
+}
+
+// RunQuery returns every result of the query in a single batch.
+func (c *FakeDatastore) RunQuery(
+	_ context.Context,
+	in *datastorepb.RunQueryRequest,
+) (*datastorepb.RunQueryResponse, error) {
+	pbQuery := in.GetQuery()
+	if pbQuery == nil {
+		return nil, status.Errorf(codes.Unimplemented, "GQL queries are not implemented")
+	}
+	query, err := readQuery(pbQuery, in.GetPartitionId().GetNamespaceId())
+	if err != nil {
+		return nil, err
+	}
+	// We apply the offset ourselves, since we have to report how many
+	// results it skipped.
+	offset, limit := query.Offset, query.Limit
+	query.Offset, query.Limit = 0, -1
+
+	c.lock.Lock()
+	entities := make([]dsquery.Entity, 0, len(c.objects))
+	stored := make(map[*datastore.Key]*datastorepb.Entity, len(c.objects))
+	pbProperties := make(map[*datastore.Key]map[string]*datastorepb.Value, len(c.objects))
+	for _, v := range c.objects {
+		e := &datastorepb.Entity{}
+		if err := proto.Unmarshal(v, e); err != nil {
+			c.lock.Unlock()
+			return nil, status.Errorf(codes.Internal, "could not unmarshal entity: %v", err)
+		}
+		key := protoToKey(e.Key)
+		props := map[string]*datastorepb.Value{}
+		flattenProperties("", e.Properties, props)
+		entity := dsquery.Entity{Key: key, Properties: make(map[string]interface{}, len(props))}
+		for name, value := range props {
+			entity.Properties[name] = fromProtoValue(value)
+		}
+		entities = append(entities, entity)
+		stored[key] = e
+		pbProperties[key] = props
+	}
+	c.lock.Unlock()
+
+	results := dsquery.Run(query, entities)
+	skipped := offset
+	if skipped > len(results) {
+		skipped = len(results)
+	}
+	results = results[skipped:]
+	if limit >= 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	resultType := datastorepb.EntityResult_FULL
+	if len(query.Projection) == 1 && query.Projection[0] == dsquery.KeyProperty {
+		resultType = datastorepb.EntityResult_KEY_ONLY
+	} else if len(query.Projection) > 0 {
+		resultType = datastorepb.EntityResult_PROJECTION
+	}
+	entityResults := make([]*datastorepb.EntityResult, len(results))
+	for i, result := range results {
+		e := &datastorepb.Entity{Key: keyToProto(result.Key)}
+		setProject(e.Key, in.GetProjectId())
+		switch resultType {
+		case datastorepb.EntityResult_FULL:
+			e = stored[result.Key]
+		case datastorepb.EntityResult_PROJECTION:
+			e.Properties = map[string]*datastorepb.Value{}
+			for name := range result.Properties {
+				e.Properties[name] = pbProperties[result.Key][name]
+			}
+		}
+		entityResults[i] = entityResultFromEntity(e)
+	}
+
+	return &datastorepb.RunQueryResponse{
+		Batch: &datastorepb.QueryResultBatch{
+			SkippedResults:   int32(skipped),
+			EntityResultType: resultType,
+			EntityResults:    entityResults,
+			MoreResults:      datastorepb.QueryResultBatch_NO_MORE_RESULTS,
+		},
+		Query: pbQuery,
+	}, nil
+}
+
+// readQuery converts a query from the datastore API to a dsquery.Query.
+func readQuery(q *datastorepb.Query, namespace string) (dsquery.Query, error) {
+	if len(q.DistinctOn) > 0 || len(q.StartCursor) > 0 || len(q.EndCursor) > 0 {
+		return dsquery.Query{}, status.Errorf(codes.Unimplemented,
+			"distinct queries and cursors are not implemented")
+	}
+	if len(q.Kind) > 1 {
+		return dsquery.Query{}, status.Errorf(codes.InvalidArgument,
+			"only one kind may be queried")
+	}
+
+	query := dsquery.Query{Namespace: namespace, Offset: int(q.Offset), Limit: -1}
+	if len(q.Kind) == 1 {
+		query.Kind = q.Kind[0].Name
+	}
+	if q.Limit != nil {
+		query.Limit = int(q.Limit.Value)
+	}
+	if err := readFilter(q.Filter, &query); err != nil {
+		return dsquery.Query{}, err
+	}
+	for _, o := range q.Order {
+		query.Orders = append(query.Orders, dsquery.Order{
+			Property:   o.GetProperty().GetName(),
+			Descending: o.Direction == datastorepb.PropertyOrder_DESCENDING,
+		})
+	}
+	for _, p := range q.Projection {
+		query.Projection = append(query.Projection, p.GetProperty().GetName())
+	}
+	return query, nil
+}
+
+// readFilter adds f, which may be a composite filter, to query.
+func readFilter(f *datastorepb.Filter, query *dsquery.Query) error {
+	if f == nil {
+		return nil
+	}
+	if composite := f.GetCompositeFilter(); composite != nil {
+		// AND is the only composite operator.
+		for _, sub := range composite.Filters {
+			if err := readFilter(sub, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	pf := f.GetPropertyFilter()
+	if pf == nil {
+		return status.Errorf(codes.InvalidArgument, "filter has no composite or property filter")
+	}
+	if pf.Op == datastorepb.PropertyFilter_HAS_ANCESTOR {
+		query.Ancestor = protoToKey(pf.Value.GetKeyValue())
+		return nil
+	}
+	op, ok := filterOps[pf.Op]
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "unknown filter operator %v", pf.Op)
+	}
+	query.Filters = append(query.Filters, dsquery.Filter{
+		Property: pf.GetProperty().GetName(),
+		Op:       op,
+		Value:    fromProtoValue(pf.Value),
+	})
+	return nil
+}
+
+// flattenProperties adds the properties of an entity to props, naming the
+// properties of nested entities "outer.inner", which is how queries refer
+// to them.
+func flattenProperties(
+	prefix string,
+	properties map[string]*datastorepb.Value,
+	props map[string]*datastorepb.Value,
+) {
+	for name, v := range properties {
+		if nested := v.GetEntityValue(); nested != nil {
+			flattenProperties(prefix+name+".", nested.Properties, props)
+			continue
+		}
+		props[prefix+name] = v
+	}
+}
+
+// fromProtoValue converts a value from the datastore API to the form
+// dsquery compares.
+func fromProtoValue(v *datastorepb.Value) interface{} {
+	switch v := v.GetValueType().(type) {
+	case *datastorepb.Value_BooleanValue:
+		return v.BooleanValue
+	case *datastorepb.Value_IntegerValue:
+		return v.IntegerValue
+	case *datastorepb.Value_DoubleValue:
+		return v.DoubleValue
+	case *datastorepb.Value_TimestampValue:
+		return v.TimestampValue.AsTime()
+	case *datastorepb.Value_KeyValue:
+		return protoToKey(v.KeyValue)
+	case *datastorepb.Value_StringValue:
+		return v.StringValue
+	case *datastorepb.Value_BlobValue:
+		return v.BlobValue
+	case *datastorepb.Value_GeoPointValue:
+		return datastore.GeoPoint{
+			Lat: v.GeoPointValue.GetLatitude(),
+			Lng: v.GeoPointValue.GetLongitude(),
+		}
+	case *datastorepb.Value_ArrayValue:
+		values := v.ArrayValue.GetValues()
+		list := make([]interface{}, len(values))
+		for i, x := range values {
+			list[i] = fromProtoValue(x)
+		}
+		return list
+	}
+	// Null values, and entities, which queries can't compare.
+	return nil
+}
@@ -9,13 +9,17 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
 	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
 
 	"github.com/Khan/districts-jobs/pkg/errors"
+	"github.com/StevenACoffman/gcp-emulator-pool/gcpapi/datastore/internal/multiarg"
 )
 
 // NOTE: This is over-restrictive, but fine for current purposes.
@@ -41,6 +45,37 @@ type Client struct {
 	dsiface.Client // For unimplemented methods
 	lock           sync.Mutex
 	objects        map[datastore.Key][]byte
+	// geoPoints holds the GeoPoint fields of each stored entity, since
+	// they can't be recovered reliably from the JSON encoding.
+	geoPoints map[datastore.Key][]datastore.GeoPoint
+
+	// To simulate eventual consistency, each write is hidden from
+	// non-ancestor queries until consistencyDelay further operations
+	// have been made.  stale holds what those queries should see
+	// instead, and ops counts the operations made so far.
+	consistencyDelay int
+	ops              int
+	stale            map[datastore.Key]staleEntity
+
+	// lastID is the last ID given out by AllocateIDs.
+	lastID int64
+
+	// noIndex holds, for each kind, the properties that have been saved
+	// unindexed (e.g. tagged `datastore:",noindex"`), which queries may
+	// not filter or order on.
+	noIndex map[string]map[string]bool
+
+	// If recordOperations is set, each operation is appended to history.
+	recordOperations bool
+	history          []Operation
+}
+
+// staleEntity is the value of an entity as seen by non-ancestor queries
+// until the op count reaches until.  A nil value means the entity
+// didn't exist.
+type staleEntity struct {
+	value []byte
+	until int
 }
 
 // NewClient returns a fake client that satisfies dsiface.Client.
@@ -48,26 +83,90 @@ func NewClient() *Client {
 	if flag.Lookup("test.v") == nil {
 		log.Fatal("DSFakeClient should only be used in tests")
 	}
-	return &Client{objects: make(map[datastore.Key][]byte, 10)}
+	return &Client{
+		objects:   make(map[datastore.Key][]byte, 10),
+		geoPoints: make(map[datastore.Key][]datastore.GeoPoint, 10),
+		stale:     make(map[datastore.Key]staleEntity),
+		noIndex:   make(map[string]map[string]bool),
+	}
 }
 
-// Close implements dsiface.Client.Close
-func (c *Client) Close() error { return nil }
+// SetConsistencyDelay makes writes invisible to non-ancestor queries
+// until ops further operations (including the queries themselves) have
+// been made on the client, simulating datastore's eventual consistency.
+// Gets and ancestor queries always see the latest writes.  Zero (the
+// default) makes everything strongly consistent.
+func (c *Client) SetConsistencyDelay(ops int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.consistencyDelay = ops
+}
 
-// Count implements dsiface.Client.Count
-func (c *Client) Count(ctx context.Context, q *datastore.Query) (n int, err error) {
-	return 0, ErrNotImplemented
+// tick counts an operation for the purposes of the consistency delay.
+// Must be called with the lock held.
+func (c *Client) tick() {
+	c.ops++
+	for k, s := range c.stale {
+		if c.ops >= s.until {
+			delete(c.stale, k)
+		}
+	}
 }
 
+// recordWrite remembers the pre-write value of key for non-ancestor
+// queries, if there is a consistency delay.  Must be called with the
+// lock held, after the write has been counted by tick but before it is
+// made.
+func (c *Client) recordWrite(key datastore.Key) {
+	if c.consistencyDelay <= 0 {
+		return
+	}
+	s, ok := c.stale[key]
+	if !ok {
+		s.value = c.objects[key]
+	}
+	// The operation after the delay is the first to see the write.
+	s.until = c.ops + c.consistencyDelay + 1
+	c.stale[key] = s
+}
+
+// eventualView returns the entities as seen by non-ancestor queries.
+// Must be called with the lock held.
+func (c *Client) eventualView() map[datastore.Key][]byte {
+	if len(c.stale) == 0 {
+		return c.objects
+	}
+	view := make(map[datastore.Key][]byte, len(c.objects))
+	for k, v := range c.objects {
+		view[k] = v
+	}
+	for k, s := range c.stale {
+		if s.value == nil {
+			delete(view, k)
+		} else {
+			view[k] = s.value
+		}
+	}
+	return view
+}
+
+// Close implements dsiface.Client.Close
+func (c *Client) Close() error { return nil }
+
 // Delete implements dsiface.Client.Delete
 func (c *Client) Delete(ctx context.Context, key *datastore.Key) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	c.record("Delete", key)
 	_, ok := c.objects[*key]
 	if !ok {
+		c.tick()
 		return datastore.ErrNoSuchEntity
 	}
+	c.tick()
+	c.recordWrite(*key)
 	delete(c.objects, *key)
+	delete(c.geoPoints, *key)
 	return nil
 }
 
@@ -79,6 +178,8 @@ func (c *Client) Get(ctx context.Context, key *datastore.Key, dst interface{}) (
 	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	c.tick()
+	c.record("Get", key)
 	o, ok := c.objects[*key]
 	if !ok {
 		return datastore.ErrNoSuchEntity
@@ -86,56 +187,6 @@ func (c *Client) Get(ctx context.Context, key *datastore.Key, dst interface{}) (
 	return json.Unmarshal(o, dst)
 }
 
-type multiArgType int
-
-const (
-	multiArgTypeInvalid multiArgType = iota
-	multiArgTypePropertyLoadSaver
-	multiArgTypeStruct
-	multiArgTypeStructPtr
-	multiArgTypeInterface
-)
-
-var (
-	typeOfPropertyLoadSaver = reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()
-	typeOfPropertyList      = reflect.TypeOf(datastore.PropertyList(nil))
-)
-
-// checkMultiArg checks that v has type []S, []*S, []I, or []P, for some struct
-// type S, for some interface type I, or some non-interface non-pointer type P
-// such that P or *P implements PropertyLoadSaver.
-//
-// It returns what category the slice's elements are, and the reflect.Type
-// that represents S, I or P.
-//
-// As a special case, PropertyList is an invalid type for v.
-func checkMultiArg(v reflect.Value) (m multiArgType, elemType reflect.Type) {
-	// TODO(djd): multiArg is very confusing. Fold this logic into the
-	// relevant Put/Get methods to make the logic less opaque.
-	if v.Kind() != reflect.Slice {
-		return multiArgTypeInvalid, nil
-	}
-	if v.Type() == typeOfPropertyList {
-		return multiArgTypeInvalid, nil
-	}
-	elemType = v.Type().Elem()
-	if reflect.PtrTo(elemType).Implements(typeOfPropertyLoadSaver) {
-		return multiArgTypePropertyLoadSaver, elemType
-	}
-	switch elemType.Kind() {
-	case reflect.Struct:
-		return multiArgTypeStruct, elemType
-	case reflect.Interface:
-		return multiArgTypeInterface, elemType
-	case reflect.Ptr:
-		elemType = elemType.Elem()
-		if elemType.Kind() == reflect.Struct {
-			return multiArgTypeStructPtr, elemType
-		}
-	}
-	return multiArgTypeInvalid, nil
-}
-
 // valid returns whether the key is valid.
 func valid(k *datastore.Key) bool {
 	if k == nil {
@@ -175,10 +226,10 @@ func valid(k *datastore.Key) bool {
 func (c *Client) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) (err error) {
 	fmt.Printf("%+v\n", c.objects)
 	v := reflect.ValueOf(dst)
-	multiArgType, _ := checkMultiArg(v)
+	multiArgType, _ := multiarg.Check(v)
 
 	// Sanity checks
-	if multiArgType == multiArgTypeInvalid {
+	if multiArgType == multiarg.Invalid {
 		return errors.New("datastore: dst has invalid type")
 	}
 	if len(keys) != v.Len() {
@@ -204,15 +255,17 @@ func (c *Client) GetMulti(ctx context.Context, keys []*datastore.Key, dst interf
 	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	c.tick()
+	c.record("GetMulti", keys...)
 	for index := range keys {
 		value, ok := c.objects[*keys[index]]
 		if ok {
 			elem := v.Index(index)
-			if multiArgType == multiArgTypePropertyLoadSaver ||
-				multiArgType == multiArgTypeStruct {
+			if multiArgType == multiarg.PropertyLoadSaver ||
+				multiArgType == multiarg.Struct {
 				elem = elem.Addr()
 			}
-			if multiArgType == multiArgTypeStructPtr && elem.IsNil() {
+			if multiArgType == multiarg.StructPtr && elem.IsNil() {
 				elem.Set(reflect.New(elem.Type().Elem()))
 			}
 			if jsonErr := json.Unmarshal(value, elem.Interface()); jsonErr != nil {
@@ -237,18 +290,242 @@ func (c *Client) Put(
 	key *datastore.Key,
 	src interface{},
 ) (*datastore.Key, error) {
-	err := validateDatastoreEntity(src)
+	e, err := encodeEntity(src)
 	if err != nil {
 		return nil, err
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tick()
+	c.record("Put", key)
+	c.recordWrite(*key)
+	c.store(*key, e)
+	return key, nil
+}
+
+// LoadFixtures stores entities directly in the mock, which is handier than
+// calling Put for each when seeding table-driven tests.  Each value must
+// be a struct pointer, as for Put.  Nothing is stored unless every entity
+// is valid.  The entities are visible immediately, regardless of any
+// consistency delay.
+func (c *Client) LoadFixtures(entities map[*datastore.Key]interface{}) error {
+	encoded := make(map[datastore.Key]encodedEntity, len(entities))
+	for k, src := range entities {
+		if !valid(k) || k.Incomplete() {
+			return errors.InvalidInput("Invalid fixture key", datastore.ErrInvalidKey,
+				errors.Fields{"key": k.String()})
+		}
+		e, err := encodeEntity(src)
+		if err != nil {
+			return errors.InvalidInput("Invalid fixture entity", err,
+				errors.Fields{"key": k.String()})
+		}
+		encoded[*k] = e
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, e := range encoded {
+		delete(c.stale, k)
+		c.store(k, e)
+	}
+	return nil
+}
+
+// encodedEntity is an entity as the mock stores it.
+type encodedEntity struct {
+	json      []byte
+	geoPoints []datastore.GeoPoint
+	noIndex   []string
+}
+
+// encodeEntity validates and encodes src, which must be a struct pointer.
+func encodeEntity(src interface{}) (encodedEntity, error) {
+	err := validateDatastoreEntity(src)
+	if err != nil {
+		return encodedEntity{}, err
+	}
 	js, err := json.Marshal(src)
 	if err != nil {
-		return nil, err
+		return encodedEntity{}, err
+	}
+	return encodedEntity{
+		json:      js,
+		geoPoints: extractGeoPoints(src),
+		noIndex:   noIndexProperties(reflect.Indirect(reflect.ValueOf(src)).Type(), ""),
+	}, nil
+}
+
+// store saves e under key.  Must be called with the lock held.
+func (c *Client) store(key datastore.Key, e encodedEntity) {
+	c.recordNoIndex(key.Kind, e.noIndex)
+	c.objects[key] = e.json
+	if len(e.geoPoints) > 0 {
+		c.geoPoints[key] = e.geoPoints
+	} else {
+		delete(c.geoPoints, key)
+	}
+}
+
+// AllocateIDs implements dsiface.Client.AllocateIDs.  The keys must be
+// incomplete; the returned copies are completed with IDs that increase
+// with each call, and are never reused, even after Reset.
+func (c *Client) AllocateIDs(_ context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	for _, k := range keys {
+		if !valid(k) || !k.Incomplete() {
+			return nil, datastore.ErrInvalidKey
+		}
 	}
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.objects[*key] = js
-	return key, nil
+	c.tick()
+	allocated := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		allocated[i] = c.allocateID(k)
+	}
+	c.record("AllocateIDs", allocated...)
+	return allocated, nil
+}
+
+// allocateID returns a copy of the incomplete key k with a new ID.  Must
+// be called with the lock held.
+func (c *Client) allocateID(k *datastore.Key) *datastore.Key {
+	c.lastID++
+	completed := *k
+	completed.ID = c.lastID
+	return &completed
+}
+
+// noIndexProperties returns the names of the properties of structs of type
+// t that are tagged noindex, with those of nested structs prefixed by
+// "Outer.".  Structs that contain themselves, e.g. through a slice of
+// children, are only followed one level deep.
+func noIndexProperties(t reflect.Type, prefix string) []string {
+	return noIndexPropertiesOf(t, prefix, map[reflect.Type]bool{})
+}
+
+// noIndexPropertiesOf is noIndexProperties, skipping the struct types in
+// outer, which t is nested in.
+func noIndexPropertiesOf(t reflect.Type, prefix string, outer map[reflect.Type]bool) []string {
+	outer[t] = true
+	defer delete(outer, t)
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name, opts := f.Name, ""
+		if tag, ok := f.Tag.Lookup("datastore"); ok {
+			tagName := tag
+			if comma := strings.Index(tag, ","); comma >= 0 {
+				tagName, opts = tag[:comma], tag[comma:]
+			}
+			if tagName == "-" {
+				continue
+			} else if tagName != "" {
+				name = tagName
+			}
+		}
+		if strings.Contains(opts+",", ",noindex,") {
+			names = append(names, prefix+name)
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr || ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != typeOfGeoPoint && ft != typeOfTime && !outer[ft] {
+			names = append(names, noIndexPropertiesOf(ft, prefix+name+".", outer)...)
+		}
+	}
+	return names
+}
+
+// recordNoIndex remembers that the named properties of kind are
+// unindexed.  Must be called with the lock held.
+func (c *Client) recordNoIndex(kind string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	if c.noIndex[kind] == nil {
+		c.noIndex[kind] = map[string]bool{}
+	}
+	for _, name := range names {
+		c.noIndex[kind][name] = true
+	}
+}
+
+var typeOfTime = reflect.TypeOf(time.Time{})
+
+var typeOfGeoPoint = reflect.TypeOf(datastore.GeoPoint{})
+
+// extractGeoPoints returns the values of all GeoPoint (or *GeoPoint)
+// fields in the struct that src points to.
+func extractGeoPoints(src interface{}) []datastore.GeoPoint {
+	v := reflect.Indirect(reflect.ValueOf(src))
+	var points []datastore.GeoPoint
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() == reflect.Ptr && !f.IsNil() {
+			f = f.Elem()
+		}
+		if f.Type() == typeOfGeoPoint {
+			points = append(points, f.Interface().(datastore.GeoPoint))
+		}
+	}
+	return points
+}
+
+// earthRadiusMeters is the mean radius of the earth, as used by the
+// haversine formula.
+const earthRadiusMeters = 6371008.8
+
+// haversineMeters returns the great-circle distance between a and b.
+func haversineMeters(a, b datastore.GeoPoint) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Lat - a.Lat)
+	dLng := toRad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+// GetKeysWithinRadius lists the keys of all entities of the given kind
+// that have a GeoPoint field within meters of center.  It is a naive
+// scan over every stored entity, and the keys are in no particular
+// order.
+func (c *Client) GetKeysWithinRadius(
+	center datastore.GeoPoint,
+	meters float64,
+	kind string,
+) []datastore.Key {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var keys []datastore.Key
+	for k, points := range c.geoPoints {
+		if k.Kind != kind {
+			continue
+		}
+		for _, p := range points {
+			if haversineMeters(center, p) <= meters {
+				keys = append(keys, k)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// Reset removes every entity saved in the fake client.
+func (c *Client) Reset(_ context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.objects = make(map[datastore.Key][]byte, 10)
+	c.geoPoints = make(map[datastore.Key][]datastore.GeoPoint, 10)
+	c.stale = make(map[datastore.Key]staleEntity)
+	c.noIndex = make(map[string]map[string]bool)
+	return nil
 }
 
 // GetKeys lists all keys saved in the fake client.
@@ -1,10 +1,15 @@
 package dsmock
 
 import (
+	"context"
 	"log"
+	"reflect"
 	"testing"
 
 	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func init() {
@@ -133,3 +138,446 @@ func contains(s []Object, e Object) bool {
 	}
 	return false
 }
+
+type Place struct {
+	Name     string
+	Location datastore.GeoPoint
+}
+
+func TestGetKeysWithinRadius(t *testing.T) {
+	client := NewClient()
+
+	const kind = "Place"
+	// The Ferry Building, a couple of km from Golden Gate Park, and
+	// about 560km from Los Angeles City Hall.
+	center := datastore.GeoPoint{Lat: 37.7955, Lng: -122.3937}
+	places := map[string]datastore.GeoPoint{
+		"coit-tower":   {Lat: 37.8024, Lng: -122.4058},
+		"union-sq":     {Lat: 37.7880, Lng: -122.4075},
+		"la-city-hall": {Lat: 34.0537, Lng: -118.2428},
+	}
+	for name, loc := range places {
+		_, err := client.Put(nil, datastore.NameKey(kind, name, nil), &Place{name, loc})
+		must(t, err)
+	}
+	// Same location, different kind: must not be returned.
+	_, err := client.Put(nil, datastore.NameKey("Other", "coit-tower", nil),
+		&Place{"coit-tower", places["coit-tower"]})
+	must(t, err)
+
+	// Check that the GeoPoint survives the round-trip.
+	var got Place
+	must(t, client.Get(nil, datastore.NameKey(kind, "union-sq", nil), &got))
+	if got.Location != places["union-sq"] {
+		t.Errorf("Got location %v, want %v", got.Location, places["union-sq"])
+	}
+
+	keys := client.GetKeysWithinRadius(center, 5000, kind)
+	found := map[string]bool{}
+	for _, k := range keys {
+		found[k.Name] = true
+	}
+	if len(keys) != 2 || !found["coit-tower"] || !found["union-sq"] {
+		t.Errorf("Got keys %v, want coit-tower and union-sq", keys)
+	}
+
+	keys = client.GetKeysWithinRadius(center, 1000, kind)
+	if len(keys) != 0 {
+		t.Errorf("Got keys %v, want none", keys)
+	}
+
+	keys = client.GetKeysWithinRadius(center, 600000, kind)
+	if len(keys) != 3 {
+		t.Errorf("Got %d keys, want 3", len(keys))
+	}
+
+	must(t, client.Delete(nil, datastore.NameKey(kind, "union-sq", nil)))
+	keys = client.GetKeysWithinRadius(center, 5000, kind)
+	if len(keys) != 1 || keys[0].Name != "coit-tower" {
+		t.Errorf("Got keys %v, want only coit-tower", keys)
+	}
+}
+
+func TestConsistencyDelay(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+	client.SetConsistencyDelay(3)
+
+	const kind = "TestConsistencyDelay"
+	parent := datastore.NameKey("Parent", "p", nil)
+	key := datastore.NameKey(kind, "o1", parent)
+	_, err := client.Put(ctx, key, &Object{"o1"})
+	must(t, err)
+
+	globalQuery := datastore.NewQuery(kind)
+	ancestorQuery := datastore.NewQuery(kind).Ancestor(parent)
+
+	// Lookups and ancestor queries are strongly consistent.
+	var o Object
+	must(t, client.Get(ctx, key, &o))
+	n, err := client.Count(ctx, ancestorQuery)
+	must(t, err)
+	if n != 1 {
+		t.Errorf("Got ancestor count %d, want 1", n)
+	}
+
+	// That was two operations since the Put, so the global query (the
+	// third) still doesn't see the new entity.
+	n, err = client.Count(ctx, globalQuery)
+	must(t, err)
+	if n != 0 {
+		t.Errorf("Got global count %d before the delay elapsed, want 0", n)
+	}
+
+	var objs []Object
+	_, err = client.GetAll(ctx, globalQuery, &objs)
+	must(t, err)
+	if len(objs) != 1 || objs[0].Value != "o1" {
+		t.Errorf("Got %v after the delay elapsed, want [o1]", objs)
+	}
+
+	// Deletes are eventually consistent too.
+	must(t, client.Delete(ctx, key))
+	n, err = client.Count(ctx, globalQuery)
+	must(t, err)
+	if n != 1 {
+		t.Errorf("Got global count %d right after Delete, want 1", n)
+	}
+	n, err = client.Count(ctx, ancestorQuery)
+	must(t, err)
+	if n != 0 {
+		t.Errorf("Got ancestor count %d right after Delete, want 0", n)
+	}
+}
+
+type sizedObject struct {
+	Value string
+	Size  int
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+
+	const kind = "TestQuery"
+	for i, value := range []string{"a", "b", "c", "d"} {
+		k := datastore.NameKey(kind, value, nil)
+		_, err := client.Put(ctx, k, &sizedObject{Value: value, Size: i})
+		must(t, err)
+	}
+
+	var objs []sizedObject
+	q := datastore.NewQuery(kind).Filter("Size >=", 1).Order("-Size").Offset(1).Limit(2)
+	keys, err := client.GetAll(ctx, q, &objs)
+	must(t, err)
+	want := []sizedObject{{"c", 2}, {"b", 1}}
+	if !reflect.DeepEqual(objs, want) || len(keys) != 2 || keys[0].Name != "c" {
+		t.Errorf("Got %v (keys %v), want %v", objs, keys, want)
+	}
+
+	n, err := client.Count(ctx, datastore.NewQuery(kind).Filter("Value =", "a"))
+	must(t, err)
+	if n != 1 {
+		t.Errorf("Got count %d, want 1", n)
+	}
+
+	keys, err = client.GetAll(ctx, datastore.NewQuery(kind).KeysOnly().Filter("Value >", "b"), nil)
+	must(t, err)
+	if len(keys) != 2 || keys[0].Name != "c" || keys[1].Name != "d" {
+		t.Errorf("Got keys %v, want [c d]", keys)
+	}
+
+	_, err = client.GetAll(ctx, datastore.NewQuery(kind).Distinct(), &objs)
+	if err != ErrNotImplemented {
+		t.Errorf("Got %v for a distinct query, want ErrNotImplemented", err)
+	}
+
+	// Errors building the query are returned when it's run.
+	bad := datastore.NewQuery(kind).Filter("Size", 1)
+	if _, err := client.Count(ctx, bad); err == nil {
+		t.Errorf("Got no error counting an invalid query")
+	}
+	if _, err := client.GetAll(ctx, bad, &objs); err == nil {
+		t.Errorf("Got no error from GetAll of an invalid query")
+	}
+	if _, err := client.Run(ctx, bad).Next(&sizedObject{}); err == nil {
+		t.Errorf("Got no error running an invalid query")
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+
+	const kind = "TestRun"
+	for _, value := range []string{"o1", "o2", "o3"} {
+		_, err := client.Put(ctx, datastore.NameKey(kind, value, nil), &Object{value})
+		must(t, err)
+	}
+	_, err := client.Put(ctx, datastore.NameKey("Other", "o4", nil), &Object{"o4"})
+	must(t, err)
+
+	var got []string
+	it := client.Run(ctx, datastore.NewQuery(kind))
+	for {
+		var o Object
+		k, err := it.Next(&o)
+		if err == iterator.Done {
+			break
+		}
+		must(t, err)
+		if k.Name != o.Value {
+			t.Errorf("Got key %v for %v", k, o)
+		}
+		got = append(got, o.Value)
+	}
+	want := []string{"o1", "o2", "o3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+
+	// Once it's done, the iterator stays done.
+	if _, err := it.Next(&Object{}); err != iterator.Done {
+		t.Errorf("Got %v after the last result, want iterator.Done", err)
+	}
+}
+
+func TestAllocateIDs(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+
+	const kind = "TestAllocateIDs"
+	incomplete := []*datastore.Key{
+		datastore.IncompleteKey(kind, nil),
+		datastore.IncompleteKey(kind, nil),
+	}
+	keys, err := client.AllocateIDs(ctx, incomplete)
+	must(t, err)
+	if len(keys) != 2 || keys[0].Incomplete() || keys[1].Incomplete() ||
+		keys[0].Equal(keys[1]) {
+		t.Fatalf("Got %v, want two distinct complete keys", keys)
+	}
+	if keys[0].Kind != kind || !incomplete[0].Incomplete() {
+		t.Errorf("Got %v from %v, want a completed copy", keys[0], incomplete[0])
+	}
+
+	// The allocated keys can be used to Put.
+	_, err = client.Put(ctx, keys[0], &Object{"o1"})
+	must(t, err)
+	var o Object
+	must(t, client.Get(ctx, keys[0], &o))
+
+	_, err = client.AllocateIDs(ctx, keys)
+	if err != datastore.ErrInvalidKey {
+		t.Errorf("Got %v for complete keys, want ErrInvalidKey", err)
+	}
+}
+
+func TestMutate(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+
+	const kind = "TestMutate"
+	k1 := datastore.NameKey(kind, "o1", nil)
+	k2 := datastore.NameKey(kind, "o2", nil)
+	_, err := client.Put(ctx, k2, &Object{"o2"})
+	must(t, err)
+
+	keys, err := client.Mutate(ctx,
+		datastore.NewInsert(k1, &Object{"o1"}),
+		datastore.NewUpsert(datastore.IncompleteKey(kind, nil), &Object{"new"}),
+		datastore.NewDelete(k2),
+	)
+	must(t, err)
+	if len(keys) != 3 || !keys[0].Equal(k1) || keys[1].Incomplete() || !keys[2].Equal(k2) {
+		t.Fatalf("Got keys %v, want [%v <allocated> %v]", keys, k1, k2)
+	}
+
+	var o Object
+	must(t, client.Get(ctx, k1, &o))
+	if o.Value != "o1" {
+		t.Errorf("Got %q for the inserted entity, want %q", o.Value, "o1")
+	}
+	must(t, client.Get(ctx, keys[1], &o))
+	if o.Value != "new" {
+		t.Errorf("Got %q for the upserted entity, want %q", o.Value, "new")
+	}
+	if err := client.Get(ctx, k2, &o); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Got %v for the deleted entity, want ErrNoSuchEntity", err)
+	}
+
+	// A failing mutation means none of the batch is applied.
+	_, err = client.Mutate(ctx,
+		datastore.NewUpsert(k2, &Object{"o2"}),
+		datastore.NewInsert(k1, &Object{"again"}),
+	)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Got %v inserting an existing entity, want AlreadyExists", err)
+	}
+	_, err = client.Mutate(ctx, datastore.NewUpdate(k2, &Object{"o2"}))
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Got %v updating a missing entity, want NotFound", err)
+	}
+	if err := client.Get(ctx, k2, &o); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Got %v after the failed batches, want ErrNoSuchEntity", err)
+	}
+}
+
+type noIndexObject struct {
+	Value string
+	Blob  string `datastore:",noindex"`
+}
+
+func TestQueryOnNoIndexProperty(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+
+	const kind = "TestQueryOnNoIndexProperty"
+	_, err := client.Put(ctx, datastore.NameKey(kind, "o1", nil), &noIndexObject{"o1", "big"})
+	must(t, err)
+
+	var objs []noIndexObject
+	_, err = client.GetAll(ctx, datastore.NewQuery(kind).Order("Blob"), &objs)
+	if err == nil {
+		t.Errorf("Got no error ordering on a noindex property")
+	}
+	_, err = client.GetAll(ctx, datastore.NewQuery(kind).Filter("Blob =", "big"), &objs)
+	if err == nil {
+		t.Errorf("Got no error filtering on a noindex property")
+	}
+
+	_, err = client.GetAll(ctx, datastore.NewQuery(kind).Order("Value"), &objs)
+	must(t, err)
+	if len(objs) != 1 {
+		t.Errorf("Got %v ordering on an indexed property, want [o1]", objs)
+	}
+}
+
+// treeNode is a kind that contains itself.
+type treeNode struct {
+	Name     string
+	Note     string `datastore:",noindex"`
+	Children []treeNode
+	Next     *treeNode
+}
+
+func TestPutSelfReferentialKind(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+
+	const kind = "TestPutSelfReferentialKind"
+	k := datastore.NameKey(kind, "root", nil)
+	root := &treeNode{Name: "root", Children: []treeNode{{Name: "leaf"}}}
+	_, err := client.Put(ctx, k, root)
+	must(t, err)
+
+	var got treeNode
+	must(t, client.Get(ctx, k, &got))
+	if !reflect.DeepEqual(&got, root) {
+		t.Errorf("Got %+v, want %+v", got, *root)
+	}
+
+	var objs []treeNode
+	_, err = client.GetAll(ctx, datastore.NewQuery(kind).Filter("Note =", ""), &objs)
+	if err == nil {
+		t.Errorf("Got no error filtering on a noindex property")
+	}
+}
+
+func TestLoadFixtures(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+	client.SetConsistencyDelay(5)
+
+	const kind = "TestLoadFixtures"
+	fixtures := map[*datastore.Key]interface{}{}
+	for _, value := range []string{"o1", "o2", "o3"} {
+		fixtures[datastore.NameKey(kind, value, nil)] = &Object{value}
+	}
+	must(t, client.LoadFixtures(fixtures))
+
+	for k, want := range fixtures {
+		var o Object
+		must(t, client.Get(ctx, k, &o))
+		if o != *want.(*Object) {
+			t.Errorf("Got %v for %v, want %v", o, k, want)
+		}
+	}
+	n, err := client.Count(ctx, datastore.NewQuery(kind))
+	must(t, err)
+	if n != 3 {
+		t.Errorf("Got count %d, want 3", n)
+	}
+
+	err = client.LoadFixtures(map[*datastore.Key]interface{}{
+		datastore.NameKey(kind, "o4", nil):  &Object{"o4"},
+		datastore.NameKey(kind, "bad", nil): Object{"not a pointer"},
+	})
+	if err == nil {
+		t.Errorf("Got no error loading an invalid fixture")
+	}
+	var o Object
+	if err := client.Get(ctx, datastore.NameKey(kind, "o4", nil), &o); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Got %v for a fixture in an invalid map, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestGetAllWhere(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+
+	const kind = "TestGetAllWhere"
+	must(t, client.LoadFixtures(map[*datastore.Key]interface{}{
+		datastore.NameKey(kind, "a", nil):    &sizedObject{"red", 1},
+		datastore.NameKey(kind, "b", nil):    &sizedObject{"blue", 2},
+		datastore.NameKey(kind, "c", nil):    &sizedObject{"red", 3},
+		datastore.NameKey("Other", "d", nil): &sizedObject{"red", 4},
+	}))
+
+	var objs []*sizedObject
+	must(t, client.GetAllWhere(ctx, kind, "", "Value", "red", &objs))
+	if len(objs) != 2 || *objs[0] != (sizedObject{"red", 1}) || *objs[1] != (sizedObject{"red", 3}) {
+		t.Errorf("Got %v, want the red objects a and c", objs)
+	}
+
+	objs = nil
+	must(t, client.GetAllWhere(ctx, kind, "", "Value", "green", &objs))
+	if len(objs) != 0 {
+		t.Errorf("Got %v, want no green objects", objs)
+	}
+}
+
+func TestOperationHistory(t *testing.T) {
+	ctx := context.Background()
+	client := NewClient()
+
+	const kind = "TestOperationHistory"
+	k1 := datastore.NameKey(kind, "o1", nil)
+	k2 := datastore.NameKey(kind, "o2", nil)
+	_, err := client.Put(ctx, k1, &Object{"o1"})
+	must(t, err)
+
+	// Only operations made after recording is turned on are recorded.
+	client.SetRecordOperations(true)
+	_, err = client.Put(ctx, k2, &Object{"o2"})
+	must(t, err)
+	var o Object
+	must(t, client.Get(ctx, k1, &o))
+	must(t, client.Delete(ctx, k2))
+
+	history := client.OperationHistory()
+	var got []string
+	for i, op := range history {
+		if len(op.Keys) != 1 {
+			t.Fatalf("Got keys %v for %v, want one key", op.Keys, op.Method)
+		}
+		got = append(got, op.Method+" "+op.Keys[0].Name)
+		if i > 0 && op.Time.Before(history[i-1].Time) {
+			t.Errorf("Got %v before %v", op, history[i-1])
+		}
+	}
+	want := []string{"Put o2", "Get o1", "Delete o2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got history %v, want %v", got, want)
+	}
+}
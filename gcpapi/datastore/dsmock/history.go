@@ -0,0 +1,51 @@
+package dsmock
+
+import (
+	"time"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+)
+
+// Operation is a call made on the mock, as recorded when
+// SetRecordOperations is on.
+type Operation struct {
+	// Method is the name of the Client method called, e.g. "Put".
+	Method string
+	// Keys are the keys the call was made with, or for queries, the keys
+	// of the results.
+	Keys []*datastore.Key
+	Time time.Time
+}
+
+// SetRecordOperations turns recording of the operations made on the
+// client on or off; it's off by default.  Turning it on clears any
+// history recorded previously.
+func (c *Client) SetRecordOperations(on bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.recordOperations = on
+	c.history = nil
+}
+
+// OperationHistory returns the operations made on the client, oldest
+// first, since SetRecordOperations(true) was called.
+func (c *Client) OperationHistory() []Operation {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	history := make([]Operation, len(c.history))
+	copy(history, c.history)
+	return history
+}
+
+// record adds an operation to the history, if we're recording.  Must be
+// called with the lock held.
+func (c *Client) record(method string, keys ...*datastore.Key) {
+	if !c.recordOperations {
+		return
+	}
+	c.history = append(c.history, Operation{
+		Method: method,
+		Keys:   append([]*datastore.Key(nil), keys...),
+		Time:   time.Now(),
+	})
+}
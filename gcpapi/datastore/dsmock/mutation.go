@@ -0,0 +1,210 @@
+package dsmock
+
+// This file implements Mutate.  datastore.Mutation only holds the
+// protocol buffer encoding of its entity, so we convert that back to the
+// JSON the mock stores.  That matches what Put stores as long as the
+// entity's datastore property names are the same as its JSON field names.
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// readMutation extracts the key, the operation and any error from m,
+// which doesn't export them.
+func readMutation(m *datastore.Mutation) (*datastore.Key, *datastorepb.Mutation, error) {
+	v := reflect.ValueOf(m).Elem()
+	key := readKey(v.FieldByName("key"))
+	mut, _ := exported(v.FieldByName("mut")).Interface().(*datastorepb.Mutation)
+	err, _ := exported(v.FieldByName("err")).Interface().(error)
+	return key, mut, err
+}
+
+// Mutate implements dsiface.Client.Mutate.  Like a datastore commit, it
+// applies all the mutations or none of them: inserting an entity that
+// already exists fails with codes.AlreadyExists, and updating one that
+// doesn't with codes.NotFound.  Incomplete keys are given IDs as by
+// AllocateIDs.
+func (c *Client) Mutate(_ context.Context, muts ...*datastore.Mutation) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(muts))
+	ops := make([]*datastorepb.Mutation, len(muts))
+	var multiErr datastore.MultiError
+	for i, m := range muts {
+		var err error
+		keys[i], ops[i], err = readMutation(m)
+		if err != nil {
+			if multiErr == nil {
+				multiErr = make(datastore.MultiError, len(muts))
+			}
+			multiErr[i] = err
+		}
+	}
+	if multiErr != nil {
+		return nil, multiErr
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tick()
+
+	// Check everything before making any changes.  exists tracks the
+	// effect of earlier mutations in the batch.
+	exists := map[datastore.Key]bool{}
+	values := make([][]byte, len(muts))
+	for i, op := range ops {
+		k := keys[i]
+		if !k.Incomplete() {
+			if _, ok := exists[*k]; !ok {
+				_, exists[*k] = c.objects[*k]
+			}
+		}
+		switch op.Operation.(type) {
+		case *datastorepb.Mutation_Insert:
+			if !k.Incomplete() && exists[*k] {
+				return nil, status.Errorf(codes.AlreadyExists, "entity already exists: %v", k)
+			}
+		case *datastorepb.Mutation_Update:
+			if !exists[*k] {
+				return nil, status.Errorf(codes.NotFound, "no entity to update: %v", k)
+			}
+		case *datastorepb.Mutation_Delete:
+			exists[*k] = false
+			continue
+		}
+		if !k.Incomplete() {
+			exists[*k] = true
+		}
+		var err error
+		values[i], err = json.Marshal(jsonFields(entityOf(op).Properties))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, op := range ops {
+		k := keys[i]
+		if k.Incomplete() {
+			k = c.allocateID(k)
+			keys[i] = k
+		}
+		c.recordWrite(*k)
+		if _, ok := op.Operation.(*datastorepb.Mutation_Delete); ok {
+			delete(c.objects, *k)
+			delete(c.geoPoints, *k)
+			continue
+		}
+		properties := entityOf(op).Properties
+		c.store(*k, encodedEntity{
+			json:      values[i],
+			geoPoints: protoGeoPoints(properties),
+			noIndex:   protoNoIndex(properties, ""),
+		})
+	}
+	c.record("Mutate", keys...)
+	return keys, nil
+}
+
+// entityOf returns the entity written by an insert, upsert or update.
+func entityOf(op *datastorepb.Mutation) *datastorepb.Entity {
+	switch op := op.Operation.(type) {
+	case *datastorepb.Mutation_Insert:
+		return op.Insert
+	case *datastorepb.Mutation_Upsert:
+		return op.Upsert
+	case *datastorepb.Mutation_Update:
+		return op.Update
+	}
+	return nil
+}
+
+// jsonFields converts the properties of an entity to the form Put would
+// have stored them in.
+func jsonFields(properties map[string]*datastorepb.Value) map[string]interface{} {
+	fields := make(map[string]interface{}, len(properties))
+	for name, v := range properties {
+		fields[name] = jsonField(v)
+	}
+	return fields
+}
+
+func jsonField(v *datastorepb.Value) interface{} {
+	switch v := v.GetValueType().(type) {
+	case *datastorepb.Value_BooleanValue:
+		return v.BooleanValue
+	case *datastorepb.Value_IntegerValue:
+		return v.IntegerValue
+	case *datastorepb.Value_DoubleValue:
+		return v.DoubleValue
+	case *datastorepb.Value_TimestampValue:
+		return v.TimestampValue.AsTime()
+	case *datastorepb.Value_KeyValue:
+		return protoToKey(v.KeyValue)
+	case *datastorepb.Value_StringValue:
+		return v.StringValue
+	case *datastorepb.Value_BlobValue:
+		return v.BlobValue
+	case *datastorepb.Value_GeoPointValue:
+		return datastore.GeoPoint{
+			Lat: v.GeoPointValue.GetLatitude(),
+			Lng: v.GeoPointValue.GetLongitude(),
+		}
+	case *datastorepb.Value_EntityValue:
+		return jsonFields(v.EntityValue.GetProperties())
+	case *datastorepb.Value_ArrayValue:
+		values := v.ArrayValue.GetValues()
+		list := make([]interface{}, len(values))
+		for i, x := range values {
+			list[i] = jsonField(x)
+		}
+		return list
+	}
+	return nil
+}
+
+// protoGeoPoints is the equivalent of extractGeoPoints for an entity's
+// properties.
+func protoGeoPoints(properties map[string]*datastorepb.Value) []datastore.GeoPoint {
+	var points []datastore.GeoPoint
+	for _, v := range properties {
+		if p := v.GetGeoPointValue(); p != nil {
+			points = append(points, datastore.GeoPoint{Lat: p.GetLatitude(), Lng: p.GetLongitude()})
+		}
+	}
+	return points
+}
+
+// protoNoIndex is the equivalent of noIndexProperties for an entity's
+// properties.
+func protoNoIndex(properties map[string]*datastorepb.Value, prefix string) []string {
+	var names []string
+	for name, v := range properties {
+		if v.ExcludeFromIndexes {
+			names = append(names, prefix+name)
+		} else if nested := v.GetEntityValue(); nested != nil {
+			names = append(names, protoNoIndex(nested.Properties, prefix+name+".")...)
+		}
+	}
+	return names
+}
+
+// protoToKey converts the protocol buffer encoding of a key back to a
+// *datastore.Key.
+func protoToKey(p *datastorepb.Key) *datastore.Key {
+	var key *datastore.Key
+	for _, el := range p.GetPath() {
+		key = &datastore.Key{
+			Namespace: p.GetPartitionId().GetNamespaceId(),
+			Kind:      el.Kind,
+			ID:        el.GetId(),
+			Name:      el.GetName(),
+			Parent:    key,
+		}
+	}
+	return key
+}
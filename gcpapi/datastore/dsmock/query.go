@@ -0,0 +1,405 @@
+package dsmock
+
+// This file implements the mock's query support, using the shared query
+// engine in dsquery.  Queries may filter, order, project, offset and
+// limit, but not use cursors or be distinct.
+//
+// Since the mock stores entities as JSON, their properties are recovered
+// from the JSON: numbers become int64 (or float64 if they aren't
+// integers), strings that are RFC 3339 timestamps become time.Time, and
+// the fields of nested structs are named "Outer.Inner", as in datastore.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+	"unsafe"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+	"github.com/googleapis/google-cloud-go-testing/datastore/dsiface"
+	"google.golang.org/api/iterator"
+
+	"github.com/Khan/districts-jobs/pkg/errors"
+	"github.com/StevenACoffman/gcp-emulator-pool/gcpapi/datastore/internal/dsquery"
+)
+
+// mockQuery is a datastore.Query as the mock understands it.
+type mockQuery struct {
+	dsquery.Query
+	keysOnly bool
+}
+
+// readQuery extracts the mockQuery from q.  datastore.Query doesn't
+// export its fields, so we have to read them via reflection.  It
+// returns the error q recorded while it was built, if any, as datastore
+// would, and ErrNotImplemented if q uses a feature the mock doesn't
+// support.
+func readQuery(q *datastore.Query) (mockQuery, error) {
+	v := reflect.ValueOf(q).Elem()
+	if err, _ := exported(v.FieldByName("err")).Interface().(error); err != nil {
+		return mockQuery{}, err
+	}
+	for _, name := range []string{"distinctOn", "start", "end"} {
+		if v.FieldByName(name).Len() > 0 {
+			return mockQuery{}, ErrNotImplemented
+		}
+	}
+	if v.FieldByName("distinct").Bool() {
+		return mockQuery{}, ErrNotImplemented
+	}
+
+	query := dsquery.Query{
+		Kind:      v.FieldByName("kind").String(),
+		Namespace: v.FieldByName("namespace").String(),
+		Ancestor:  readKey(v.FieldByName("ancestor")),
+		Offset:    int(v.FieldByName("offset").Int()),
+		Limit:     int(v.FieldByName("limit").Int()),
+	}
+	filters := v.FieldByName("filter")
+	for i := 0; i < filters.Len(); i++ {
+		f := filters.Index(i)
+		query.Filters = append(query.Filters, dsquery.Filter{
+			Property: f.FieldByName("FieldName").String(),
+			// datastore's operators are numbered in the same order as
+			// dsquery's.
+			Op:    dsquery.Op(f.FieldByName("Op").Int()),
+			Value: exported(f.FieldByName("Value")).Interface(),
+		})
+	}
+	orders := v.FieldByName("order")
+	for i := 0; i < orders.Len(); i++ {
+		o := orders.Index(i)
+		query.Orders = append(query.Orders, dsquery.Order{
+			Property:   o.FieldByName("FieldName").String(),
+			Descending: o.FieldByName("Direction").Bool(),
+		})
+	}
+	projection := v.FieldByName("projection")
+	for i := 0; i < projection.Len(); i++ {
+		query.Projection = append(query.Projection, projection.Index(i).String())
+	}
+
+	return mockQuery{Query: query, keysOnly: v.FieldByName("keysOnly").Bool()}, nil
+}
+
+// exported returns a copy of v, which was read from an unexported field,
+// that we can call Interface on.  v must be addressable.
+func exported(v reflect.Value) reflect.Value {
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+}
+
+// readKey copies a *datastore.Key that we can only get at via
+// reflection on an unexported field.
+func readKey(v reflect.Value) *datastore.Key {
+	if v.IsNil() {
+		return nil
+	}
+	k := v.Elem()
+	return &datastore.Key{
+		Kind:      k.FieldByName("Kind").String(),
+		ID:        k.FieldByName("ID").Int(),
+		Name:      k.FieldByName("Name").String(),
+		Parent:    readKey(k.FieldByName("Parent")),
+		Namespace: k.FieldByName("Namespace").String(),
+	}
+}
+
+// jsonProperties returns the properties of an entity stored as JSON.
+func jsonProperties(value []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	props := make(map[string]interface{}, len(fields))
+	flattenJSON("", fields, props)
+	return props, nil
+}
+
+func flattenJSON(prefix string, fields map[string]interface{}, props map[string]interface{}) {
+	for name, v := range fields {
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenJSON(prefix+name+".", nested, props)
+			continue
+		}
+		props[prefix+name] = jsonValue(v)
+	}
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t.UTC()
+		}
+		return v
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, x := range v {
+			list[i] = jsonValue(x)
+		}
+		return list
+	}
+	return v
+}
+
+// runQuery returns the keys and values matching q.  Must be called with
+// the lock held.
+func (c *Client) runQuery(q *datastore.Query) (mockQuery, []*datastore.Key, [][]byte, error) {
+	query, err := readQuery(q)
+	if err != nil {
+		return query, nil, nil, err
+	}
+	c.tick()
+	if err := c.checkIndexed(query.Query); err != nil {
+		return query, nil, nil, err
+	}
+
+	// Non-ancestor queries are eventually consistent, so they may see
+	// stale values.
+	view := c.objects
+	if query.Ancestor == nil {
+		view = c.eventualView()
+	}
+
+	entities := make([]dsquery.Entity, 0, len(view))
+	for k, value := range view {
+		k := k
+		props, err := jsonProperties(value)
+		if err != nil {
+			return query, nil, nil, errors.Internal("could not read stored entity", err,
+				errors.Fields{"key": k.String()})
+		}
+		entities = append(entities, dsquery.Entity{Key: &k, Properties: props})
+	}
+
+	results := dsquery.Run(query.Query, entities)
+	keys := make([]*datastore.Key, len(results))
+	values := make([][]byte, len(results))
+	for i, e := range results {
+		keys[i] = e.Key
+		if len(query.Projection) == 0 {
+			values[i] = view[*e.Key]
+			continue
+		}
+		values[i], err = json.Marshal(unflattenJSON(e.Properties))
+		if err != nil {
+			return query, nil, nil, err
+		}
+	}
+	return query, keys, values, nil
+}
+
+// checkIndexed returns an error if q filters or orders on a property
+// that has been saved unindexed.  Datastore doesn't return such entities,
+// which is usually a bug, so the mock is stricter.  Must be called with
+// the lock held.
+func (c *Client) checkIndexed(q dsquery.Query) error {
+	noIndex := c.noIndex[q.Kind]
+	for _, f := range q.Filters {
+		if noIndex[f.Property] {
+			return errors.InvalidInput("datastore: cannot filter on an unindexed property",
+				errors.Fields{"kind": q.Kind, "property": f.Property})
+		}
+	}
+	for _, o := range q.Orders {
+		if noIndex[o.Property] {
+			return errors.InvalidInput("datastore: cannot order on an unindexed property",
+				errors.Fields{"kind": q.Kind, "property": o.Property})
+		}
+	}
+	return nil
+}
+
+// unflattenJSON undoes flattenJSON, so that projected properties can be
+// loaded into structs.
+func unflattenJSON(props map[string]interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for name, v := range props {
+		parts := strings.Split(name, ".")
+		m := fields
+		for _, part := range parts[:len(parts)-1] {
+			nested, ok := m[part].(map[string]interface{})
+			if !ok {
+				nested = map[string]interface{}{}
+				m[part] = nested
+			}
+			m = nested
+		}
+		m[parts[len(parts)-1]] = v
+	}
+	return fields
+}
+
+// Count implements dsiface.Client.Count
+func (c *Client) Count(_ context.Context, q *datastore.Query) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, keys, _, err := c.runQuery(q)
+	c.record("Count", keys...)
+	return len(keys), err
+}
+
+// GetAll implements dsiface.Client.GetAll.  Cursors and distinct queries
+// aren't supported.
+//
+// dst must have type *[]S or *[]*S for some struct type S; it may be nil
+// for keys-only queries.
+func (c *Client) GetAll(
+	_ context.Context,
+	q *datastore.Query,
+	dst interface{},
+) ([]*datastore.Key, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	query, keys, values, err := c.runQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	c.record("GetAll", keys...)
+	if query.keysOnly {
+		return keys, nil
+	}
+	if err := appendEntities(dst, values); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetAllWhere appends to dst the entities of the given kind and namespace
+// whose property equals value, in key order.  It's shorthand for GetAll
+// with an equality filter, except that it always sees the latest writes.
+// property is named as in the entity's JSON encoding, with the fields of
+// nested structs named "Outer.Inner".
+//
+// dst must have type *[]S or *[]*S for some struct type S.
+func (c *Client) GetAllWhere(
+	_ context.Context,
+	kind, namespace, property string,
+	value interface{},
+	dst interface{},
+) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tick()
+	query := dsquery.Query{
+		Kind:      kind,
+		Namespace: namespace,
+		Filters:   []dsquery.Filter{{Property: property, Op: dsquery.Equal, Value: value}},
+		Limit:     -1,
+	}
+
+	var entities []dsquery.Entity
+	for k, v := range c.objects {
+		k := k
+		if k.Kind != kind || k.Namespace != namespace {
+			continue
+		}
+		props, err := jsonProperties(v)
+		if err != nil {
+			return errors.Internal("could not read stored entity", err,
+				errors.Fields{"key": k.String()})
+		}
+		entities = append(entities, dsquery.Entity{Key: &k, Properties: props})
+	}
+
+	results := dsquery.Run(query, entities)
+	keys := make([]*datastore.Key, len(results))
+	values := make([][]byte, len(results))
+	for i, e := range results {
+		keys[i] = e.Key
+		values[i] = c.objects[*e.Key]
+	}
+	c.record("GetAllWhere", keys...)
+	return appendEntities(dst, values)
+}
+
+// appendEntities decodes each of values, and appends it to dst, which
+// must have type *[]S or *[]*S for some struct type S.
+func appendEntities(dst interface{}, values [][]byte) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return errors.New("datastore: dst has invalid type")
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return errors.New("datastore: dst has invalid type")
+	}
+
+	for _, value := range values {
+		elem := reflect.New(elemType)
+		if err := json.Unmarshal(value, elem.Interface()); err != nil {
+			return err
+		}
+		if !isPtr {
+			elem = elem.Elem()
+		}
+		slice = reflect.Append(slice, elem)
+	}
+	v.Elem().Set(slice)
+	return nil
+}
+
+// queryIterator implements dsiface.Iterator over results that were all
+// fetched when the query was run.
+type queryIterator struct {
+	dsiface.Iterator // For unimplemented methods
+	keys             []*datastore.Key
+	values           [][]byte
+	keysOnly         bool
+	err              error
+}
+
+// Run implements dsiface.Client.Run.  The query supports the same
+// features as in GetAll, and is run immediately, so the iterator doesn't
+// see later writes.
+func (c *Client) Run(_ context.Context, q *datastore.Query) dsiface.Iterator {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	query, keys, values, err := c.runQuery(q)
+	c.record("Run", keys...)
+	return &queryIterator{keys: keys, values: values, keysOnly: query.keysOnly, err: err}
+}
+
+// Next implements dsiface.Iterator.Next.  It returns iterator.Done once
+// there are no more results.  dst is ignored for keys-only queries.
+func (it *queryIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.keys) == 0 {
+		return nil, iterator.Done
+	}
+	key, value := it.keys[0], it.values[0]
+	it.keys, it.values = it.keys[1:], it.values[1:]
+	if it.keysOnly {
+		return key, nil
+	}
+	if err := validateDatastoreEntity(dst); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(value, dst); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Cursor implements dsiface.Iterator.Cursor.  Cursors aren't supported.
+func (it *queryIterator) Cursor() (datastore.Cursor, error) {
+	return datastore.Cursor{}, ErrNotImplemented
+}
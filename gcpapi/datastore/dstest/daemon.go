@@ -0,0 +1,488 @@
+package dstest
+
+// This file implements the optional "daemon mode" for the emulator pool.
+//
+// The lockfile pool (see datastore_emulator.go) already lets test processes
+// share emulators, but each `go test` package binary still has to find,
+// lock, and sometimes start emulators on its own, and they all race to do
+// so.  In daemon mode, a single long-running process owns a warm pool of
+// emulators and hands them out over a unix socket, so test binaries just
+// ask it for one.
+//
+// Daemon mode is enabled by setting DSTEST_DAEMON=1 in the environment of
+// the tests; NewTempClient will then call EnsureDaemon, which starts the
+// daemon if it isn't already running.  The daemon is just another copy of
+// the current (test) binary, started with DSTEST_DAEMON_SERVE set to the
+// socket it should listen on; the init function below notices that and runs
+// the daemon instead of the tests.
+//
+// The protocol is newline-delimited JSON: the client sends
+//  {"op": "acquire"}
+// and gets back the emulator, and later sends
+//  {"op": "release"}
+// to hand it back.  Each connection holds at most one emulator, and the
+// daemon takes it back when the connection closes, so an emulator isn't
+// lost if a test binary dies without releasing it.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Khan/districts-jobs/pkg/errors"
+)
+
+const (
+	// daemonEnvVar turns on daemon mode for NewTempClient.
+	daemonEnvVar = "DSTEST_DAEMON"
+	// daemonServeEnvVar is set (to the socket path) in the environment of
+	// the daemon process itself.
+	daemonServeEnvVar = "DSTEST_DAEMON_SERVE"
+
+	// daemonWarmPoolSize is how many emulators the daemon starts up
+	// before anyone asks for one.
+	daemonWarmPoolSize = 2
+	// daemonMaxPoolSize is the most emulators the daemon runs at once.
+	// Clients wait for one to be released rather than start more.
+	daemonMaxPoolSize = 8
+	// daemonIdleTimeout is how long the daemon keeps running with no
+	// clients connected.  Its emulators keep running after it exits, and
+	// can be picked up again via their lockfiles.
+	daemonIdleTimeout = 10 * time.Minute
+)
+
+func init() {
+	if socketPath := os.Getenv(daemonServeEnvVar); socketPath != "" {
+		err := runDaemon(socketPath)
+		if err != nil {
+			fmt.Println("dstest daemon exited with error:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+}
+
+type daemonRequest struct {
+	Op string `json:"op"`
+}
+
+type daemonResponse struct {
+	Emulator *DatastoreEmulator `json:"emulator,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// emulatorDaemon owns a pool of emulators and hands them out to clients.
+type emulatorDaemon struct {
+	// start gets a new emulator for the pool; reset empties an emulator
+	// before it's handed out again; shutdown stops one that won't reset.
+	// They're fields so tests can avoid starting real emulators.
+	start    func(ctx context.Context) (*DatastoreEmulator, error)
+	reset    func(ctx context.Context, emulator *DatastoreEmulator) error
+	shutdown func(ctx context.Context, emulator *DatastoreEmulator) error
+
+	warm        int
+	max         int // zero means no limit
+	idleTimeout time.Duration
+
+	mu         sync.Mutex
+	idle       []*DatastoreEmulator
+	running    int // emulators idle, leased or starting
+	clients    int
+	lastActive time.Time
+	// available is closed, and replaced, when an emulator is put back in
+	// the pool or a slot for one frees up, to wake up clients waiting in
+	// get.
+	available chan struct{}
+}
+
+// DaemonSocketPath returns the path of the unix socket the daemon listens
+// on.
+func DaemonSocketPath() string {
+	return filepath.Join(LockDirPath(), "daemon.sock")
+}
+
+// EnsureDaemon makes sure the emulator daemon is running, starting it if
+// necessary, and returns the path of its socket.
+func EnsureDaemon() (string, error) {
+	lockDirPath := LockDirPath()
+	socketPath := DaemonSocketPath()
+
+	err := os.MkdirAll(lockDirPath, 0o777)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// Hold a lock while we check for and start the daemon, so that test
+	// binaries starting at the same time don't each start one.
+	lockFile, err := os.Create(filepath.Join(lockDirPath, "daemon.lock"))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer lockFile.Close()
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	if pingDaemon(socketPath) {
+		return socketPath, nil
+	}
+
+	// Nobody is listening, so any socket file is left over from a daemon
+	// that exited.
+	os.Remove(socketPath)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", errors.Internal("Could not find executable to run daemon", err)
+	}
+	logFile, err := os.OpenFile(filepath.Join(lockDirPath, "daemon.out"),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o666)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), daemonServeEnvVar+"="+socketPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// Put the daemon in its own session so it outlives this test binary.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	if err != nil {
+		return "", errors.Internal("Could not start daemon", err,
+			errors.Fields{"executable": exe})
+	}
+	_ = cmd.Process.Release()
+
+	deadline := time.Now().Add(startupTimeout)
+	for attempt := 0; !pingDaemon(socketPath); attempt++ {
+		if time.Now().After(deadline) {
+			return "", errors.Internal("Timed out waiting for daemon to start",
+				errors.Fields{"socketPath": socketPath})
+		}
+		time.Sleep(pollingInterval(attempt))
+	}
+	return socketPath, nil
+}
+
+func pingDaemon(socketPath string) bool {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// runDaemon runs the daemon in this process until it has been idle for
+// daemonIdleTimeout.
+func runDaemon(socketPath string) error {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(socketPath)
+
+	d := &emulatorDaemon{
+		start: func(ctx context.Context) (*DatastoreEmulator, error) {
+			return acquireLocalEmulator(ctx, tempProjectID)
+		},
+		reset: func(ctx context.Context, emulator *DatastoreEmulator) error {
+			return emulator.Reset(ctx)
+		},
+		shutdown: func(ctx context.Context, emulator *DatastoreEmulator) error {
+			return emulator.Shutdown(ctx)
+		},
+		warm:        daemonWarmPoolSize,
+		max:         daemonMaxPoolSize,
+		idleTimeout: daemonIdleTimeout,
+	}
+	fmt.Println("dstest daemon listening on", socketPath)
+	return d.serve(context.Background(), listener)
+}
+
+// serve hands out emulators to clients connecting to listener, until ctx is
+// done or the daemon has been idle for d.idleTimeout.  It closes listener
+// before returning.
+func (d *emulatorDaemon) serve(ctx context.Context, listener net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d.mu.Lock()
+	d.lastActive = time.Now()
+	d.mu.Unlock()
+
+	for i := 0; i < d.warm; i++ {
+		d.mu.Lock()
+		d.running++
+		d.mu.Unlock()
+		go func() {
+			emulator, err := d.start(ctx)
+			if err != nil {
+				fmt.Println("dstest daemon could not start emulator:", err)
+				d.drop()
+				return
+			}
+			d.put(emulator)
+		}()
+	}
+
+	if d.idleTimeout > 0 {
+		go d.exitWhenIdle(ctx, cancel)
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.handle(ctx, conn)
+		}()
+	}
+}
+
+func (d *emulatorDaemon) exitWhenIdle(ctx context.Context, cancel func()) {
+	ticker := time.NewTicker(d.idleTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.mu.Lock()
+			idle := d.clients == 0 && time.Since(d.lastActive) > d.idleTimeout
+			d.mu.Unlock()
+			if idle {
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handle serves a single client connection.
+func (d *emulatorDaemon) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Unblock the Decode below when the daemon shuts down.
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	d.mu.Lock()
+	d.clients++
+	d.mu.Unlock()
+
+	var leased *DatastoreEmulator
+	defer func() {
+		if leased != nil {
+			d.put(leased)
+		}
+		d.mu.Lock()
+		d.clients--
+		d.lastActive = time.Now()
+		d.mu.Unlock()
+	}()
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var req daemonRequest
+		if decoder.Decode(&req) != nil {
+			return
+		}
+
+		var resp daemonResponse
+		switch req.Op {
+		case "acquire":
+			if leased != nil {
+				resp.Error = "connection already holds an emulator"
+				break
+			}
+			emulator, err := d.get(ctx)
+			if err != nil {
+				resp.Error = err.Error()
+				break
+			}
+			leased = emulator
+			resp.Emulator = emulator
+		case "release":
+			if leased != nil {
+				d.put(leased)
+				leased = nil
+			}
+		default:
+			resp.Error = fmt.Sprintf("unknown op %q", req.Op)
+		}
+
+		if encoder.Encode(&resp) != nil {
+			return
+		}
+	}
+}
+
+// get returns a clean emulator from the pool, or starts a new one if the
+// pool is empty.  If d.max emulators are already running, it waits for one
+// to be put back.
+func (d *emulatorDaemon) get(ctx context.Context) (*DatastoreEmulator, error) {
+	for {
+		d.mu.Lock()
+		if len(d.idle) == 0 {
+			if d.max > 0 && d.running >= d.max {
+				wait := d.waitChan()
+				d.mu.Unlock()
+				select {
+				case <-wait:
+					continue
+				case <-ctx.Done():
+					return nil, errors.WithStack(ctx.Err())
+				}
+			}
+			d.running++
+			d.mu.Unlock()
+			emulator, err := d.start(ctx)
+			if err != nil {
+				d.drop()
+				return nil, err
+			}
+			return emulator, nil
+		}
+		emulator := d.idle[len(d.idle)-1]
+		d.idle = d.idle[:len(d.idle)-1]
+		d.mu.Unlock()
+
+		err := d.reset(ctx, emulator)
+		if err == nil {
+			return emulator, nil
+		}
+		if ctx.Err() != nil {
+			// The reset was just cut short, so the emulator is still good.
+			d.put(emulator)
+			return nil, errors.WithStack(ctx.Err())
+		}
+		// If it won't reset, it's probably broken; shut it down, so it
+		// doesn't keep running outside the pool, and try the next one.
+		fmt.Println("dstest daemon dropping emulator", emulator.Addr, err)
+		if err := d.shutdown(ctx, emulator); err != nil {
+			fmt.Println("dstest daemon could not shut down emulator", emulator.Addr, err)
+		}
+		d.drop()
+	}
+}
+
+// put returns an emulator to the pool.
+func (d *emulatorDaemon) put(emulator *DatastoreEmulator) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.idle = append(d.idle, emulator)
+	d.notify()
+}
+
+// drop frees the slot of an emulator that failed to start or was
+// abandoned.
+func (d *emulatorDaemon) drop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.running--
+	d.notify()
+}
+
+// waitChan returns the channel notify will close.  Must be called with
+// d.mu held.
+func (d *emulatorDaemon) waitChan() chan struct{} {
+	if d.available == nil {
+		d.available = make(chan struct{})
+	}
+	return d.available
+}
+
+// notify wakes up the clients waiting in get.  Must be called with d.mu
+// held.
+func (d *emulatorDaemon) notify() {
+	if d.available != nil {
+		close(d.available)
+		d.available = nil
+	}
+}
+
+// acquireFromDaemon gets an emulator from the daemon listening on
+// socketPath.  The connection is kept open until the emulator is released.
+func acquireFromDaemon(ctx context.Context, socketPath string) (*DatastoreEmulator, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socketPath)
+	if err != nil {
+		return nil, errors.Service("Could not connect to emulator daemon", err,
+			errors.Fields{"socketPath": socketPath})
+	}
+
+	resp, err := daemonCall(conn, "acquire")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.Emulator == nil {
+		conn.Close()
+		return nil, errors.Internal("Emulator daemon did not return an emulator")
+	}
+
+	emulator := resp.Emulator
+	emulator.daemonConn = conn
+	return emulator, nil
+}
+
+// releaseToDaemon hands emulator back to the daemon it came from.
+func (emulator *DatastoreEmulator) releaseToDaemon() error {
+	_, err := daemonCall(emulator.daemonConn, "release")
+	closeErr := emulator.daemonConn.Close()
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(closeErr)
+}
+
+func daemonCall(conn net.Conn, op string) (*daemonResponse, error) {
+	err := json.NewEncoder(conn).Encode(&daemonRequest{Op: op})
+	if err != nil {
+		return nil, errors.Service("Could not send request to emulator daemon",
+			err, errors.Fields{"op": op})
+	}
+	var resp daemonResponse
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return nil, errors.Service("Could not read response from emulator daemon",
+			err, errors.Fields{"op": op})
+	}
+	if resp.Error != "" {
+		return nil, errors.Service("Emulator daemon returned an error",
+			errors.Fields{"op": op, "error": resp.Error})
+	}
+	return &resp, nil
+}
@@ -0,0 +1,165 @@
+package dstest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Khan/districts-jobs/pkg/khantest"
+)
+
+type daemonSuite struct{ khantest.Suite }
+
+// fakeEmulators stands in for starting and resetting real emulators.
+type fakeEmulators struct {
+	mu        sync.Mutex
+	started   int
+	resets    map[string]int
+	broken    map[string]bool // emulators that fail to reset
+	shutdowns []string
+}
+
+func (f *fakeEmulators) start(ctx context.Context) (*DatastoreEmulator, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started++
+	return &DatastoreEmulator{
+		Addr: fmt.Sprintf("localhost:%d", 9000+f.started),
+		Pid:  f.started,
+	}, nil
+}
+
+func (f *fakeEmulators) reset(ctx context.Context, emulator *DatastoreEmulator) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resets[emulator.Addr]++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.broken[emulator.Addr] {
+		return fmt.Errorf("emulator %s is broken", emulator.Addr)
+	}
+	return nil
+}
+
+func (f *fakeEmulators) shutdown(ctx context.Context, emulator *DatastoreEmulator) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shutdowns = append(f.shutdowns, emulator.Addr)
+	return nil
+}
+
+func (suite *daemonSuite) TestTwoClients() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	socketPath := filepath.Join(suite.T().TempDir(), "daemon.sock")
+	listener, err := net.Listen("unix", socketPath)
+	suite.Require().NoError(err)
+
+	fake := &fakeEmulators{resets: map[string]int{}}
+	d := &emulatorDaemon{start: fake.start, reset: fake.reset}
+	served := make(chan error, 1)
+	go func() { served <- d.serve(ctx, listener) }()
+
+	// Two clients at once get different emulators.
+	first, err := acquireFromDaemon(ctx, socketPath)
+	suite.Require().NoError(err)
+	second, err := acquireFromDaemon(ctx, socketPath)
+	suite.Require().NoError(err)
+	suite.Require().NotEqual(first.Addr, second.Addr)
+	suite.Require().Equal(2, fake.started)
+
+	// Once they're released, the next client reuses one of them, after
+	// it's been reset.
+	suite.Require().NoError(first.releaseToDaemon())
+	suite.Require().NoError(second.releaseToDaemon())
+
+	third, err := acquireFromDaemon(ctx, socketPath)
+	suite.Require().NoError(err)
+	suite.Require().Contains([]string{first.Addr, second.Addr}, third.Addr)
+	suite.Require().Equal(2, fake.started)
+	suite.Require().Equal(1, fake.resets[third.Addr])
+	suite.Require().NoError(third.releaseToDaemon())
+
+	cancel()
+	suite.Require().NoError(<-served)
+}
+
+func (suite *daemonSuite) TestMaxPoolSize() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	socketPath := filepath.Join(suite.T().TempDir(), "daemon.sock")
+	listener, err := net.Listen("unix", socketPath)
+	suite.Require().NoError(err)
+
+	fake := &fakeEmulators{resets: map[string]int{}}
+	d := &emulatorDaemon{start: fake.start, reset: fake.reset, max: 1}
+	served := make(chan error, 1)
+	go func() { served <- d.serve(ctx, listener) }()
+
+	first, err := acquireFromDaemon(ctx, socketPath)
+	suite.Require().NoError(err)
+
+	// The pool is full, so the next client waits for the first to release
+	// its emulator, and then gets the same one.
+	acquired := make(chan *DatastoreEmulator, 1)
+	acquireErr := make(chan error, 1)
+	go func() {
+		second, err := acquireFromDaemon(ctx, socketPath)
+		acquireErr <- err
+		acquired <- second
+	}()
+	select {
+	case <-acquireErr:
+		suite.T().Fatal("Got an emulator from a full pool")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	suite.Require().NoError(first.releaseToDaemon())
+	suite.Require().NoError(<-acquireErr)
+	second := <-acquired
+	suite.Require().Equal(first.Addr, second.Addr)
+	suite.Require().Equal(1, fake.started)
+	suite.Require().NoError(second.releaseToDaemon())
+
+	cancel()
+	suite.Require().NoError(<-served)
+}
+
+func (suite *daemonSuite) TestResetFailure() {
+	ctx := context.Background()
+	fake := &fakeEmulators{resets: map[string]int{}, broken: map[string]bool{}}
+	d := &emulatorDaemon{start: fake.start, reset: fake.reset, shutdown: fake.shutdown, max: 1}
+
+	first, err := d.get(ctx)
+	suite.Require().NoError(err)
+	d.put(first)
+
+	// A reset cut short by the client's ctx leaves the emulator in the
+	// pool.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = d.get(cancelled)
+	suite.Require().Error(err)
+	suite.Require().Equal([]*DatastoreEmulator{first}, d.idle)
+	suite.Require().Empty(fake.shutdowns)
+
+	// An emulator that won't reset is shut down and replaced, without
+	// going over the pool's size.
+	fake.broken[first.Addr] = true
+	second, err := d.get(ctx)
+	suite.Require().NoError(err)
+	suite.Require().NotEqual(first.Addr, second.Addr)
+	suite.Require().Equal([]string{first.Addr}, fake.shutdowns)
+	suite.Require().Equal(1, d.running)
+}
+
+func TestDaemon(t *testing.T) {
+	khantest.Run(t, new(daemonSuite))
+}
@@ -11,13 +11,17 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -36,6 +40,15 @@ type DatastoreEmulator struct {
 	// when serializing
 	lockFile    *os.File
 	LogFilename string `json:"logFilename"`
+	// daemonConn is set instead of lockFile for emulators we got from
+	// the daemon (see daemon.go).
+	daemonConn net.Conn
+	// resetMu serializes Resets, since overlapping calls to /reset can
+	// leave the emulator in a weird state.
+	resetMu sync.Mutex
+	// dedicated is set for emulators that aren't in the pool (see
+	// startDedicatedEmulator); Release stops them.
+	dedicated bool
 }
 
 func gitCommandWithBasePath(out io.Writer, basePath string, cmds []string) error {
@@ -103,30 +116,57 @@ func (emulator *DatastoreEmulator) datadir() string {
 	return strings.Replace(emulator.LogFilename, ".out", ".data", 1)
 }
 
+// emulatorHTTPClient is used for requests to the emulator's HTTP API.
+var emulatorHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// resetAttempts is how many times Reset tries to reset the emulator.
+const resetAttempts = 5
+
 // Reset resets the datastore emulator back to empty.
 //
 // It can be useful to call this before each test to ensure no state
-// leaks between test cases.
+// leaks between test cases.  In case the emulator is momentarily busy,
+// this retries a few times (with backoff), giving up early if ctx is done.
+// It's safe to call concurrently.
 func (emulator *DatastoreEmulator) Reset(ctx context.Context) error {
+	emulator.resetMu.Lock()
+	defer emulator.resetMu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < resetAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(pollingInterval(attempt - 1)):
+			case <-ctx.Done():
+				return errors.Service("Error resetting datastore emulator",
+					err, errors.Fields{"attempts": attempt})
+			}
+		}
+		err = emulator.reset(ctx)
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.Service("Error resetting datastore emulator",
+		err, errors.Fields{"attempts": resetAttempts})
+}
+
+func (emulator *DatastoreEmulator) reset(ctx context.Context) error {
 	// The /reset endpoint isn't officially documented, but it seems to
 	// be relatively stable.
 	//
 	// To allow for parallel testing using the same emulator, we could
 	// just define a new project id per test case instead of clearing
-	// out old data. This would mean having test cases build a new
-	// dsClient for each test case, since we cannot change the project id
-	// per test
+	// out old data (see TempDSClient.ResetByNewProject).
 	url := fmt.Sprintf("http://%v/reset", emulator.Addr)
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
-		return errors.Service("Error resetting datastore emulator", err)
+		return errors.WithStack(err)
 	}
 
-	// TODO(benkraft): Refactor to pass in http-context and use ctx.HTTP().
-	//nolint:ka-banned-symbol // see previous line
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := emulatorHTTPClient.Do(req)
 	if err != nil {
-		return errors.Service("Error resetting datastore emulator", err)
+		return errors.WithStack(err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
@@ -153,21 +193,91 @@ func (emulator *DatastoreEmulator) Release() error {
 			errors.Fields{"indexes": missing})
 	}
 
-	err = syscall.Flock(int(emulator.lockFile.Fd()), syscall.LOCK_UN)
-	if err != nil {
-		err = errors.Service("unable to release emulator",
-			err,
-			errors.Fields{
-				"filename": emulator.lockFile.Name(),
-				"fd":       emulator.lockFile.Fd(),
-			})
+	if emulator.dedicated {
+		err = emulator.stop()
+	} else if emulator.daemonConn != nil {
+		err = emulator.releaseToDaemon()
+	} else {
+		err = syscall.Flock(int(emulator.lockFile.Fd()), syscall.LOCK_UN)
+		if err != nil {
+			err = errors.Service("unable to release emulator",
+				err,
+				errors.Fields{
+					"filename": emulator.lockFile.Name(),
+					"fd":       emulator.lockFile.Fd(),
+				})
+		}
+
+		emulator.lockFile.Close()
 	}
 
-	emulator.lockFile.Close()
+	if err == nil {
+		callHook(currentHooks().OnEmulatorRelease, emulator.Addr)
+	}
 	return err
 }
 
+// Shutdown stops the emulator cleanly, via its /shutdown endpoint, and
+// waits for it to exit.  It then removes its lockfile and data, so it's
+// gone from the pool for good.  It can't be used on emulators from the
+// daemon, which manages them itself.
+func (emulator *DatastoreEmulator) Shutdown(ctx context.Context) error {
+	if emulator.daemonConn != nil {
+		return errors.InvalidInput("Can't shut down an emulator owned by the daemon")
+	}
+
+	url := fmt.Sprintf("http://%v/shutdown", emulator.Addr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := emulatorHTTPClient.Do(req)
+	if err != nil {
+		return errors.Service("Error shutting down datastore emulator", err,
+			errors.Fields{"addr": emulator.Addr})
+	}
+	resp.Body.Close()
+
+	for attempt := 0; syscall.Kill(emulator.Pid, syscall.Signal(0)) == nil; attempt++ {
+		select {
+		case <-time.After(pollingInterval(attempt)):
+		case <-ctx.Done():
+			return errors.Service("Datastore emulator didn't exit after shutdown",
+				ctx.Err(), errors.Fields{"pid": emulator.Pid})
+		}
+	}
+
+	lockfilePath := strings.Replace(emulator.LogFilename, ".out", ".lockfile.json", 1)
+	if emulator.lockFile != nil {
+		lockfilePath = emulator.lockFile.Name()
+		emulator.lockFile.Close()
+	}
+	os.Remove(lockfilePath)
+	os.RemoveAll(emulator.datadir())
+	return nil
+}
+
 func acquireDatastoreEmulator(ctx context.Context, projectID string) (*DatastoreEmulator, error) {
+	if os.Getenv(daemonEnvVar) == "" {
+		return acquireLocalEmulator(ctx, projectID)
+	}
+
+	socketPath, err := EnsureDaemon()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to start emulator daemon")
+	}
+	// The daemon always resets its emulators before handing them out.
+	emulator, err := acquireFromDaemon(ctx, socketPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get emulator from daemon")
+	}
+	clearIndexXMLFile(emulator.datadir())
+	return emulator, nil
+}
+
+// acquireLocalEmulator acquires an emulator from the lockfile pool, starting
+// a new one if none is available.
+func acquireLocalEmulator(ctx context.Context, projectID string) (*DatastoreEmulator, error) {
 	// First we try to lock an emulator that's already running.
 	emulator, err := lockRunningEmulator(ctx)
 	if err != nil && !errors.Is(err, errors.TransientKhanServiceKind) {
@@ -179,12 +289,14 @@ func acquireDatastoreEmulator(ctx context.Context, projectID string) (*Datastore
 		if err != nil {
 			return nil, errors.Wrap(err, "unable to start new emulator")
 		}
+		callHook(currentHooks().OnEmulatorStart, emulator.Addr)
 	} else {
 		// We got an emulator.  Make sure it's clean before use.
 		err = emulator.Reset(ctx)
 		if err != nil {
 			return nil, errors.Wrap(err, "unable to reset emulator")
 		}
+		callHook(currentHooks().OnEmulatorReuse, emulator.Addr)
 	}
 
 	// Clear out the index.xml file from an old test, so it doesn't
@@ -255,12 +367,18 @@ func tryLockEmulator(ctx context.Context, filePath string) (*DatastoreEmulator,
 		os.Remove(filePath)
 		os.Remove(strings.Replace(filePath, ".lockfile.json", ".out", 1))
 		fmt.Println("The process isn't alive", file, err)
+		if emulator != nil {
+			callHook(currentHooks().OnEmulatorReclaim, emulator.Addr)
+		}
 		return nil, errors.Service(err, "message", emulatorUnavailable)
 	}
 
 	return emulator, nil
 }
 
+// emulatorFromFile reads the emulator from lockedFile, and checks that it's
+// still running.  If the lockfile was valid but the emulator isn't running,
+// it returns the emulator along with the error.
 func emulatorFromFile(ctx context.Context, lockedFile *os.File) (*DatastoreEmulator, error) {
 	// Read the lock file and check that the process is still running
 	jsonData, err := ioutil.ReadAll(lockedFile)
@@ -285,7 +403,7 @@ func emulatorFromFile(ctx context.Context, lockedFile *os.File) (*DatastoreEmula
 	// more details
 	err = syscall.Kill(emulator.Pid, syscall.Signal(0))
 	if err != nil {
-		return nil, errors.Internal("Process no longer running",
+		return &emulator, errors.Internal("Process no longer running",
 			errors.Fields{"pid": emulator.Pid})
 	}
 
@@ -299,18 +417,102 @@ func emulatorFromFile(ctx context.Context, lockedFile *os.File) (*DatastoreEmula
 		logName = strings.Replace(
 			lockedFile.Name(), ".lockfile.json", ".out", 1)
 	}
-	err = waitForStartup(ctx, emulator.Addr, logName)
+	addr, err := waitForStartup(ctx, emulator.Addr, logName)
 	if err != nil {
 		fmt.Println("waitForStartup got error:", err)
 		// caller will remove the lockfile on error
-		return nil, errors.Internal("Could not contact emulator",
+		return &emulator, errors.Internal("Could not contact emulator",
 			err, errors.Fields{"addr": emulator.Addr})
 	}
+	emulator.Addr = addr
 
 	return &emulator, nil
 }
 
 func startEmulator(ctx context.Context, projectID string) (*DatastoreEmulator, error) {
+	emulator, err := launchEmulator(ctx, projectID, 1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	lockfilePath := strings.Replace(emulator.LogFilename, ".out", ".lockfile.json", 1)
+
+	// Now that we have a valid emulator, write its config to a lockfile
+	// to be used by other processes when ours exits.
+	lockFile, err := os.Create(lockfilePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Delete and close the file if any error occurred.  We need to hold
+	// it open otherwise, since our Flock depends on an open file
+	// descriptor.
+	defer func() {
+		if err != nil {
+			lockFile.Close()
+			os.Remove(lockfilePath)
+		}
+	}()
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	emulator.lockFile = lockFile
+
+	emulatorData, err := json.Marshal(emulator)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	_, err = lockFile.Write(emulatorData)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return emulator, nil
+}
+
+// startDedicatedEmulator starts an emulator just for the caller, with the
+// given consistency (see NewTempClientWithConsistency).  It isn't added
+// to the pool, and Release stops it.
+func startDedicatedEmulator(
+	ctx context.Context,
+	projectID string,
+	consistency float64,
+) (*DatastoreEmulator, error) {
+	emulator, err := launchEmulator(ctx, projectID, consistency, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to start dedicated emulator")
+	}
+	emulator.dedicated = true
+	callHook(currentHooks().OnEmulatorStart, emulator.Addr)
+	clearIndexXMLFile(emulator.datadir())
+	return emulator, nil
+}
+
+// stop kills a dedicated emulator, and removes its files.
+func (emulator *DatastoreEmulator) stop() error {
+	// The emulator was started in its own process group, so that this
+	// kills the JVM as well as the gcloud wrapper.
+	err := syscall.Kill(-emulator.Pid, syscall.SIGKILL)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return errors.Service("unable to stop dedicated emulator", err,
+			errors.Fields{"pid": emulator.Pid})
+	}
+	os.RemoveAll(emulator.datadir())
+	os.Remove(emulator.LogFilename)
+	return nil
+}
+
+// launchEmulator starts an emulator process, and waits for it to be ready.
+// If ownGroup is set, the process is put in a new process group, so that
+// it and its children can be killed together.
+func launchEmulator(
+	ctx context.Context,
+	projectID string,
+	consistency float64,
+	ownGroup bool,
+) (*DatastoreEmulator, error) {
 	lockDirPath := LockDirPath()
 
 	// First find a free port to run the emulator on
@@ -344,23 +546,19 @@ func startEmulator(ctx context.Context, projectID string) (*DatastoreEmulator, e
 	// Start the emulator on that port
 	// TODO(dhruv): Consider adding a timeout here if we find it's too
 	// resource intensive to constantly run an emulator for testing.
-	cmdPath, err := exec.LookPath("gcloud")
+	cmdPath, args, err := emulatorCommand(
+		projectID, emulatorAddr,
+		strings.Replace(gcloudOutput.Name(), ".out", ".data", 1),
+		consistency)
 	if err != nil {
-		return nil, errors.Internal("Could not find gcloud executable", err)
-	}
-
-	args := []string{
-		"beta", "emulators", "datastore", "start",
-		"--project=" + projectID,
-		"--host-port=" + emulatorAddr,
-		"--data-dir=" + strings.Replace(gcloudOutput.Name(), ".out", ".data", 1),
-		// We must pass `--no-store-on-disk` for /reset to work.
-		"--no-store-on-disk",
-		"--consistency=1",
+		return nil, err
 	}
 	cmd := exec.Command(cmdPath, args...)
 	cmd.Stdout = gcloudOutput
 	cmd.Stderr = gcloudOutput
+	if ownGroup {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
 
 	err = cmd.Start()
 	if err != nil {
@@ -369,8 +567,21 @@ func startEmulator(ctx context.Context, projectID string) (*DatastoreEmulator, e
 			errors.Fields{"emulator_cmd": fmt.Sprintf("%s %s", cmdPath, strings.Join(args, " "))})
 	}
 
-	err = waitForStartup(ctx, emulatorAddr, gcloudOutput.Name())
+	// If gcloud exits (e.g. because the emulator component isn't
+	// installed) there's no point waiting for the emulator to come up.
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		_ = cmd.Wait()
+		cancel()
+	}()
+
+	emulatorAddr, err = waitForStartup(waitCtx, emulatorAddr, gcloudOutput.Name())
 	if err != nil {
+		if componentErr := checkEmulatorComponent(gcloudOutput.Name()); componentErr != nil {
+			err = componentErr
+			return nil, err
+		}
 		return nil, errors.WrapWithFields(err,
 			errors.Fields{
 				"emulator_cmd": fmt.Sprintf("%s %s",
@@ -378,47 +589,75 @@ func startEmulator(ctx context.Context, projectID string) (*DatastoreEmulator, e
 			})
 	}
 
-	lockfilePath := strings.Replace(gcloudOutput.Name(), ".out", ".lockfile.json", 1)
+	return &DatastoreEmulator{
+		Addr:        emulatorAddr,
+		Pid:         cmd.Process.Pid,
+		LogFilename: gcloudOutput.Name(),
+	}, nil
+}
 
-	// Now that we have a valid emulator, write its config to a lockfile
-	// to be used by other processes when ours exits.
-	lockFile, err := os.Create(lockfilePath)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	// Delete and close the file if any error occurred.  We need to hold
-	// it open otherwise, since our Flock depends on an open file
-	// descriptor.
-	defer func() {
+const (
+	// gcloudPathEnvVar, if set, is the gcloud binary to run (instead of
+	// whichever is on $PATH).
+	gcloudPathEnvVar = "DSTEST_GCLOUD_PATH"
+	// jvmFlagsEnvVar holds space-separated flags to pass to the
+	// emulator's JVM, e.g. "-Xmx512m" to cap its heap on a small CI
+	// machine.  Each is passed with the emulator's --jvm_flag option.
+	jvmFlagsEnvVar = "DSTEST_EMULATOR_JVM_FLAGS"
+)
+
+// emulatorCommand returns the command, and its arguments, to start an
+// emulator.  consistency is the fraction of eventually consistent writes
+// that are applied immediately; see `gcloud beta emulators datastore
+// start --help`.
+func emulatorCommand(projectID, addr, datadir string, consistency float64) (string, []string, error) {
+	cmdPath := os.Getenv(gcloudPathEnvVar)
+	if cmdPath == "" {
+		var err error
+		cmdPath, err = exec.LookPath("gcloud")
 		if err != nil {
-			lockFile.Close()
-			os.Remove(lockfilePath)
+			return "", nil, errors.Internal("Could not find gcloud executable", err)
 		}
-	}()
-
-	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
-	if err != nil {
-		return nil, errors.WithStack(err)
 	}
 
-	emulator := DatastoreEmulator{
-		Addr:        emulatorAddr,
-		Pid:         cmd.Process.Pid,
-		LogFilename: gcloudOutput.Name(),
-		lockFile:    lockFile,
+	args := []string{
+		"beta", "emulators", "datastore", "start",
+		"--project=" + projectID,
+		"--host-port=" + addr,
+		"--data-dir=" + datadir,
+		// We must pass `--no-store-on-disk` for /reset to work.
+		"--no-store-on-disk",
+		"--consistency=" + strconv.FormatFloat(consistency, 'g', -1, 64),
 	}
-
-	emulatorData, err := json.Marshal(&emulator)
-	if err != nil {
-		return nil, errors.WithStack(err)
+	for _, flag := range strings.Fields(os.Getenv(jvmFlagsEnvVar)) {
+		args = append(args, "--jvm_flag="+flag)
 	}
+	return cmdPath, args, nil
+}
 
-	_, err = lockFile.Write(emulatorData)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
+// emulatorComponent is the gcloud component that provides the datastore
+// emulator.
+const emulatorComponent = "cloud-datastore-emulator"
 
-	return &emulator, nil
+// checkEmulatorComponent looks in the emulator's log for gcloud complaining
+// that the emulator component isn't installed, and if so returns an error
+// explaining how to install it.  Otherwise, the error is buried in the log,
+// and the caller just sees that the emulator didn't start.
+func checkEmulatorComponent(logfileName string) error {
+	output, err := ioutil.ReadFile(logfileName)
+	if err != nil {
+		return nil // we'll just report the original error
+	}
+	text := string(output)
+	if !strings.Contains(text, emulatorComponent) ||
+		!(strings.Contains(text, "not installed") ||
+			strings.Contains(text, "requires the installation of components")) {
+		return nil
+	}
+	return errors.Internal(
+		"The "+emulatorComponent+" gcloud component is not installed; "+
+			"run `gcloud components install "+emulatorComponent+"` and try again",
+		errors.Fields{"emulatorOutput": text})
 }
 
 func findFreePort() (int, error) {
@@ -442,11 +681,41 @@ func findFreePort() (int, error) {
 }
 
 const (
-	startupTimeout  = 100 * time.Second
-	pollingInterval = 100 * time.Millisecond
+	startupTimeout = 100 * time.Second
+	// We poll every initialPollingInterval at first, backing off
+	// exponentially up to maxPollingInterval, so that a slow-starting
+	// emulator isn't hammered with requests.
+	initialPollingInterval = 100 * time.Millisecond
+	maxPollingInterval     = 2 * time.Second
+	// pollingJitter is the fraction by which each interval is randomly
+	// shortened or lengthened, so that emulators started together don't
+	// all get polled at the same moment.
+	pollingJitter = 0.1
 )
 
-func waitForStartup(ctx context.Context, addr string, logfileName string) (err error) {
+// pollingInterval returns how long to wait before the given (0-indexed)
+// retry when polling for startup.
+func pollingInterval(attempt int) time.Duration {
+	interval := initialPollingInterval
+	for i := 0; i < attempt && interval < maxPollingInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxPollingInterval {
+		interval = maxPollingInterval
+	}
+	jitter := (2*rand.Float64() - 1) * pollingJitter
+	return time.Duration(float64(interval) * (1 + jitter))
+}
+
+// waitForStartup waits for the emulator, which we asked to listen on addr,
+// to start responding.  It returns the address the emulator actually
+// reports in its log (see emulatorAddrFromLog), which is what clients
+// should connect to.
+func waitForStartup(
+	ctx context.Context,
+	addr string,
+	logfileName string,
+) (actualAddr string, err error) {
 	ctx, cancel := context.WithTimeout(ctx, startupTimeout)
 	defer cancel()
 	defer func() {
@@ -471,26 +740,58 @@ func waitForStartup(ctx context.Context, addr string, logfileName string) (err e
 		}
 	}()
 
+	addr = emulatorAddrFromLog(logfileName, addr)
 	tryAgain, err := checkEmulatorConnection(ctx, addr)
 	if !tryAgain {
-		return err
+		return addr, err
 	}
 
-	for {
+	for attempt := 0; ; attempt++ {
 		// TODO(csilvers): change these cases to err != nil instead.
 		select {
-		case <-time.After(pollingInterval):
+		case <-time.After(pollingInterval(attempt)):
+			addr = emulatorAddrFromLog(logfileName, addr)
 			tryAgain, err := checkEmulatorConnection(ctx, addr)
 			if !tryAgain {
-				return err
+				return addr, err
 			}
 		case <-ctx.Done():
 			err = ctx.Err()
-			return errors.WithStack(err)
+			return "", errors.WithStack(err)
 		}
 	}
 }
 
+// The emulator logs the address it's serving on, in a line like
+// "[datastore] API endpoint: http://localhost:8081", just before it logs
+// "Dev App Server is now running".
+var apiEndpointRegexp = regexp.MustCompile(`API endpoint: https?://([^\s/]+)`)
+
+// parseEmulatorAddr returns the host:port from the emulator's "API
+// endpoint" log line, or "" if it hasn't logged one.
+func parseEmulatorAddr(emulatorOutput string) string {
+	match := apiEndpointRegexp.FindStringSubmatch(emulatorOutput)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// emulatorAddrFromLog returns the address the emulator logged in
+// logfileName.  This isn't always exactly the host:port we asked for (it
+// may say [::1] instead of localhost, for instance), so it's better to use
+// what it says.  If it hasn't logged one (yet), we return requestedAddr.
+func emulatorAddrFromLog(logfileName, requestedAddr string) string {
+	output, err := ioutil.ReadFile(logfileName)
+	if err != nil {
+		return requestedAddr
+	}
+	if addr := parseEmulatorAddr(string(output)); addr != "" {
+		return addr
+	}
+	return requestedAddr
+}
+
 // checkEmulatorConnection attempts to make an HTTP request to the emulator.
 // If it gets the expected response *or* encounters an error condition that
 // is abnormal, it returns false for tryAgain. That means it's safe to
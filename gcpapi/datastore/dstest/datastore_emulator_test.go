@@ -0,0 +1,199 @@
+package dstest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Khan/districts-jobs/pkg/khantest"
+)
+
+type datastoreEmulatorSuite struct{ khantest.Suite }
+
+func (suite *datastoreEmulatorSuite) TestPollingIntervalBacksOff() {
+	within := func(d, want time.Duration) bool {
+		slop := time.Duration(float64(want) * pollingJitter)
+		return d >= want-slop && d <= want+slop
+	}
+
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1600 * time.Millisecond,
+		2 * time.Second,
+		2 * time.Second,
+		2 * time.Second,
+	}
+	var prev time.Duration
+	for attempt, w := range want {
+		got := pollingInterval(attempt)
+		suite.Require().True(within(got, w),
+			"attempt %v: got %v, want %v ± %v", attempt, got, w, pollingJitter)
+		if w < maxPollingInterval {
+			suite.Require().True(got > prev,
+				"attempt %v: %v did not grow from %v", attempt, got, prev)
+		}
+		prev = got
+	}
+
+	// Even after many attempts we never wait longer than the cap.
+	suite.Require().True(within(pollingInterval(1000), maxPollingInterval))
+}
+
+func (suite *datastoreEmulatorSuite) TestComponentNotInstalled() {
+	dir := suite.T().TempDir()
+
+	logfileName := filepath.Join(dir, "emulator-1.out")
+	err := ioutil.WriteFile(logfileName, []byte(
+		"ERROR: (gcloud.beta.emulators.datastore.start) You do not currently "+
+			"have this command group installed.  Using it requires the "+
+			"installation of components: [cloud-datastore-emulator]\n"), 0o644)
+	suite.Require().NoError(err)
+
+	err = checkEmulatorComponent(logfileName)
+	suite.Require().Error(err)
+	suite.Require().True(
+		strings.Contains(err.Error(), "gcloud components install cloud-datastore-emulator"),
+		"got %v", err)
+
+	// Other failures are left alone.
+	otherLogfileName := filepath.Join(dir, "emulator-2.out")
+	err = ioutil.WriteFile(otherLogfileName,
+		[]byte("java.net.BindException: Address already in use\n"), 0o644)
+	suite.Require().NoError(err)
+	suite.Require().NoError(checkEmulatorComponent(otherLogfileName))
+	suite.Require().NoError(checkEmulatorComponent(filepath.Join(dir, "missing.out")))
+}
+
+func (suite *datastoreEmulatorSuite) TestEmulatorCommandFromEnv() {
+	for _, name := range []string{gcloudPathEnvVar, jvmFlagsEnvVar} {
+		defer os.Setenv(name, os.Getenv(name))
+	}
+	os.Setenv(gcloudPathEnvVar, "/opt/google-cloud-sdk/bin/gcloud")
+	os.Setenv(jvmFlagsEnvVar, "-Xmx256m  -XX:+UseSerialGC")
+
+	cmdPath, args, err := emulatorCommand("khan-test", "localhost:8081", "/tmp/emulator.data", 1)
+	suite.Require().NoError(err)
+	suite.Require().Equal("/opt/google-cloud-sdk/bin/gcloud", cmdPath)
+	suite.Require().Equal([]string{
+		"beta", "emulators", "datastore", "start",
+		"--project=khan-test",
+		"--host-port=localhost:8081",
+		"--data-dir=/tmp/emulator.data",
+		"--no-store-on-disk",
+		"--consistency=1",
+		"--jvm_flag=-Xmx256m",
+		"--jvm_flag=-XX:+UseSerialGC",
+	}, args)
+
+	_, args, err = emulatorCommand("khan-test", "localhost:8081", "/tmp/emulator.data", 0.5)
+	suite.Require().NoError(err)
+	suite.Require().Contains(args, "--consistency=0.5")
+}
+
+func (suite *datastoreEmulatorSuite) TestParseEmulatorAddr() {
+	output := `Executing: /usr/lib/google-cloud-sdk/platform/cloud-datastore-emulator/cloud_datastore_emulator start --host=localhost --port=8081
+[datastore] API endpoint: http://[::1]:8081
+[datastore] If you are using a library that supports the DATASTORE_EMULATOR_HOST environment variable, run:
+[datastore]
+[datastore]   export DATASTORE_EMULATOR_HOST=[::1]:8081
+[datastore]
+[datastore] Dev App Server is now running.
+`
+	suite.Require().Equal("[::1]:8081", parseEmulatorAddr(output))
+	suite.Require().Equal("", parseEmulatorAddr("[datastore] Starting...\n"))
+
+	// We fall back to the requested address until the emulator logs one.
+	dir := suite.T().TempDir()
+	logfileName := filepath.Join(dir, "emulator-1.out")
+	suite.Require().Equal("localhost:8081", emulatorAddrFromLog(logfileName, "localhost:8081"))
+	suite.Require().NoError(ioutil.WriteFile(logfileName, []byte(output), 0o644))
+	suite.Require().Equal("[::1]:8081", emulatorAddrFromLog(logfileName, "localhost:8081"))
+}
+
+func (suite *datastoreEmulatorSuite) TestResetRetries() {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+	defer server.Close()
+
+	emulator := &DatastoreEmulator{Addr: server.Listener.Addr().String()}
+	err := emulator.Reset(context.Background())
+	suite.Require().NoError(err)
+	suite.Require().Equal(2, requests)
+
+	// If it never succeeds, we give up eventually.
+	server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = emulator.Reset(ctx)
+	suite.Require().Error(err)
+}
+
+func (suite *datastoreEmulatorSuite) TestConcurrentResets() {
+	// A fake emulator which notices overlapping resets.
+	var mu sync.Mutex
+	entities, inFlight, maxInFlight := 3, 0, 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			if r.URL.Path == "/reset" {
+				entities = 0
+			}
+			mu.Unlock()
+		}))
+	defer server.Close()
+
+	emulator := &DatastoreEmulator{Addr: server.Listener.Addr().String()}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- emulator.Reset(context.Background())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		suite.Require().NoError(err)
+	}
+
+	mu.Lock()
+	suite.Require().Equal(1, maxInFlight)
+	suite.Require().Equal(0, entities)
+	mu.Unlock()
+
+	tryAgain, err := checkEmulatorConnection(context.Background(), emulator.Addr)
+	suite.Require().False(tryAgain)
+	suite.Require().NoError(err)
+}
+
+func TestDatastoreEmulator(t *testing.T) {
+	khantest.Run(t, new(datastoreEmulatorSuite))
+}
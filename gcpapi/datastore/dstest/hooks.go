@@ -0,0 +1,44 @@
+package dstest
+
+import "sync"
+
+// EmulatorHooks are called at points in the lifecycle of the emulators in
+// the pool, e.g. so that CI can report on pool churn.  Each is passed the
+// emulator's address.  Any of them may be nil.
+type EmulatorHooks struct {
+	// OnEmulatorStart is called when we start a new emulator.
+	OnEmulatorStart func(addr string)
+	// OnEmulatorReuse is called when we lock an emulator that's already
+	// running.
+	OnEmulatorReuse func(addr string)
+	// OnEmulatorRelease is called when a test releases its emulator.
+	OnEmulatorRelease func(addr string)
+	// OnEmulatorReclaim is called when we find a lockfile for an emulator
+	// that is no longer running, and remove it.
+	OnEmulatorReclaim func(addr string)
+}
+
+var (
+	hooksMu sync.Mutex
+	hooks   EmulatorHooks
+)
+
+// SetEmulatorHooks sets the hooks to call for all emulators in this
+// process, replacing any set previously.
+func SetEmulatorHooks(h EmulatorHooks) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks = h
+}
+
+func currentHooks() EmulatorHooks {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	return hooks
+}
+
+func callHook(hook func(addr string), addr string) {
+	if hook != nil {
+		hook(addr)
+	}
+}
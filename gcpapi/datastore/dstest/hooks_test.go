@@ -0,0 +1,169 @@
+package dstest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Khan/districts-jobs/pkg/khantest"
+)
+
+// fakeGcloudEnvVar makes the test binary act as a (very) fake gcloud, so
+// we can test the pool without a real emulator.
+const fakeGcloudEnvVar = "DSTEST_FAKE_GCLOUD"
+
+func init() {
+	if os.Getenv(fakeGcloudEnvVar) != "" {
+		runFakeGcloud(os.Args[1:])
+		os.Exit(0)
+	}
+}
+
+// runFakeGcloud serves 200s on the --host-port it's given, which is all
+// the pool needs from an emulator, and exits on /shutdown.
+func runFakeGcloud(args []string) {
+	var hostPort string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--host-port=") {
+			hostPort = strings.TrimPrefix(arg, "--host-port=")
+		}
+	}
+	fmt.Printf("[datastore] API endpoint: http://%v\n", hostPort)
+	fmt.Println("[datastore] Dev App Server is now running.")
+	_ = http.ListenAndServe(hostPort, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/shutdown" {
+				go os.Exit(0)
+			}
+		}))
+}
+
+type hooksSuite struct{ khantest.Suite }
+
+// useFakeGcloud points the pool at a fresh lockfile directory, and makes it
+// start fake emulators.
+func (suite *hooksSuite) useFakeGcloud() {
+	exe, err := os.Executable()
+	suite.Require().NoError(err)
+
+	oldLockDir := lockDirAbsPath
+	lockDirAbsPath = suite.T().TempDir()
+	os.Setenv(gcloudPathEnvVar, exe)
+	os.Setenv(fakeGcloudEnvVar, "1")
+	suite.T().Cleanup(func() {
+		lockDirAbsPath = oldLockDir
+		os.Unsetenv(gcloudPathEnvVar)
+		os.Unsetenv(fakeGcloudEnvVar)
+	})
+}
+
+// killEmulator kills the (fake) emulator, and waits for it to be gone.
+func (suite *hooksSuite) killEmulator(emulator *DatastoreEmulator) {
+	suite.Require().NoError(syscall.Kill(emulator.Pid, syscall.SIGKILL))
+	deadline := time.Now().Add(10 * time.Second)
+	for syscall.Kill(emulator.Pid, syscall.Signal(0)) == nil {
+		suite.Require().True(time.Now().Before(deadline), "emulator didn't exit")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (suite *hooksSuite) TestHooks() {
+	suite.useFakeGcloud()
+	ctx := context.Background()
+
+	var events []string
+	hook := func(event string) func(string) {
+		return func(addr string) { events = append(events, event+" "+addr) }
+	}
+	SetEmulatorHooks(EmulatorHooks{
+		OnEmulatorStart:   hook("start"),
+		OnEmulatorReuse:   hook("reuse"),
+		OnEmulatorRelease: hook("release"),
+		OnEmulatorReclaim: hook("reclaim"),
+	})
+	defer SetEmulatorHooks(EmulatorHooks{})
+
+	first, err := acquireLocalEmulator(ctx, tempProjectID)
+	suite.Require().NoError(err)
+	suite.Require().NoError(first.Release())
+
+	again, err := acquireLocalEmulator(ctx, tempProjectID)
+	suite.Require().NoError(err)
+	suite.Require().Equal(first.Addr, again.Addr)
+	suite.Require().NoError(again.Release())
+
+	suite.killEmulator(first)
+	second, err := acquireLocalEmulator(ctx, tempProjectID)
+	suite.Require().NoError(err)
+	defer suite.killEmulator(second)
+	suite.Require().NoError(second.Release())
+
+	suite.Require().Equal([]string{
+		"start " + first.Addr,
+		"release " + first.Addr,
+		"reuse " + first.Addr,
+		"release " + first.Addr,
+		"reclaim " + first.Addr,
+		"start " + second.Addr,
+		"release " + second.Addr,
+	}, events)
+}
+
+func (suite *hooksSuite) TestDedicatedEmulator() {
+	suite.useFakeGcloud()
+	ctx := context.Background()
+
+	var events []string
+	SetEmulatorHooks(EmulatorHooks{
+		OnEmulatorStart:   func(addr string) { events = append(events, "start") },
+		OnEmulatorRelease: func(addr string) { events = append(events, "release") },
+	})
+	defer SetEmulatorHooks(EmulatorHooks{})
+
+	emulator, err := startDedicatedEmulator(ctx, tempProjectID, 0.5)
+	suite.Require().NoError(err)
+	_, err = checkEmulatorConnection(ctx, emulator.Addr)
+	suite.Require().NoError(err)
+
+	// It's not in the pool, so no-one else can lock it.
+	other, err := lockRunningEmulator(ctx)
+	suite.Require().Error(err)
+	suite.Require().Nil(other)
+
+	suite.Require().NoError(emulator.Release())
+	deadline := time.Now().Add(10 * time.Second)
+	for syscall.Kill(emulator.Pid, syscall.Signal(0)) == nil {
+		suite.Require().True(time.Now().Before(deadline), "emulator wasn't stopped")
+		time.Sleep(10 * time.Millisecond)
+	}
+	suite.Require().Equal([]string{"start", "release"}, events)
+}
+
+func (suite *hooksSuite) TestShutdown() {
+	suite.useFakeGcloud()
+	ctx := context.Background()
+
+	emulator, err := acquireLocalEmulator(ctx, tempProjectID)
+	suite.Require().NoError(err)
+	lockfilePath := emulator.lockFile.Name()
+	_, err = os.Stat(emulator.datadir())
+	suite.Require().NoError(err)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	suite.Require().NoError(emulator.Shutdown(ctx))
+	suite.Require().Error(syscall.Kill(emulator.Pid, syscall.Signal(0)))
+	_, err = os.Stat(lockfilePath)
+	suite.Require().True(os.IsNotExist(err), "lockfile wasn't removed")
+	_, err = os.Stat(emulator.datadir())
+	suite.Require().True(os.IsNotExist(err), "data dir wasn't removed")
+}
+
+func TestHooks(t *testing.T) {
+	khantest.Run(t, new(hooksSuite))
+}
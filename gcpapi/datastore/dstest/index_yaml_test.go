@@ -2,6 +2,8 @@ package dstest
 
 import (
 	"encoding/xml"
+	"io/ioutil"
+	"path"
 	"testing"
 
 	"gopkg.in/yaml.v2"
@@ -124,6 +126,102 @@ indexes:
 	suite.Require().Equal([]_index{xmlIndexes[1]}, _setDifference(xmlIndexes, yamlIndexes))
 }
 
+func (suite *indexYamlSuite) TestIndexUsage() {
+	xmlData := `
+<!-- Indices written at Tue, 9 Mar 2021 11:06:57 PST -->
+<datastore-indexes autoGenerate="true">
+    <!-- Used 3 times in query history -->
+    <datastore-index kind="AccountDeletionRequest" ancestor="false"
+                     source="auto">
+        <property name="cancelled" direction="asc"/>
+        <property name="date" direction="desc"/>
+    </datastore-index>
+    <!-- Used 1 time in query history -->
+    <datastore-index kind="FrozenModelStore" ancestor="true" source="auto">
+        <property name="index" direction="asc"/>
+    </datastore-index>
+</datastore-indexes>
+`
+	usage, err := _parseIndexUsage([]byte(xmlData))
+	suite.Require().NoError(err)
+	suite.Require().Equal(map[string]int{
+		"AccountDeletionRequest{cancelled,date[desc]}": 3,
+		"FrozenModelStore[ancestor]{index}":            1,
+	}, usage)
+
+	usage, err = _parseIndexUsage([]byte("<datastore-indexes />"))
+	suite.Require().NoError(err)
+	suite.Require().Equal(map[string]int{}, usage)
+}
+
+func (suite *indexYamlSuite) TestNamespaces() {
+	xmlData := `
+<datastore-indexes autoGenerate="true">
+    <datastore-index kind="FrozenModelStore" ancestor="true" source="auto">
+        <property name="index" direction="asc"/>
+    </datastore-index>
+    <datastore-index namespace="teachers" kind="FrozenModelStore"
+                     ancestor="true" source="auto">
+        <property name="index" direction="asc"/>
+    </datastore-index>
+    <datastore-index namespace="students" kind="FrozenModelStore"
+                     ancestor="true" source="auto">
+        <property name="index" direction="asc"/>
+    </datastore-index>
+</datastore-indexes>
+`
+	yamlData := `
+indexes:
+- ancestor: true
+  kind: FrozenModelStore
+  namespace: teachers
+  properties:
+  - name: index
+`
+
+	xmlIndexes, yamlIndexes := suite._parse(xmlData, yamlData)
+
+	suite.Require().Equal("FrozenModelStore[ancestor]{index}", xmlIndexes[0].String())
+	suite.Require().Equal("teachers/FrozenModelStore[ancestor]{index}", xmlIndexes[1].String())
+	suite.Require().NotEqual(xmlIndexes[1].String(), xmlIndexes[2].String())
+
+	// The index in the teachers namespace doesn't cover the others.
+	suite.Require().Equal(
+		[]_index{xmlIndexes[0], xmlIndexes[2]},
+		_setDifference(xmlIndexes, yamlIndexes))
+
+	// But an index without a namespace covers them all.
+	yamlIndexes[0].Namespace = ""
+	suite.Require().Equal([]_index{}, _setDifference(xmlIndexes, yamlIndexes))
+}
+
+func (suite *indexYamlSuite) TestAllowlist() {
+	datadir := suite.T().TempDir()
+	clearIndexXMLFile(datadir)
+	err := ioutil.WriteFile(
+		path.Join(datadir, "WEB-INF/appengine-generated/datastore-indexes-auto.xml"),
+		[]byte(`
+<datastore-indexes autoGenerate="true">
+    <datastore-index kind="DstestMissing" ancestor="false"
+                     source="auto">
+        <property name="cancelled" direction="asc"/>
+        <property name="date" direction="desc"/>
+    </datastore-index>
+    <datastore-index kind="DstestAllowlisted" ancestor="true" source="auto">
+        <property name="index" direction="asc"/>
+    </datastore-index>
+</datastore-indexes>
+`), 0o644)
+	suite.Require().NoError(err)
+
+	SetCompositeIndexAllowlist("DstestAllowlisted[ancestor]{index}")
+	defer SetCompositeIndexAllowlist()
+
+	missing, err := missingCompositeIndexes(datadir)
+	suite.Require().NoError(err)
+	suite.Require().Equal("DstestMissing{cancelled,date[desc]}", missing)
+}
+
 func TestIndexYaml(t *testing.T) {
 	khantest.Run(t, new(indexYamlSuite))
 }
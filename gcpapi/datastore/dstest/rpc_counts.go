@@ -0,0 +1,72 @@
+package dstest
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// rpcCounter counts the datastore RPCs a client makes, by method.
+type rpcCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newRPCCounter() *rpcCounter {
+	return &rpcCounter{counts: map[string]int{}}
+}
+
+// option returns a client option which makes the client count its RPCs
+// with c.  It chains with any interceptors the caller adds.
+func (c *rpcCounter) option() option.ClientOption {
+	return option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(c.intercept))
+}
+
+func (c *rpcCounter) intercept(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	c.mu.Lock()
+	// e.g. "/google.datastore.v1.Datastore/Lookup" -> "Lookup"
+	c.counts[path.Base(method)]++
+	c.mu.Unlock()
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (c *rpcCounter) snapshot() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int, len(c.counts))
+	for method, n := range c.counts {
+		counts[method] = n
+	}
+	return counts
+}
+
+func (c *rpcCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = map[string]int{}
+}
+
+// RPCCounts returns how many datastore RPCs the client has made, by
+// method (e.g. "Lookup", "RunQuery" or "Commit"), since it was created or
+// ResetRPCCounts was last called.  Tests can use it to catch N+1 query
+// regressions, by asserting that a handler made exactly the RPCs it
+// should.
+func (client TempDSClient) RPCCounts() map[string]int {
+	return client.rpcCounts.snapshot()
+}
+
+// ResetRPCCounts zeroes the counts returned by RPCCounts, e.g. after
+// setting up a test's data.
+func (client TempDSClient) ResetRPCCounts() {
+	client.rpcCounts.reset()
+}
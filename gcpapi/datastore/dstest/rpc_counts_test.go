@@ -0,0 +1,47 @@
+package dstest
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+
+	"github.com/Khan/districts-jobs/pkg/khantest"
+	dsifake "github.com/StevenACoffman/gcp-emulator-pool/gcpapi/datastore/dsfake"
+)
+
+type rpcCountsSuite struct{ khantest.Suite }
+
+// The counter doesn't need an emulator, so we test it against dsfake.
+func (suite *rpcCountsSuite) TestCounts() {
+	ctx := context.Background()
+	_, fake := dsifake.NewClient(ctx)
+
+	counter := newRPCCounter()
+	client, err := datastore.NewClient(ctx, "dsfake",
+		option.WithEndpoint(fake.Addr()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+		counter.option())
+	suite.Require().NoError(err)
+	defer client.Close()
+
+	key := datastore.NameKey("Counted", "o1", nil)
+	_, err = client.Put(ctx, key, &Entity{"bar"})
+	suite.Require().NoError(err)
+	suite.Require().Equal(map[string]int{"Commit": 1}, counter.snapshot())
+
+	counter.reset()
+	var entity Entity
+	suite.Require().NoError(client.Get(ctx, key, &entity))
+	var entities []Entity
+	_, err = client.GetAll(ctx, datastore.NewQuery("Counted"), &entities)
+	suite.Require().NoError(err)
+	suite.Require().Equal(map[string]int{"Lookup": 1, "RunQuery": 1}, counter.snapshot())
+}
+
+func TestRPCCounts(t *testing.T) {
+	khantest.Run(t, new(rpcCountsSuite))
+}
@@ -0,0 +1,150 @@
+package dstest
+
+// This file implements snapshots of the emulator's contents, so that suites
+// with a fixed, read-only dataset can load it from a committed fixture
+// rather than re-seeding it entity by entity.
+//
+// A snapshot has one entity per line, in the protobuf JSON encoding of the
+// datastore API's Entity.  We talk to the emulator over that API directly,
+// since the datastore client doesn't let us read or write entities without
+// knowing their Go types.  Only the default namespace is included.
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/Khan/districts-jobs/pkg/errors"
+)
+
+const (
+	// snapshotBatchSize is how many entities LoadSnapshot writes per
+	// commit; 500 is the most datastore allows.
+	snapshotBatchSize = 500
+	// maxSnapshotLineSize is the longest line LoadSnapshot will read; an
+	// entity can be up to 1MiB, and its JSON somewhat bigger.
+	maxSnapshotLineSize = 4 << 20
+)
+
+func (client *TempDSClient) dialEmulator(ctx context.Context) (*grpc.ClientConn, error) {
+	conn, err := grpc.DialContext(ctx, client.emulator.Addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, errors.Service("Could not connect to emulator", err,
+			errors.Fields{"addr": client.emulator.Addr})
+	}
+	return conn, nil
+}
+
+// ExportSnapshot writes all the entities in the client's datastore to w,
+// in a form LoadSnapshot can read back.
+func (client *TempDSClient) ExportSnapshot(ctx context.Context, w io.Writer) error {
+	conn, err := client.dialEmulator(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	dsClient := datastorepb.NewDatastoreClient(conn)
+
+	// A kindless query returns every entity in the namespace.
+	query := &datastorepb.Query{}
+	for {
+		resp, err := dsClient.RunQuery(ctx, &datastorepb.RunQueryRequest{
+			ProjectId: client.projectID,
+			QueryType: &datastorepb.RunQueryRequest_Query{Query: query},
+		})
+		if err != nil {
+			return errors.Service("Error querying emulator", err)
+		}
+
+		for _, result := range resp.Batch.EntityResults {
+			entity := result.Entity
+			path := entity.Key.Path
+			if strings.HasPrefix(path[len(path)-1].Kind, "__") {
+				continue // skip datastore's own stats and metadata
+			}
+			// The project will be whatever we load the snapshot into.
+			entity.Key.PartitionId = nil
+			data, err := protojson.Marshal(entity)
+			if err != nil {
+				return errors.Internal("Could not marshal entity", err)
+			}
+			_, err = w.Write(append(data, '\n'))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		if resp.Batch.MoreResults != datastorepb.QueryResultBatch_NOT_FINISHED {
+			return nil
+		}
+		query.StartCursor = resp.Batch.EndCursor
+	}
+}
+
+// LoadSnapshot writes the entities in the snapshot read from r, as
+// written by ExportSnapshot, to the client's datastore.
+func (client *TempDSClient) LoadSnapshot(ctx context.Context, r io.Reader) error {
+	conn, err := client.dialEmulator(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	dsClient := datastorepb.NewDatastoreClient(conn)
+
+	var mutations []*datastorepb.Mutation
+	commit := func() error {
+		if len(mutations) == 0 {
+			return nil
+		}
+		_, err := dsClient.Commit(ctx, &datastorepb.CommitRequest{
+			ProjectId: client.projectID,
+			Mode:      datastorepb.CommitRequest_NON_TRANSACTIONAL,
+			Mutations: mutations,
+		})
+		mutations = nil
+		if err != nil {
+			return errors.Service("Error writing snapshot to emulator", err)
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxSnapshotLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entity datastorepb.Entity
+		err = protojson.Unmarshal(scanner.Bytes(), &entity)
+		if err != nil {
+			return errors.InvalidInput("Could not parse snapshot entity", err,
+				errors.Fields{"line": line})
+		}
+		if entity.Key == nil {
+			return errors.InvalidInput("Snapshot entity has no key",
+				errors.Fields{"line": line})
+		}
+		entity.Key.PartitionId = &datastorepb.PartitionId{ProjectId: client.projectID}
+
+		mutations = append(mutations, &datastorepb.Mutation{
+			Operation: &datastorepb.Mutation_Upsert{Upsert: &entity},
+		})
+		if len(mutations) == snapshotBatchSize {
+			err = commit()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.InvalidInput("Could not read snapshot", err)
+	}
+	return commit()
+}
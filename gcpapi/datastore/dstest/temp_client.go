@@ -16,20 +16,34 @@ package dstest
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
 
 	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
 
 	"github.com/Khan/districts-jobs/pkg/errors"
 )
 
+// tempProjectID is the project the emulators are started with.
+const tempProjectID = "khan-test"
+
 // TempDSClient is a dsClient for talking to a temporary datastore
 // (generally a datastore emulator used in tests).
 type TempDSClient struct {
-	emulator *DatastoreEmulator
-	dsClient *datastore.Client
+	emulator  *DatastoreEmulator
+	dsClient  *datastore.Client
+	projectID string
+	// opts are the extra options the dsClient was created with,
+	// including the one that counts its RPCs in rpcCounts.
+	opts      []option.ClientOption
+	rpcCounts *rpcCounter
 }
 
 // A ResettableClient is a datastore dsClient that can additionally be reset.
@@ -48,11 +62,41 @@ type ResettableClient interface {
 // Most clients should not need to call this directly; just use
 // servicetest.Suite and it will be set up as suite.KAContext().Datastore().
 func NewTempClient(ctx context.Context) (*TempDSClient, error) {
-	projectID := "khan-test"
+	return NewTempClientWithOptions(ctx)
+}
+
+// NewTempClientWithOptions is like NewTempClient, but creates the datastore
+// client with the given options in addition to the ones needed to talk to
+// the emulator, e.g. to add gRPC interceptors for tracing.
+func NewTempClientWithOptions(
+	ctx context.Context,
+	opts ...option.ClientOption,
+) (*TempDSClient, error) {
+	return NewTempClientWithConsistency(ctx, 1, opts...)
+}
+
+// NewTempClientWithConsistency is like NewTempClientWithOptions, but the
+// emulator applies only the given fraction (between 0 and 1) of writes
+// immediately for non-ancestor queries, for testing code's handling of
+// eventual consistency.  The pool's emulators are strongly consistent
+// (consistency 1), so for any lower value this starts a dedicated
+// emulator, which is much slower, and which Close stops.
+func NewTempClientWithConsistency(
+	ctx context.Context,
+	consistency float64,
+	opts ...option.ClientOption,
+) (*TempDSClient, error) {
+	projectID := tempProjectID
 	// Set in dev/khantest/suite.go:
 	os.Setenv("GOOGLE_CLOUD_PROJECT", projectID)
 
-	emulator, err := acquireDatastoreEmulator(ctx, projectID)
+	var emulator *DatastoreEmulator
+	var err error
+	if consistency < 1 {
+		emulator, err = startDedicatedEmulator(ctx, projectID, consistency)
+	} else {
+		emulator, err = acquireDatastoreEmulator(ctx, projectID)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "Error starting datastore emulator")
 	}
@@ -68,21 +112,18 @@ func NewTempClient(ctx context.Context) (*TempDSClient, error) {
 	//}()
 	//conn, err := grpc.Dial(emulator.Addr, rec.DialOptions()...)
 
-	client, err := datastore.NewClient(ctx,
-		projectID,
-		option.WithEndpoint(emulator.Addr),
-		option.WithoutAuthentication(),
-		option.WithGRPCDialOption(grpc.WithInsecure()),
-	)
+	rpcCounts := newRPCCounter()
+	opts = append([]option.ClientOption{rpcCounts.option()}, opts...)
+	client, err := newEmulatorClient(ctx, projectID, emulator.Addr, opts...)
 	if err != nil {
-		return nil, errors.Wrap(err, "Unable to Create Emulator Datastore Client")
+		return nil, err
 	}
 
 	// Make sure index.yaml is loaded, so we can do some sanity-checks
 	// around composite indexes.
 	loadIndexYAML(ctx) // in index_yaml.go
 
-	return &TempDSClient{emulator, client}, nil
+	return &TempDSClient{emulator, client, projectID, opts, rpcCounts}, nil
 }
 
 // Reset resets the datastore emulator back to empty.
@@ -96,6 +137,50 @@ func (client *TempDSClient) Reset(ctx context.Context) error {
 	return client.emulator.Reset(ctx)
 }
 
+// ResetByNewProject is an alternative to Reset which, rather than clearing
+// the emulator via its (undocumented, and occasionally flaky) /reset
+// endpoint, switches the client to a new project on the same emulator.
+// The new project is guaranteed to be empty.
+//
+// Note that this replaces the client's Datastore(), so callers must not
+// hold on to the old one.
+func (client *TempDSClient) ResetByNewProject(ctx context.Context) error {
+	projectID := fmt.Sprintf("%s-%d-%d",
+		tempProjectID, os.Getpid(), atomic.AddInt64(&resetProjectCounter, 1))
+	dsClient, err := newEmulatorClient(ctx, projectID, client.emulator.Addr, client.opts...)
+	if err != nil {
+		return err
+	}
+	oldClient := client.dsClient
+	client.dsClient = dsClient
+	client.projectID = projectID
+	if err := oldClient.Close(); err != nil {
+		return errors.Service("could not close emulator-dsClient", err)
+	}
+	return nil
+}
+
+// resetProjectCounter, along with our pid, is used to pick unique project
+// IDs for ResetByNewProject.
+var resetProjectCounter int64
+
+func newEmulatorClient(
+	ctx context.Context,
+	projectID, addr string,
+	opts ...option.ClientOption,
+) (*datastore.Client, error) {
+	opts = append([]option.ClientOption{
+		option.WithEndpoint(addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	}, opts...)
+	client, err := datastore.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to Create Emulator Datastore Client")
+	}
+	return client, nil
+}
+
 func (client *TempDSClient) Datastore() *datastore.Client {
 	return client.dsClient
 }
@@ -117,6 +202,59 @@ func (client TempDSClient) UsedCompositeIndexes() ([]string, error) {
 	return descs, err
 }
 
+// RequireNoCompositeIndexes fails the test if it has used any composite
+// indexes, listing them.  It's a regression guard for tests of queries
+// that should stay simple.
+func (client TempDSClient) RequireNoCompositeIndexes(t testing.TB) {
+	t.Helper()
+	indexes, err := client.UsedCompositeIndexes()
+	if err != nil {
+		t.Fatalf("dstest: could not read composite indexes: %v", err)
+		return
+	}
+	if len(indexes) > 0 {
+		t.Errorf("dstest: test used composite indexes:\n%s",
+			strings.Join(indexes, "\n"))
+	}
+}
+
+// CompositeIndexesForQuery runs q, and returns the composite indexes that
+// running it used.  This is useful when debugging a particular query; see
+// UsedCompositeIndexes for the indexes used by the whole test.
+func (client TempDSClient) CompositeIndexesForQuery(
+	ctx context.Context,
+	q *datastore.Query,
+) ([]string, error) {
+	before, err := compositeIndexUsage(client.emulator.datadir())
+	if err != nil {
+		return nil, err
+	}
+
+	it := client.dsClient.Run(ctx, q)
+	for {
+		var entity datastore.PropertyList
+		_, err = it.Next(&entity)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "Error running query")
+		}
+	}
+
+	after, err := compositeIndexUsage(client.emulator.datadir())
+	if err != nil {
+		return nil, err
+	}
+	descs := []string{}
+	for desc, count := range after {
+		if count > before[desc] {
+			descs = append(descs, desc)
+		}
+	}
+	sort.Strings(descs)
+	return descs, nil
+}
+
 // Close closes the dsClient's connection and releases our lock on the
 // emulator so other tests can use it.
 func (client TempDSClient) Close() error {
@@ -1,11 +1,15 @@
 package dstest
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"os"
 	"testing"
 
 	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
 
 	"github.com/Khan/districts-jobs/pkg/khantest"
 	"github.com/Khan/districts-jobs/pkg/models"
@@ -77,6 +81,203 @@ func (suite *tempClientSuite) TestTempClient() {
 	suite.Require().Equal(0, count)
 }
 
+func (suite *tempClientSuite) TestResetByNewProject() {
+	ctx := tempClientContext{context.Background()}
+
+	client, err := NewTempClient(ctx)
+	suite.Require().NoError(err)
+	defer client.Close()
+
+	key := datastore.IncompleteKey(EntityKind.Value, nil)
+	_, err = client.Datastore().Put(ctx, key, &Entity{"bar"})
+	suite.Require().NoError(err)
+
+	query := datastore.NewQuery(EntityKind.Value)
+	count, err := client.Datastore().Count(ctx, query)
+	suite.Require().NoError(err)
+	suite.Require().Equal(1, count)
+
+	err = client.ResetByNewProject(ctx)
+	suite.Require().NoError(err)
+
+	count, err = client.Datastore().Count(ctx, query)
+	suite.Require().NoError(err)
+	suite.Require().Equal(0, count)
+}
+
+func (suite *tempClientSuite) TestNewTempClientWithConsistency() {
+	ctx := tempClientContext{context.Background()}
+
+	client, err := NewTempClientWithConsistency(ctx, 0.5)
+	suite.Require().NoError(err)
+	defer client.Close()
+
+	// Each write has an even chance of being invisible to a global query
+	// right after; the chance that none of these are is negligible.
+	stale := false
+	query := datastore.NewQuery(EntityKind.Value).KeysOnly()
+	for i := 0; i < 20 && !stale; i++ {
+		key := datastore.IncompleteKey(EntityKind.Value, nil)
+		_, err = client.Datastore().Put(ctx, key, &Entity{"bar"})
+		suite.Require().NoError(err)
+
+		count, err := client.Datastore().Count(ctx, query)
+		suite.Require().NoError(err)
+		stale = count <= i
+	}
+	suite.Require().True(stale, "never saw a stale read")
+}
+
+func (suite *tempClientSuite) TestCompositeIndexesForQuery() {
+	ctx := tempClientContext{context.Background()}
+	// Don't fail Release on the index we use on purpose.
+	SetCompositeIndexAllowlist("Entity{Bar[desc],Foo}")
+	defer SetCompositeIndexAllowlist()
+
+	client, err := NewTempClient(ctx)
+	suite.Require().NoError(err)
+	defer client.Close()
+
+	// An equality filter plus a sort on another property needs a
+	// composite index.
+	query := datastore.NewQuery(EntityKind.Value).
+		Filter("Foo =", "bar").
+		Order("-Bar")
+	indexes, err := client.CompositeIndexesForQuery(ctx, query)
+	suite.Require().NoError(err)
+	suite.Require().Equal([]string{"Entity{Bar[desc],Foo}"}, indexes)
+
+	// A kind-only query doesn't, even though the test has now used one.
+	indexes, err = client.CompositeIndexesForQuery(ctx, datastore.NewQuery(EntityKind.Value))
+	suite.Require().NoError(err)
+	suite.Require().Empty(indexes)
+}
+
+func (suite *tempClientSuite) TestSnapshotRoundTrip() {
+	ctx := tempClientContext{context.Background()}
+
+	client, err := NewTempClient(ctx)
+	suite.Require().NoError(err)
+	defer client.Close()
+
+	entities := []Entity{{"bar"}, {"baz"}, {"qux"}}
+	for i, entity := range entities {
+		entity := entity // fix scoping issues; we take a pointer below
+		key := datastore.IDKey(EntityKind.Value, int64(i+1), nil)
+		_, err = client.Datastore().Put(ctx, key, &entity)
+		suite.Require().NoError(err)
+	}
+
+	var snapshot bytes.Buffer
+	err = client.ExportSnapshot(ctx, &snapshot)
+	suite.Require().NoError(err)
+
+	err = client.ResetByNewProject(ctx)
+	suite.Require().NoError(err)
+	err = client.LoadSnapshot(ctx, &snapshot)
+	suite.Require().NoError(err)
+
+	var loaded []Entity
+	keys, err := client.Datastore().GetAll(ctx,
+		datastore.NewQuery(EntityKind.Value).Order("__key__"), &loaded)
+	suite.Require().NoError(err)
+	suite.Require().Equal(entities, loaded)
+	for i, key := range keys {
+		suite.Require().Equal(int64(i+1), key.ID)
+	}
+}
+
+func (suite *tempClientSuite) TestNewTempClientWithOptions() {
+	ctx := tempClientContext{context.Background()}
+
+	var methods []string
+	interceptor := func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		methods = append(methods, method)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	client, err := NewTempClientWithOptions(ctx,
+		option.WithGRPCDialOption(grpc.WithUnaryInterceptor(interceptor)))
+	suite.Require().NoError(err)
+	defer client.Close()
+
+	key := datastore.NameKey(EntityKind.Value, "intercepted", nil)
+	_, err = client.Datastore().Put(ctx, key, &Entity{"bar"})
+	suite.Require().NoError(err)
+	suite.Require().Equal([]string{"/google.datastore.v1.Datastore/Commit"}, methods)
+}
+
+// recordingTB records the failures reported to it instead of failing.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Fatalf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (suite *tempClientSuite) TestRPCCounts() {
+	ctx := tempClientContext{context.Background()}
+
+	client, err := NewTempClient(ctx)
+	suite.Require().NoError(err)
+	defer client.Close()
+
+	key := datastore.NameKey(EntityKind.Value, "counted", nil)
+	_, err = client.Datastore().Put(ctx, key, &Entity{"bar"})
+	suite.Require().NoError(err)
+	client.ResetRPCCounts()
+
+	var entity Entity
+	suite.Require().NoError(client.Datastore().Get(ctx, key, &entity))
+	var entities []Entity
+	_, err = client.Datastore().GetAll(ctx, datastore.NewQuery(EntityKind.Value), &entities)
+	suite.Require().NoError(err)
+	suite.Require().Equal(map[string]int{"Lookup": 1, "RunQuery": 1}, client.RPCCounts())
+}
+
+func (suite *tempClientSuite) TestRequireNoCompositeIndexes() {
+	ctx := tempClientContext{context.Background()}
+	// Don't fail Release on the index we use on purpose.
+	SetCompositeIndexAllowlist("Entity{Bar[desc],Foo}")
+	defer SetCompositeIndexAllowlist()
+
+	client, err := NewTempClient(ctx)
+	suite.Require().NoError(err)
+	defer client.Close()
+
+	var entities []Entity
+	_, err = client.Datastore().GetAll(ctx, datastore.NewQuery(EntityKind.Value), &entities)
+	suite.Require().NoError(err)
+
+	rec := &recordingTB{}
+	client.RequireNoCompositeIndexes(rec)
+	suite.Require().Empty(rec.errors)
+
+	query := datastore.NewQuery(EntityKind.Value).Order("Foo").Order("-Bar")
+	_, err = client.Datastore().GetAll(ctx, query, &entities)
+	suite.Require().NoError(err)
+
+	client.RequireNoCompositeIndexes(rec)
+	suite.Require().Len(rec.errors, 1)
+	suite.Require().Contains(rec.errors[0], "Entity{Bar[desc],Foo}")
+
+}
+
 func TestTempClient(t *testing.T) {
 	if os.Getenv("CI") != "" {
 		t.Skip("Skipping testing in CI environment")
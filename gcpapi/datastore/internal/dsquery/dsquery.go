@@ -0,0 +1,445 @@
+// Package dsquery evaluates datastore queries over an in-memory list of
+// entities.  It's shared by the dsfake and dsmock fakes, which each
+// translate their own representation of queries and entities into this
+// package's, so that the (fiddly) query semantics only live in one place.
+//
+// It supports filters (including on __key__), sort orders, projections,
+// offsets and limits, with these simplifications:
+//   - Integers and doubles compare numerically with each other, rather
+//     than all integers sorting before all doubles.
+//   - A projection on a multi-valued property returns the whole list,
+//     rather than one result per value.
+//   - Cursors and distinct queries aren't supported.
+package dsquery
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+)
+
+// KeyProperty is the name of the pseudo-property holding an entity's key,
+// which can be used in filters and orders.
+const KeyProperty = "__key__"
+
+// Op is a filter operator.
+type Op int
+
+// The filter operators.
+const (
+	LessThan Op = iota + 1
+	LessEq
+	Equal
+	GreaterEq
+	GreaterThan
+	In
+	NotIn
+	NotEqual
+)
+
+// Filter restricts a query to entities whose Property compares to Value
+// according to Op.  For In and NotIn, Value must be a slice.
+type Filter struct {
+	Property string
+	Op       Op
+	Value    interface{}
+}
+
+// Order sorts a query's results by Property.
+type Order struct {
+	Property   string
+	Descending bool
+}
+
+// Query describes a datastore query.
+type Query struct {
+	// Kind may be empty for a kindless query.
+	Kind      string
+	Namespace string
+	Ancestor  *datastore.Key
+	Filters   []Filter
+	// Results are sorted by Orders, and then by key.
+	Orders []Order
+	// If Projection is set, the results only include those properties,
+	// and entities missing any of them are skipped.
+	Projection []string
+	Offset     int
+	// A negative Limit means no limit.
+	Limit int
+}
+
+// Entity is an entity to be queried.  The values in Properties should be
+// as returned by Normalize; a multi-valued property is a []interface{}.
+type Entity struct {
+	Key        *datastore.Key
+	Properties map[string]interface{}
+}
+
+// Run returns the entities matching q, in order.  It doesn't modify
+// entities.
+func Run(q Query, entities []Entity) []Entity {
+	var results []Entity
+	for _, e := range entities {
+		if q.matches(e) {
+			results = append(results, e)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, o := range q.Orders {
+			c := Compare(sortValue(results[i], o), sortValue(results[j], o))
+			if o.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return CompareKeys(results[i].Key, results[j].Key) < 0
+	})
+
+	if q.Offset > 0 {
+		if q.Offset >= len(results) {
+			results = nil
+		} else {
+			results = results[q.Offset:]
+		}
+	}
+	if q.Limit >= 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+
+	if len(q.Projection) > 0 {
+		for i, e := range results {
+			projected := make(map[string]interface{}, len(q.Projection))
+			for _, name := range q.Projection {
+				if name != KeyProperty {
+					projected[name] = e.Properties[name]
+				}
+			}
+			results[i] = Entity{Key: e.Key, Properties: projected}
+		}
+	}
+	return results
+}
+
+// matches reports whether e is in the results of q (ignoring offset and
+// limit).
+func (q Query) matches(e Entity) bool {
+	if q.Kind != "" && e.Key.Kind != q.Kind {
+		return false
+	}
+	if e.Key.Namespace != q.Namespace {
+		return false
+	}
+	if q.Ancestor != nil && !HasAncestor(e.Key, q.Ancestor) {
+		return false
+	}
+	// Entities without a property aren't in its index, so they're
+	// excluded by filters and orders on it (and projections of it).
+	for _, o := range q.Orders {
+		if _, ok := property(e, o.Property); !ok {
+			return false
+		}
+	}
+	for _, name := range q.Projection {
+		if _, ok := property(e, name); !ok {
+			return false
+		}
+	}
+	for _, f := range q.Filters {
+		if !f.matches(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f Filter) matches(e Entity) bool {
+	value, ok := property(e, f.Property)
+	if !ok {
+		return false
+	}
+	want := Normalize(f.Value)
+	// A multi-valued property matches if any of its values do.
+	for _, v := range values(value) {
+		if f.matchesValue(v, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Filter) matchesValue(v, want interface{}) bool {
+	switch f.Op {
+	case In, NotIn:
+		found := false
+		for _, w := range values(want) {
+			if Compare(v, w) == 0 {
+				found = true
+				break
+			}
+		}
+		return found == (f.Op == In)
+	}
+
+	c := Compare(v, want)
+	switch f.Op {
+	case LessThan:
+		return c < 0
+	case LessEq:
+		return c <= 0
+	case Equal:
+		return c == 0
+	case GreaterEq:
+		return c >= 0
+	case GreaterThan:
+		return c > 0
+	case NotEqual:
+		return c != 0
+	}
+	return false
+}
+
+// property returns the named property of e, or its key for KeyProperty.
+func property(e Entity, name string) (interface{}, bool) {
+	if name == KeyProperty {
+		return e.Key, true
+	}
+	v, ok := e.Properties[name]
+	return v, ok
+}
+
+// values returns the values of a (possibly multi-valued) property.
+func values(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+// sortValue returns the value e sorts by for o: for a multi-valued
+// property, that's its smallest value in ascending order, and its largest
+// in descending order.
+func sortValue(e Entity, o Order) interface{} {
+	v, _ := property(e, o.Property)
+	list := values(v)
+	if len(list) == 0 {
+		return nil
+	}
+	best := list[0]
+	for _, x := range list[1:] {
+		c := Compare(x, best)
+		if (o.Descending && c > 0) || (!o.Descending && c < 0) {
+			best = x
+		}
+	}
+	return best
+}
+
+// HasAncestor reports whether ancestor is k or one of its parents.
+func HasAncestor(k, ancestor *datastore.Key) bool {
+	for ; k != nil; k = k.Parent {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	typeOfTime     = reflect.TypeOf(time.Time{})
+	typeOfGeoPoint = reflect.TypeOf(datastore.GeoPoint{})
+	typeOfKeyPtr   = reflect.TypeOf(&datastore.Key{})
+)
+
+// Normalize converts a Go value to the form the engine compares: nil,
+// bool, int64, float64, string, []byte, time.Time (in UTC),
+// datastore.GeoPoint, *datastore.Key, or a []interface{} of those.
+// Values of other types are returned as-is, and only compare equal to
+// themselves.
+func Normalize(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Type() {
+	case typeOfTime:
+		return rv.Interface().(time.Time).UTC()
+	case typeOfGeoPoint, typeOfKeyPtr:
+		return v
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil
+		}
+		return Normalize(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			if rv.Kind() == reflect.Array {
+				// Bytes only works on addressable arrays, so copy it.
+				b := reflect.MakeSlice(reflect.SliceOf(rv.Type().Elem()), rv.Len(), rv.Len())
+				reflect.Copy(b, rv)
+				return b.Bytes()
+			}
+			return rv.Bytes()
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = Normalize(rv.Index(i).Interface())
+		}
+		return list
+	}
+	return v
+}
+
+// typeRank orders values of different types, roughly as datastore does.
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		return 1
+	case time.Time:
+		return 2
+	case bool:
+		return 3
+	case string, []byte:
+		return 4
+	case datastore.GeoPoint:
+		return 5
+	case *datastore.Key:
+		return 6
+	}
+	return 7
+}
+
+// Compare returns -1, 0 or 1 as normalized value a sorts before, with, or
+// after b.
+func Compare(a, b interface{}) int {
+	if ra, rb := typeRank(a), typeRank(b); ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case int64:
+		if b, ok := b.(int64); ok {
+			return compareInts(a, b)
+		}
+		return compareFloats(float64(a), b.(float64))
+	case float64:
+		if b, ok := b.(int64); ok {
+			return compareFloats(a, float64(b))
+		}
+		return compareFloats(a, b.(float64))
+	case time.Time:
+		b := b.(time.Time)
+		if a.Before(b) {
+			return -1
+		} else if a.After(b) {
+			return 1
+		}
+		return 0
+	case bool:
+		if a == b.(bool) {
+			return 0
+		} else if !a {
+			return -1
+		}
+		return 1
+	case string:
+		return bytes.Compare([]byte(a), asBytes(b))
+	case []byte:
+		return bytes.Compare(a, asBytes(b))
+	case datastore.GeoPoint:
+		b := b.(datastore.GeoPoint)
+		if c := compareFloats(a.Lat, b.Lat); c != 0 {
+			return c
+		}
+		return compareFloats(a.Lng, b.Lng)
+	case *datastore.Key:
+		return CompareKeys(a, b.(*datastore.Key))
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return -1
+}
+
+func asBytes(v interface{}) []byte {
+	if s, ok := v.(string); ok {
+		return []byte(s)
+	}
+	return v.([]byte)
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// CompareKeys orders keys as datastore does: element by element from the
+// root, by kind and then by ID (all IDs before all names) or name, with
+// ancestors before their descendants.
+func CompareKeys(a, b *datastore.Key) int {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if c := strings.Compare(x.Kind, y.Kind); c != 0 {
+			return c
+		}
+		switch {
+		case x.Name == "" && y.Name != "":
+			return -1
+		case x.Name != "" && y.Name == "":
+			return 1
+		case x.Name == "":
+			if c := compareInts(x.ID, y.ID); c != 0 {
+				return c
+			}
+		default:
+			if c := strings.Compare(x.Name, y.Name); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(int64(len(pa)), int64(len(pb)))
+}
+
+// keyPath returns the elements of k's path, root first.
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
@@ -0,0 +1,135 @@
+package dsquery
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+)
+
+func testEntities() []Entity {
+	entity := func(name string, props map[string]interface{}) Entity {
+		return Entity{Key: datastore.NameKey("Thing", name, nil), Properties: props}
+	}
+	return []Entity{
+		entity("a", map[string]interface{}{"Size": int64(3), "Color": "red"}),
+		entity("b", map[string]interface{}{"Size": 1.5, "Color": "blue"}),
+		entity("c", map[string]interface{}{"Size": int64(2), "Color": "red"}),
+		entity("d", map[string]interface{}{"Color": "green"}),
+		entity("e", map[string]interface{}{
+			"Size":  int64(5),
+			"Color": []interface{}{"blue", "red"},
+		}),
+		{
+			Key:        datastore.NameKey("Other", "f", nil),
+			Properties: map[string]interface{}{"Size": int64(1), "Color": "red"},
+		},
+	}
+}
+
+func names(entities []Entity) []string {
+	var names []string
+	for _, e := range entities {
+		names = append(names, e.Key.Name)
+	}
+	return names
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{"kind", Query{Kind: "Thing", Limit: -1}, []string{"a", "b", "c", "d", "e"}},
+		{"kindless", Query{Limit: -1}, []string{"f", "a", "b", "c", "d", "e"}},
+		{
+			"equality",
+			Query{Kind: "Thing", Filters: []Filter{{"Color", Equal, "red"}}, Limit: -1},
+			[]string{"a", "c", "e"},
+		},
+		{
+			"inequality",
+			Query{Kind: "Thing", Filters: []Filter{{"Size", GreaterEq, 2}}, Limit: -1},
+			[]string{"a", "c", "e"},
+		},
+		{
+			"not equal",
+			Query{Kind: "Thing", Filters: []Filter{{"Color", NotEqual, "red"}}, Limit: -1},
+			[]string{"b", "d", "e"},
+		},
+		{
+			"in",
+			Query{Kind: "Thing", Filters: []Filter{{"Size", In, []int{1, 2, 3}}}, Limit: -1},
+			[]string{"a", "c"},
+		},
+		{
+			"key",
+			Query{
+				Kind:    "Thing",
+				Filters: []Filter{{KeyProperty, GreaterThan, datastore.NameKey("Thing", "c", nil)}},
+				Limit:   -1,
+			},
+			[]string{"d", "e"},
+		},
+		{
+			"ascending",
+			Query{Kind: "Thing", Orders: []Order{{Property: "Size"}}, Limit: -1},
+			[]string{"b", "c", "a", "e"},
+		},
+		{
+			"descending",
+			Query{
+				Kind:   "Thing",
+				Orders: []Order{{Property: "Color", Descending: true}, {Property: "Size"}},
+				Limit:  -1,
+			},
+			[]string{"c", "a", "e", "b"},
+		},
+		{
+			"limit",
+			Query{Kind: "Thing", Orders: []Order{{Property: "Size"}}, Limit: 2},
+			[]string{"b", "c"},
+		},
+		{
+			"offset",
+			Query{Kind: "Thing", Orders: []Order{{Property: "Size"}}, Offset: 1, Limit: 2},
+			[]string{"c", "a"},
+		},
+		{"offset past end", Query{Kind: "Thing", Offset: 10, Limit: -1}, nil},
+		{
+			"ancestor",
+			Query{Kind: "Thing", Ancestor: datastore.NameKey("Thing", "a", nil), Limit: -1},
+			[]string{"a"},
+		},
+		{"namespace", Query{Kind: "Thing", Namespace: "other", Limit: -1}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := names(Run(test.query, testEntities()))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunProjection(t *testing.T) {
+	got := Run(Query{Kind: "Thing", Projection: []string{"Size"}, Limit: 1}, testEntities())
+	want := []Entity{{
+		Key:        datastore.NameKey("Thing", "a", nil),
+		Properties: map[string]interface{}{"Size": int64(3)},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNormalizeBytes(t *testing.T) {
+	want := []byte{1, 2, 3}
+	for _, v := range []interface{}{[]byte{1, 2, 3}, [3]byte{1, 2, 3}} {
+		if got := Normalize(v); !reflect.DeepEqual(got, want) {
+			t.Errorf("Normalize(%#v) = %#v, want %#v", v, got, want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Package multiarg classifies the dst and src slices passed to the
+// datastore client's GetMulti and PutMulti, as the client itself does, so
+// that the fakes accept exactly the same arguments.
+package multiarg
+
+import (
+	"reflect"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+)
+
+// Type is the category of a slice's elements.
+type Type int
+
+// The categories of slice element.
+const (
+	Invalid Type = iota
+	PropertyLoadSaver
+	Struct
+	StructPtr
+	Interface
+)
+
+var (
+	typeOfPropertyLoadSaver = reflect.TypeOf((*datastore.PropertyLoadSaver)(nil)).Elem()
+	typeOfPropertyList      = reflect.TypeOf(datastore.PropertyList(nil))
+)
+
+// Check checks that v has type []S, []*S, []I, or []P, for some struct
+// type S, for some interface type I, or some non-interface non-pointer type P
+// such that P or *P implements PropertyLoadSaver.
+//
+// It returns what category the slice's elements are, and the reflect.Type
+// that represents S, I or P.
+//
+// As a special case, PropertyList is an invalid type for v.
+func Check(v reflect.Value) (m Type, elemType reflect.Type) {
+	if v.Kind() != reflect.Slice {
+		return Invalid, nil
+	}
+	if v.Type() == typeOfPropertyList {
+		return Invalid, nil
+	}
+	elemType = v.Type().Elem()
+	if reflect.PtrTo(elemType).Implements(typeOfPropertyLoadSaver) {
+		return PropertyLoadSaver, elemType
+	}
+	switch elemType.Kind() {
+	case reflect.Struct:
+		return Struct, elemType
+	case reflect.Interface:
+		return Interface, elemType
+	case reflect.Ptr:
+		elemType = elemType.Elem()
+		if elemType.Kind() == reflect.Struct {
+			return StructPtr, elemType
+		}
+	}
+	return Invalid, nil
+}
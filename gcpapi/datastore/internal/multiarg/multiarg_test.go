@@ -0,0 +1,51 @@
+package multiarg
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore" //nolint:depguard // GKE ≠ AppEngine
+)
+
+type entity struct {
+	Value string
+}
+
+// loadSaver is a non-struct type whose pointer implements
+// PropertyLoadSaver.
+type loadSaver map[string]interface{}
+
+func (l *loadSaver) Load([]datastore.Property) error     { return nil }
+func (l *loadSaver) Save() ([]datastore.Property, error) { return nil, nil }
+
+type loader interface {
+	Load([]datastore.Property) error
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		v            interface{}
+		wantType     Type
+		wantElemType reflect.Type
+	}{
+		{"[]S", []entity{}, Struct, reflect.TypeOf(entity{})},
+		{"[]*S", []*entity{}, StructPtr, reflect.TypeOf(entity{})},
+		{"[]I", []loader{}, Interface, reflect.TypeOf((*loader)(nil)).Elem()},
+		{"[]P", []loadSaver{}, PropertyLoadSaver, reflect.TypeOf(loadSaver{})},
+		{"PropertyList", datastore.PropertyList{}, Invalid, nil},
+		{"[]PropertyList", []datastore.PropertyList{}, PropertyLoadSaver,
+			reflect.TypeOf(datastore.PropertyList{})},
+		{"[]int", []int{}, Invalid, nil},
+		{"not a slice", entity{}, Invalid, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotType, gotElemType := Check(reflect.ValueOf(test.v))
+			if gotType != test.wantType || gotElemType != test.wantElemType {
+				t.Errorf("Got (%v, %v), want (%v, %v)",
+					gotType, gotElemType, test.wantType, test.wantElemType)
+			}
+		})
+	}
+}
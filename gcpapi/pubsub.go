@@ -5,6 +5,8 @@ import (
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/json"
+	"net/http"
 
 	"golang.org/x/sync/errgroup"
 
@@ -12,6 +14,10 @@ import (
 	"cloud.google.com/go/pubsub/pstest"
 	"google.golang.org/api/option"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"github.com/Khan/districts-jobs/pkg/errors"
 )
 
 type PubSubTopic string
@@ -115,6 +121,23 @@ func (p *PubSubInfo) publishMessage(
 	topic *pubsub.Topic,
 	message proto.Message,
 ) (*pubsub.PublishResult, error) {
+	msg, err := p.newMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	return topic.Publish(ctx, msg), nil
+}
+
+// Attributes of the messages we publish.
+const (
+	signatureAttribute = "signature"
+	// typeAttribute holds the full name of the message's proto type, so
+	// that VerifyPushRequest knows what to unmarshal it as.
+	typeAttribute = "type"
+)
+
+// newMessage encodes and signs message for publishing.
+func (p *PubSubInfo) newMessage(message proto.Message) (*pubsub.Message, error) {
 	data, err := proto.Marshal(message)
 	if err != nil {
 		return nil, err
@@ -123,17 +146,61 @@ func (p *PubSubInfo) publishMessage(
 	if err != nil {
 		return nil, err
 	}
-
-	result := topic.Publish(
-		ctx,
-		&pubsub.Message{
-			Data: data,
-			Attributes: map[string]string{
-				"signature": signature,
-			},
+	return &pubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			signatureAttribute: signature,
+			typeAttribute:      string(proto.MessageName(message)),
 		},
-	)
-	return result, nil
+	}, nil
+}
+
+// pushRequest is the JSON body of a push delivery.  encoding/json decodes
+// the base64 data for us.
+type pushRequest struct {
+	Message struct {
+		Data       []byte            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// VerifyPushRequest reads a push delivery of a message published by
+// SendPubSubMessage or SendPubSubMessages, checks its signature, and
+// returns the message it carries.  The message's proto type must be
+// linked into the binary.
+func (p *PubSubInfo) VerifyPushRequest(r *http.Request) (proto.Message, error) {
+	var body pushRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, errors.InvalidInput("Unable to decode push request", err)
+	}
+	attrs := body.Message.Attributes
+	signature, ok := attrs[signatureAttribute]
+	if !ok {
+		return nil, errors.InvalidInput("Push request has no signature",
+			errors.Fields{"subscription": body.Subscription})
+	}
+	want, err := p.ComputeSignatureWithSecret(body.Message.Data)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return nil, errors.InvalidInput("Push request has an invalid signature",
+			errors.Fields{"subscription": body.Subscription, "messageID": body.Message.MessageID})
+	}
+
+	messageType, err := protoregistry.GlobalTypes.FindMessageByName(
+		protoreflect.FullName(attrs[typeAttribute]))
+	if err != nil {
+		return nil, errors.InvalidInput("Push request has an unknown message type",
+			errors.Fields{"type": attrs[typeAttribute]})
+	}
+	message := messageType.New().Interface()
+	if err := proto.Unmarshal(body.Message.Data, message); err != nil {
+		return nil, errors.InvalidInput("Unable to unmarshal pushed message", err)
+	}
+	return message, nil
 }
 
 const batchSize = 500
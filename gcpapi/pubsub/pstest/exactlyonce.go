@@ -0,0 +1,67 @@
+package pstest
+
+// This file implements the ack failures of subscriptions with exactly-once
+// delivery enabled.  Each delivery leases the message to its subscriber
+// until its ack deadline; once the lease has expired, because the deadline
+// passed or the message was nacked, acking the message fails until it's
+// delivered again.  Pub/Sub reports such failures as an error whose
+// ErrorInfo details map each failed ack ID to a reason, as we do for the
+// Acknowledge RPC.  On a streaming pull we just drop the acks, as though
+// they were lost.
+//
+// Our ack IDs are message IDs, so they don't change between deliveries,
+// as real ones do: an ack sent after a message was redelivered acks the
+// new delivery.
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ackFailureReason is the reason of the ErrorInfo of an error acking
+	// messages under exactly-once delivery.
+	ackFailureReason = "EXACTLY_ONCE_ACKID_FAILURE"
+	// ackFailureLeaseExpired is the failure of an ack ID whose lease had
+	// expired.  Its TRANSIENT_FAILURE_ prefix tells clients they may retry.
+	ackFailureLeaseExpired = "TRANSIENT_FAILURE_LEASE_EXPIRED"
+)
+
+// leaseExpired reports whether the message with the given ack ID can't be
+// acked, because the subscription has exactly-once delivery enabled and
+// the message's lease has expired.
+//
+// Must be called with the lock held.
+func (s *subscription) leaseExpired(id string, now time.Time) bool {
+	if !s.proto.EnableExactlyOnceDelivery {
+		return false
+	}
+	m := s.msgs[id]
+	return m != nil && (!m.outstanding() || now.After(m.ackDeadline))
+}
+
+// ackFailureError returns the retriable error for a request whose acks
+// failed, given the failure of each failed ack ID.
+func ackFailureError(failures map[string]string) error {
+	ids := make([]string, 0, len(failures))
+	for id := range failures {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	st := status.New(codes.Unavailable,
+		fmt.Sprintf("acks of %v failed under exactly-once delivery", ids))
+	st, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   ackFailureReason,
+		Domain:   "pubsub.googleapis.com",
+		Metadata: failures,
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "adding error details: %v", err)
+	}
+	return st.Err()
+}
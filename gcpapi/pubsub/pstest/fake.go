@@ -1,19 +1,24 @@
 package pstest
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"net/http"
 	"path"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"testing"
 	"time"
 
 	pb "google.golang.org/genproto/googleapis/pubsub/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	durpb "google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -33,10 +38,24 @@ type Reactor interface {
 	React(_ interface{}) (handled bool, ret interface{}, err error)
 }
 
+// ContextReactor is a Reactor that also wants the context of the RPC it's
+// reacting to, e.g. to look at its deadline.  When a reactor implements
+// ContextReactor, the server calls ReactContext instead of React, without
+// holding its lock, so ReactContext may block without holding up other
+// RPCs.
+type ContextReactor interface {
+	Reactor
+	ReactContext(ctx context.Context, req interface{}) (handled bool, ret interface{}, err error)
+}
+
 // ServerReactorOption is options passed to the server for reactor creation.
 type ServerReactorOption struct {
 	Reactor  Reactor
 	FuncName string
+
+	// apply, if set, makes the option a server setting, which has no
+	// reactor: NewServer calls it on the new server instead.
+	apply func(*GServer)
 }
 
 // For testing. Note that even though changes to the now variable are atomic, a call
@@ -68,14 +87,39 @@ type GServer struct {
 	pb.SubscriberServer
 	topics         map[string]*topic
 	subs           map[string]*subscription
+	snapshots      map[string]*snapshot
 	reactorOptions ReactorOptions
 	msgsByID       map[string]*Message
 	timeNowFunc    func() time.Time
 	msgs           []*Message
 	nextID         int
 	streamTimeout  time.Duration
+	pullWait       time.Duration // set by SetPullWait
 	wg             sync.WaitGroup
 	mu             sync.Mutex
+	closed         bool // set by Server.Close
+	started        bool // whether subscriptions deliver in the background
+	// maxOutstandingMessages is set by SetMaxOutstandingMessages.  Zero
+	// means no limit.
+	maxOutstandingMessages int64
+	// maxMessageBytes and maxPublishMessages are set by SetPublishLimits.
+	// Zero means Pub/Sub's limit.
+	maxMessageBytes    int
+	maxPublishMessages int
+	// defaultAckDeadline is the ack deadline of subscriptions created without
+	// one.  Zero means Pub/Sub's default of 10 seconds.
+	defaultAckDeadline time.Duration
+	// maxRetainedMessages bounds the length of msgs.  Zero means no limit.
+	maxRetainedMessages int
+	// deliveryDelay is how long after publication messages become
+	// deliverable.
+	deliveryDelay time.Duration
+	// keyAffinity is whether subscriptions send all the messages with an
+	// ordering key to the same stream.
+	keyAffinity bool
+	// pushClient is the client subscriptions push messages with, if
+	// WithPushDelivery was given.
+	pushClient *http.Client
 }
 
 // NewServer creates a new fake server running in the current process.
@@ -84,27 +128,49 @@ func NewServer(opts ...ServerReactorOption) *Server {
 	if err != nil {
 		panic(fmt.Sprintf("pstest.NewServer: %v", err))
 	}
-	reactorOptions := ReactorOptions{}
-	for _, opt := range opts {
-		reactorOptions[opt.FuncName] = append(reactorOptions[opt.FuncName], opt.Reactor)
-	}
 	s := &Server{
 		srv:  srv,
 		Addr: srv.Addr,
 		GServer: GServer{
 			topics:         map[string]*topic{},
 			subs:           map[string]*subscription{},
+			snapshots:      map[string]*snapshot{},
 			msgsByID:       map[string]*Message{},
 			timeNowFunc:    timeNow,
-			reactorOptions: reactorOptions,
+			pullWait:       defaultPullWait,
+			reactorOptions: ReactorOptions{},
+			started:        true,
 		},
 	}
+	for _, opt := range opts {
+		if opt.apply != nil {
+			opt.apply(&s.GServer)
+			continue
+		}
+		ro := s.GServer.reactorOptions
+		ro[opt.FuncName] = append(ro[opt.FuncName], opt.Reactor)
+	}
 	pb.RegisterPublisherServer(srv.Gsrv, &s.GServer)
 	pb.RegisterSubscriberServer(srv.Gsrv, &s.GServer)
 	srv.Start()
 	return s
 }
 
+// Start begins background delivery for the subscriptions of a server
+// created with WithManualStart.  It does nothing if delivery has already
+// started.
+func (s *Server) Start() {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+	if s.GServer.started {
+		return
+	}
+	s.GServer.started = true
+	for _, sub := range s.GServer.subs {
+		sub.start(&s.GServer.wg)
+	}
+}
+
 // SetTimeNowFunc registers f as a function to
 // be used instead of time.Now for this server.
 func (s *Server) SetTimeNowFunc(f func() time.Time) {
@@ -131,6 +197,21 @@ func (s *Server) PublishOrdered(
 	attrs map[string]string,
 	orderingKey string,
 ) string {
+	s.ensureTopic(topic)
+	req := &pb.PublishRequest{
+		Topic:    topic,
+		Messages: []*pb.PubsubMessage{{Data: data, Attributes: attrs, OrderingKey: orderingKey}},
+	}
+	res, err := s.GServer.Publish(context.TODO(), req)
+	if err != nil {
+		panic(fmt.Sprintf("pstest.Server.Publish: %v", err))
+	}
+	return res.MessageIds[0]
+}
+
+// ensureTopic creates topic if it doesn't exist, for the Publish methods.
+// It panics if topic isn't a valid topic name.
+func (s *Server) ensureTopic(topic string) {
 	const topicPattern = "projects/*/topics/*"
 	ok, err := path.Match(topicPattern, topic)
 	if err != nil {
@@ -140,17 +221,75 @@ func (s *Server) PublishOrdered(
 		panic(fmt.Sprintf("topic name must be of the form %q", topicPattern))
 	}
 	_, _ = s.GServer.CreateTopic(context.TODO(), &pb.Topic{Name: topic})
+}
+
+// PublishAt is Publish, but stamps the message with publishTime instead of
+// the current time, e.g. to test Seek or retention.
+//
+// PublishAt panics if there is an error, which is appropriate for testing.
+func (s *Server) PublishAt(
+	topic string,
+	data []byte,
+	attrs map[string]string,
+	publishTime time.Time,
+) string {
+	s.ensureTopic(topic)
 	req := &pb.PublishRequest{
 		Topic:    topic,
-		Messages: []*pb.PubsubMessage{{Data: data, Attributes: attrs, OrderingKey: orderingKey}},
+		Messages: []*pb.PubsubMessage{{Data: data, Attributes: attrs}},
 	}
-	res, err := s.GServer.Publish(context.TODO(), req)
+	s.GServer.mu.Lock()
+	res, err := s.GServer.publish(req, publishTime)
+	s.GServer.mu.Unlock()
 	if err != nil {
-		panic(fmt.Sprintf("pstest.Server.Publish: %v", err))
+		panic(fmt.Sprintf("pstest.Server.PublishAt: %v", err))
 	}
 	return res.MessageIds[0]
 }
 
+// PublishBatch publishes msgs to topic under a single acquisition of the
+// server's lock, returning their IDs, without the overhead of the Publish
+// RPC.  It's meant for setting up benchmarks and load tests, so it isn't
+// bound by the Publish RPC's limits on the number and size of messages.
+// It sets the ID and publish time of each message.
+// The topic will be created if it doesn't exist.
+//
+// PublishBatch panics if there is an error, which is appropriate for testing.
+func (s *Server) PublishBatch(topic string, msgs []*pb.PubsubMessage) []string {
+	s.ensureTopic(topic)
+	req := &pb.PublishRequest{Topic: topic, Messages: msgs}
+	s.GServer.mu.Lock()
+	res, err := s.GServer.publish(req, time.Time{})
+	s.GServer.mu.Unlock()
+	if err != nil {
+		panic(fmt.Sprintf("pstest.Server.PublishBatch: %v", err))
+	}
+	return res.MessageIds
+}
+
+// SetPublishLimits sets the most bytes of data and attributes a message
+// can have, and the most messages a request can have, that the Publish RPC
+// accepts.  It rejects bigger messages and requests with InvalidArgument.
+// Zero means Pub/Sub's limit: 10MB, and 1000 messages.
+func (s *Server) SetPublishLimits(maxMessageBytes, maxMessages int) {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+	s.GServer.maxMessageBytes = maxMessageBytes
+	s.GServer.maxPublishMessages = maxMessages
+}
+
+// defaultPullWait is how long Pull waits for a message by default.
+const defaultPullWait = 500 * time.Millisecond
+
+// SetPullWait sets how long a Pull that finds no messages waits for one to
+// arrive, unless it asks to return immediately.  It's 500ms by default;
+// zero makes every Pull return immediately.
+func (s *Server) SetPullWait(d time.Duration) {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+	s.GServer.pullWait = d
+}
+
 // SetStreamTimeout sets the amount of time a stream will be active before it shuts
 // itself down. This mimics the real service's behavior of closing streams after 30
 // minutes. If SetStreamTimeout is never called or is passed zero, streams never shut
@@ -161,11 +300,25 @@ func (s *Server) SetStreamTimeout(d time.Duration) {
 	s.GServer.streamTimeout = d
 }
 
+// SetMaxOutstandingMessages limits how many messages a streaming pull can
+// hold outstanding at once, like the flow control a client can ask for in
+// its StreamingPullRequest.  Messages aren't delivered on a stream that's
+// at the limit until acks, nacks or expired ack deadlines make room, so
+// they go to the subscription's other streams if they can.  The lower of
+// this limit and the client's applies.  It affects streams opened after it
+// is called; zero, the default, means no limit.
+func (s *Server) SetMaxOutstandingMessages(n int) {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+	s.GServer.maxOutstandingMessages = int64(n)
+}
+
 // A Message is a message that was published to the server.
 type Message struct {
 	PublishTime time.Time
 	Attributes  map[string]string
 	ID          string
+	Topic       string // the name of the topic it was published to
 	OrderingKey string
 	modacks     []Modack
 	Modacks     []Modack
@@ -174,6 +327,33 @@ type Message struct {
 	deliveries  int
 	acks        int
 	Deliveries  int
+	// AckedAt is when the message was last acked, or zero if it never
+	// was.
+	AckedAt time.Time
+	ackedAt time.Time
+
+	ackDeadline       time.Time // set by the latest delivery or modack
+	effectiveDeadline time.Time
+	seq               int // position in publish order
+	failures          int // set by FailDelivery
+}
+
+// EffectiveDeadline returns the ack deadline set by the message's latest
+// delivery or modack, as of the Message or Messages call that returned m.
+// It is zero if the message was never delivered.  A nack sets it to the
+// time of the nack.
+func (m *Message) EffectiveDeadline() time.Time {
+	return m.effectiveDeadline
+}
+
+// AckLatency returns how long after the message was published it was
+// last acked, as of the Message or Messages call that returned m, or zero
+// if it was never acked.
+func (m *Message) AckLatency() time.Duration {
+	if m.AckedAt.IsZero() {
+		return 0
+	}
+	return m.AckedAt.Sub(m.PublishTime)
 }
 
 // Modack represents a modack sent to the server.
@@ -193,11 +373,81 @@ func (s *Server) Messages() []*Message {
 		m.Deliveries = m.deliveries
 		m.Acks = m.acks
 		m.Modacks = append([]Modack(nil), m.modacks...)
+		m.effectiveDeadline = m.ackDeadline
+		m.AckedAt = m.ackedAt
 		msgs = append(msgs, m)
 	}
 	return msgs
 }
 
+// MessagesSorted is Messages, but sorted by publish time and then ID,
+// with each message's Modacks sorted by the time they were received, so
+// that tests can compare them with golden values.
+func (s *Server) MessagesSorted() []*Message {
+	msgs := s.Messages()
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if !msgs[i].PublishTime.Equal(msgs[j].PublishTime) {
+			return msgs[i].PublishTime.Before(msgs[j].PublishTime)
+		}
+		return msgs[i].ID < msgs[j].ID
+	})
+	for _, m := range msgs {
+		sort.SliceStable(m.Modacks, func(i, j int) bool {
+			return m.Modacks[i].ReceivedAt.Before(m.Modacks[j].ReceivedAt)
+		})
+	}
+	return msgs
+}
+
+// FindMessagesByData returns all the messages ever published with the
+// given data, keyed by the topic they were published to.  This lets tests
+// check that one event was published to several topics.
+func (s *Server) FindMessagesByData(data []byte) map[string][]*Message {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	found := map[string][]*Message{}
+	for _, m := range s.GServer.msgs {
+		if !bytes.Equal(m.Data, data) {
+			continue
+		}
+		m.Deliveries = m.deliveries
+		m.Acks = m.acks
+		m.Modacks = append([]Modack(nil), m.modacks...)
+		m.effectiveDeadline = m.ackDeadline
+		m.AckedAt = m.ackedAt
+		found[m.Topic] = append(found[m.Topic], m)
+	}
+	return found
+}
+
+// MessagesByOrderingKey returns copies of the messages published to the
+// server, grouped by ordering key, in the order they were published.
+// Messages published without an ordering key are under "".  Unlike
+// Messages, changing the results doesn't change the server's messages.
+func (s *Server) MessagesByOrderingKey() map[string][]*Message {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	byKey := map[string][]*Message{}
+	for _, m := range s.GServer.msgs {
+		c := *m
+		c.Attributes = make(map[string]string, len(m.Attributes))
+		for k, v := range m.Attributes {
+			c.Attributes[k] = v
+		}
+		c.Data = append([]byte(nil), m.Data...)
+		c.modacks = append([]Modack(nil), m.modacks...)
+		c.Deliveries = m.deliveries
+		c.Acks = m.acks
+		c.Modacks = append([]Modack(nil), m.modacks...)
+		c.effectiveDeadline = m.ackDeadline
+		c.AckedAt = m.ackedAt
+		byKey[m.OrderingKey] = append(byKey[m.OrderingKey], &c)
+	}
+	return byKey
+}
+
 // Message returns the message with the given ID, or nil if no message
 // with that ID was published.
 func (s *Server) Message(id string) *Message {
@@ -209,10 +459,288 @@ func (s *Server) Message(id string) *Message {
 		m.Deliveries = m.deliveries
 		m.Acks = m.acks
 		m.Modacks = append([]Modack(nil), m.modacks...)
+		m.effectiveDeadline = m.ackDeadline
+		m.AckedAt = m.ackedAt
 	}
 	return m
 }
 
+// TopicConfig returns a copy of the named topic's configuration, or nil if
+// there is no such topic.
+func (s *Server) TopicConfig(name string) *pb.Topic {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	t := s.GServer.topics[name]
+	if t == nil {
+		return nil
+	}
+	return proto.Clone(t.proto).(*pb.Topic)
+}
+
+// SubscriptionConfig returns a copy of the named subscription's
+// configuration, e.g. its ack deadline or filter, or nil if there is no
+// such subscription.
+func (s *Server) SubscriptionConfig(name string) *pb.Subscription {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	sub := s.GServer.subs[name]
+	if sub == nil {
+		return nil
+	}
+	return proto.Clone(sub.proto).(*pb.Subscription)
+}
+
+// SubscriptionsForTopic returns copies of the configurations of the
+// named topic's subscriptions, sorted by name, or nil if there is no such
+// topic.
+func (s *Server) SubscriptionsForTopic(topic string) []*pb.Subscription {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	t := s.GServer.topics[topic]
+	if t == nil {
+		return nil
+	}
+	var subs []*pb.Subscription
+	for _, name := range sortedSubNames(t.subs) {
+		subs = append(subs, proto.Clone(t.subs[name].proto).(*pb.Subscription))
+	}
+	return subs
+}
+
+// RequireDrained fails the test if any subscription still has messages
+// that haven't been acked, whether they're outstanding on a stream or
+// waiting to be delivered.  It's meant for the end of a test.
+func (s *Server) RequireDrained(t testing.TB) {
+	t.Helper()
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	var problems []string
+	for _, name := range sortedSubNames(s.GServer.subs) {
+		sub := s.GServer.subs[name]
+		if len(sub.msgs) == 0 {
+			continue
+		}
+		ids := make([]string, 0, len(sub.msgs))
+		for id, m := range sub.msgs {
+			if m.outstanding() {
+				id += " (outstanding)"
+			}
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		problems = append(problems, fmt.Sprintf("%s: %s", name, strings.Join(ids, ", ")))
+	}
+	if len(problems) > 0 {
+		t.Errorf("pstest: subscriptions have unacked messages:\n%s",
+			strings.Join(problems, "\n"))
+	}
+}
+
+// DumpState returns a human-readable snapshot of the server's topics,
+// subscriptions and their messages, and the log of published messages,
+// for debugging failing tests.
+func (s *Server) DumpState() string {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	var b strings.Builder
+	topicNames := make([]string, 0, len(s.GServer.topics))
+	for name := range s.GServer.topics {
+		topicNames = append(topicNames, name)
+	}
+	sort.Strings(topicNames)
+	b.WriteString("topics:\n")
+	for _, name := range topicNames {
+		fmt.Fprintf(&b, "  %s\n", name)
+	}
+
+	b.WriteString("subscriptions:\n")
+	for _, name := range sortedSubNames(s.GServer.subs) {
+		sub := s.GServer.subs[name]
+		fmt.Fprintf(&b, "  %s (topic %s, ack deadline %v, %d streams)\n",
+			name, sub.proto.Topic, sub.ackTimeout, len(sub.streams))
+		for _, m := range sub.inOrder() {
+			if m.outstanding() {
+				fmt.Fprintf(&b, "    %s outstanding until %v\n",
+					m.proto.GetAckId(), m.ackDeadline.Format(time.RFC3339Nano))
+			} else {
+				fmt.Fprintf(&b, "    %s available\n", m.proto.GetAckId())
+			}
+		}
+	}
+
+	b.WriteString("messages:\n")
+	for _, m := range s.GServer.msgs {
+		fmt.Fprintf(&b, "  %s on %s at %v: %d deliveries, %d acks",
+			m.ID, m.Topic, m.PublishTime.Format(time.RFC3339Nano), m.deliveries, m.acks)
+		if m.OrderingKey != "" {
+			fmt.Fprintf(&b, ", ordering key %q", m.OrderingKey)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func sortedSubNames(subs map[string]*subscription) []string {
+	names := make([]string, 0, len(subs))
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StreamDeliveryCounts returns the number of messages delivered on each
+// of the subscription's streams, in the order the streams were opened.
+// This lets tests check that delivery is shared fairly between streams.
+func (s *Server) StreamDeliveryCounts(subscription string) []int {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	sub := s.GServer.subs[subscription]
+	if sub == nil {
+		return nil
+	}
+	counts := make([]int, len(sub.streams))
+	for i, st := range sub.streams {
+		counts[i] = st.deliveries
+	}
+	return counts
+}
+
+// AckStats returns the number of times the subscription's messages have
+// been acked and nacked (modacked to a deadline of 0), and the number
+// currently outstanding, so that tests can check how often processing
+// succeeded.  Acks and nacks of messages that had already been acked
+// aren't counted.
+func (s *Server) AckStats(subscription string) (acked, nacked, outstanding int) {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	sub := s.GServer.subs[subscription]
+	if sub == nil {
+		return 0, 0, 0
+	}
+	for _, m := range sub.msgs {
+		if m.outstanding() {
+			outstanding++
+		}
+	}
+	return sub.acked, sub.nacked, outstanding
+}
+
+// NumUndeliveredMessages returns the number of messages published to the
+// subscription that haven't been acked, whether or not they're
+// outstanding, like the subscription/num_undelivered_messages metric that
+// Cloud Monitoring reports for real subscriptions.  The Subscription proto
+// has no field for this, so GetSubscription can't return it.  It returns
+// 0 if there is no such subscription.
+func (s *Server) NumUndeliveredMessages(subscription string) int {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	sub := s.GServer.subs[subscription]
+	if sub == nil {
+		return 0
+	}
+	return len(sub.msgs)
+}
+
+// DeliveryOrder returns the ack IDs of the messages delivered on the
+// subscription, by Pull or on a stream, in the order they were delivered.
+// A message that was redelivered appears once per delivery.
+func (s *Server) DeliveryOrder(subscription string) []string {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	sub := s.GServer.subs[subscription]
+	if sub == nil {
+		return nil
+	}
+	return append([]string(nil), sub.deliveryOrder...)
+}
+
+// WaitForAck blocks until the message with the given ID is acked on the
+// subscription, returning ctx.Err() if ctx is done first.  It returns
+// immediately if the subscription has no such message, e.g. because it
+// was already acked, and a NotFound error if the server has no record of
+// the message.  If the message is dropped without an ack, by
+// ClearSubscription, by expiring or by deleting the subscription, it
+// returns an Aborted error.  Seeking past the message counts as acking it.
+func (s *Server) WaitForAck(ctx context.Context, subscription, messageID string) error {
+	s.GServer.mu.Lock()
+	sub, err := s.GServer.findSubscription(subscription)
+	if err != nil {
+		s.GServer.mu.Unlock()
+		return err
+	}
+	if sub.msgs[messageID] == nil {
+		defer s.GServer.mu.Unlock()
+		if s.GServer.msgsByID[messageID] == nil {
+			return status.Errorf(codes.NotFound, "message %q", messageID)
+		}
+		return nil
+	}
+	acked := make(chan error, 1)
+	if sub.ackWaiters == nil {
+		sub.ackWaiters = map[string][]chan error{}
+	}
+	sub.ackWaiters[messageID] = append(sub.ackWaiters[messageID], acked)
+	s.GServer.mu.Unlock()
+
+	select {
+	case err := <-acked:
+		return err
+	case <-ctx.Done():
+		s.GServer.mu.Lock()
+		defer s.GServer.mu.Unlock()
+		sub.removeAckWaiter(messageID, acked)
+		return ctx.Err()
+	}
+}
+
+// FailDelivery makes the next times deliveries of the message with the
+// given ID, on any subscription, get lost: the message isn't sent, but is
+// outstanding until its ack deadline expires, as though a consumer never
+// received it.
+//
+// FailDelivery panics if there is no such message, which is appropriate for
+// testing.
+func (s *Server) FailDelivery(messageID string, times int) {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	m := s.GServer.msgsByID[messageID]
+	if m == nil {
+		panic(fmt.Sprintf("pstest.Server.FailDelivery: no message %s", messageID))
+	}
+	m.failures = times
+}
+
+// Redeliver makes the message with the given ID available for delivery
+// again on the subscription, as if its ack deadline had expired, without
+// the client nacking it.  It fails if the subscription doesn't exist or
+// has no such message, e.g. because it was acked.
+func (s *Server) Redeliver(subscription, messageID string) error {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	sub, err := s.GServer.findSubscription(subscription)
+	if err != nil {
+		return err
+	}
+	m := sub.msgs[messageID]
+	if m == nil {
+		return status.Errorf(codes.NotFound, "message %s on subscription %s", messageID, subscription)
+	}
+	m.makeAvailable()
+	return nil
+}
+
 // Wait blocks until all server activity has completed.
 func (s *Server) Wait() {
 	s.GServer.wg.Wait()
@@ -227,8 +755,37 @@ func (s *Server) ClearMessages() {
 	s.GServer.mu.Unlock()
 }
 
-// Close shuts down the server and releases all resources.
+// ClearSubscription removes all of a subscription's messages, whether
+// delivered or not, leaving other subscriptions and the server's published
+// messages alone.
+func (s *Server) ClearSubscription(name string) {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+
+	sub := s.GServer.subs[name]
+	if sub == nil {
+		return
+	}
+	for _, m := range sub.msgs {
+		m.release()
+	}
+	sub.msgs = map[string]*message{}
+	for id := range sub.ackWaiters {
+		sub.wakeAckWaiters(id, errDropped(id))
+	}
+}
+
+// Close shuts down the server and releases all resources.  Calling it more
+// than once is harmless.
 func (s *Server) Close() error {
+	s.GServer.mu.Lock()
+	if s.GServer.closed {
+		s.GServer.mu.Unlock()
+		return nil
+	}
+	s.GServer.closed = true
+	s.GServer.mu.Unlock()
+
 	s.srv.Close()
 	s.GServer.mu.Lock()
 	defer s.GServer.mu.Unlock()
@@ -238,11 +795,11 @@ func (s *Server) Close() error {
 	return nil
 }
 
-func (s *GServer) CreateTopic(_ context.Context, t *pb.Topic) (*pb.Topic, error) {
+func (s *GServer) CreateTopic(ctx context.Context, t *pb.Topic) (*pb.Topic, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(t, "CreateTopic", &pb.Topic{}); handled || err != nil {
+	if handled, ret, err := s.runReactor(ctx, t, "CreateTopic", &pb.Topic{}); handled || err != nil {
 		return ret.(*pb.Topic), err
 	}
 
@@ -254,11 +811,11 @@ func (s *GServer) CreateTopic(_ context.Context, t *pb.Topic) (*pb.Topic, error)
 	return top.proto, nil
 }
 
-func (s *GServer) GetTopic(_ context.Context, req *pb.GetTopicRequest) (*pb.Topic, error) {
+func (s *GServer) GetTopic(ctx context.Context, req *pb.GetTopicRequest) (*pb.Topic, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "GetTopic", &pb.Topic{}); handled || err != nil {
+	if handled, ret, err := s.runReactor(ctx, req, "GetTopic", &pb.Topic{}); handled || err != nil {
 		return ret.(*pb.Topic), err
 	}
 
@@ -268,11 +825,11 @@ func (s *GServer) GetTopic(_ context.Context, req *pb.GetTopicRequest) (*pb.Topi
 	return nil, status.Errorf(codes.NotFound, "topic %q", req.Topic)
 }
 
-func (s *GServer) UpdateTopic(_ context.Context, req *pb.UpdateTopicRequest) (*pb.Topic, error) {
+func (s *GServer) UpdateTopic(ctx context.Context, req *pb.UpdateTopicRequest) (*pb.Topic, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "UpdateTopic", &pb.Topic{}); handled || err != nil {
+	if handled, ret, err := s.runReactor(ctx, req, "UpdateTopic", &pb.Topic{}); handled || err != nil {
 		return ret.(*pb.Topic), err
 	}
 
@@ -294,13 +851,13 @@ func (s *GServer) UpdateTopic(_ context.Context, req *pb.UpdateTopicRequest) (*p
 }
 
 func (s *GServer) ListTopics(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.ListTopicsRequest,
 ) (*pb.ListTopicsResponse, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "ListTopics", &pb.ListTopicsResponse{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "ListTopics", &pb.ListTopicsResponse{}); handled ||
 		err != nil {
 		return ret.(*pb.ListTopicsResponse), err
 	}
@@ -324,13 +881,13 @@ func (s *GServer) ListTopics(
 }
 
 func (s *GServer) ListTopicSubscriptions(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.ListTopicSubscriptionsRequest,
 ) (*pb.ListTopicSubscriptionsResponse, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "ListTopicSubscriptions", &pb.ListTopicSubscriptionsResponse{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "ListTopicSubscriptions", &pb.ListTopicSubscriptionsResponse{}); handled ||
 		err != nil {
 		return ret.(*pb.ListTopicSubscriptionsResponse), err
 	}
@@ -353,13 +910,13 @@ func (s *GServer) ListTopicSubscriptions(
 }
 
 func (s *GServer) DeleteTopic(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.DeleteTopicRequest,
 ) (*emptypb.Empty, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "DeleteTopic", &emptypb.Empty{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "DeleteTopic", &emptypb.Empty{}); handled ||
 		err != nil {
 		return ret.(*emptypb.Empty), err
 	}
@@ -370,17 +927,23 @@ func (s *GServer) DeleteTopic(
 	}
 	t.stop()
 	delete(s.topics, req.Topic)
+	// Like subscriptions, the topic's snapshots outlive it.
+	for _, snap := range s.snapshots {
+		if snap.proto.Topic == req.Topic {
+			snap.proto.Topic = "_deleted-topic_"
+		}
+	}
 	return &emptypb.Empty{}, nil
 }
 
 func (s *GServer) CreateSubscription(
-	_ context.Context,
+	ctx context.Context,
 	ps *pb.Subscription,
 ) (*pb.Subscription, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(ps, "CreateSubscription", &pb.Subscription{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, ps, "CreateSubscription", &pb.Subscription{}); handled ||
 		err != nil {
 		return ret.(*pb.Subscription), err
 	}
@@ -398,8 +961,11 @@ func (s *GServer) CreateSubscription(
 	if top == nil {
 		return nil, status.Errorf(codes.NotFound, "topic %q", ps.Topic)
 	}
-	if err := checkAckDeadline(ps.AckDeadlineSeconds); err != nil {
-		return nil, err
+	// Zero means the default ack deadline.
+	if ps.AckDeadlineSeconds != 0 {
+		if err := checkAckDeadline(ps.AckDeadlineSeconds); err != nil {
+			return nil, err
+		}
 	}
 	if ps.MessageRetentionDuration == nil {
 		ps.MessageRetentionDuration = defaultMessageRetentionDuration
@@ -410,11 +976,27 @@ func (s *GServer) CreateSubscription(
 	if ps.PushConfig == nil {
 		ps.PushConfig = &pb.PushConfig{}
 	}
+	f, err := parseFilter(ps.Filter)
+	if err != nil {
+		return nil, err
+	}
 
 	sub := newSubscription(top, &s.mu, s.timeNowFunc, ps)
+	sub.filter = f
+	sub.deliveryDelay = s.deliveryDelay
+	sub.keyAffinity = s.keyAffinity
+	sub.pushClient = s.pushClient
+	if ps.AckDeadlineSeconds == 0 {
+		if s.defaultAckDeadline > 0 {
+			sub.ackTimeout = s.defaultAckDeadline
+		}
+		ps.AckDeadlineSeconds = int32(sub.ackTimeout / time.Second)
+	}
 	top.subs[ps.Name] = sub
 	s.subs[ps.Name] = sub
-	sub.start(&s.wg)
+	if s.started {
+		sub.start(&s.wg)
+	}
 	return ps, nil
 }
 
@@ -439,8 +1021,11 @@ func ResetMinAckDeadline() {
 	minAckDeadlineSecs = 10
 }
 
+// maxAckDeadlineSecs is the longest ack deadline Pub/Sub allows.
+const maxAckDeadlineSecs = 600
+
 func checkAckDeadline(ads int32) error {
-	if ads < minAckDeadlineSecs || ads > 600 {
+	if ads < minAckDeadlineSecs || ads > maxAckDeadlineSecs {
 		// PubSub service returns Unknown.
 		return status.Errorf(codes.Unknown, "bad ack_deadline_seconds: %d", ads)
 	}
@@ -463,13 +1048,13 @@ func checkMRD(pmrd *durpb.Duration) error {
 }
 
 func (s *GServer) GetSubscription(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.GetSubscriptionRequest,
 ) (*pb.Subscription, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "GetSubscription", &pb.Subscription{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "GetSubscription", &pb.Subscription{}); handled ||
 		err != nil {
 		return ret.(*pb.Subscription), err
 	}
@@ -482,7 +1067,7 @@ func (s *GServer) GetSubscription(
 }
 
 func (s *GServer) UpdateSubscription(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.UpdateSubscriptionRequest,
 ) (*pb.Subscription, error) {
 	if req.Subscription == nil {
@@ -491,7 +1076,7 @@ func (s *GServer) UpdateSubscription(
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "UpdateSubscription", &pb.Subscription{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "UpdateSubscription", &pb.Subscription{}); handled ||
 		err != nil {
 		return ret.(*pb.Subscription), err
 	}
@@ -534,6 +1119,11 @@ func (s *GServer) UpdateSubscription(
 			sub.proto.RetryPolicy = req.Subscription.RetryPolicy
 
 		case "filter":
+			f, err := parseFilter(req.Subscription.Filter)
+			if err != nil {
+				return nil, err
+			}
+			sub.filter = f
 			sub.proto.Filter = req.Subscription.Filter
 
 		default:
@@ -544,13 +1134,13 @@ func (s *GServer) UpdateSubscription(
 }
 
 func (s *GServer) ListSubscriptions(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.ListSubscriptionsRequest,
 ) (*pb.ListSubscriptionsResponse, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "ListSubscriptions", &pb.ListSubscriptionsResponse{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "ListSubscriptions", &pb.ListSubscriptionsResponse{}); handled ||
 		err != nil {
 		return ret.(*pb.ListSubscriptionsResponse), err
 	}
@@ -574,13 +1164,13 @@ func (s *GServer) ListSubscriptions(
 }
 
 func (s *GServer) DeleteSubscription(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.DeleteSubscriptionRequest,
 ) (*emptypb.Empty, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "DeleteSubscription", &emptypb.Empty{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "DeleteSubscription", &emptypb.Empty{}); handled ||
 		err != nil {
 		return ret.(*emptypb.Empty), err
 	}
@@ -596,13 +1186,13 @@ func (s *GServer) DeleteSubscription(
 }
 
 func (s *GServer) DetachSubscription(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.DetachSubscriptionRequest,
 ) (*pb.DetachSubscriptionResponse, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "DetachSubscription", &pb.DetachSubscriptionResponse{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "DetachSubscription", &pb.DetachSubscriptionResponse{}); handled ||
 		err != nil {
 		return ret.(*pb.DetachSubscriptionResponse), err
 	}
@@ -615,15 +1205,72 @@ func (s *GServer) DetachSubscription(
 	return &pb.DetachSubscriptionResponse{}, nil
 }
 
-func (s *GServer) Publish(_ context.Context, req *pb.PublishRequest) (*pb.PublishResponse, error) {
+func (s *GServer) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishResponse, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "Publish", &pb.PublishResponse{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "Publish", &pb.PublishResponse{}); handled ||
 		err != nil {
 		return ret.(*pb.PublishResponse), err
 	}
+	if err := s.checkPublishLimits(req); err != nil {
+		return nil, err
+	}
+	return s.publish(req, time.Time{})
+}
+
+// maxOrderingKeyBytes is the longest ordering key Pub/Sub accepts.
+const maxOrderingKeyBytes = 1024
+
+// The limits Pub/Sub puts on a publish request, unless SetPublishLimits
+// changes them.
+const (
+	// defaultMaxMessageBytes bounds the size of a message's data and
+	// attributes, together.
+	defaultMaxMessageBytes = 10 * 1000 * 1000
+	// defaultMaxPublishMessages bounds the number of messages in a request.
+	defaultMaxPublishMessages = 1000
+)
+
+// checkPublishLimits returns an InvalidArgument error if req has too many
+// messages, or a message that's too big.
+//
+// Must be called with the lock held.
+func (s *GServer) checkPublishLimits(req *pb.PublishRequest) error {
+	maxBytes, maxMessages := s.maxMessageBytes, s.maxPublishMessages
+	if maxBytes == 0 {
+		maxBytes = defaultMaxMessageBytes
+	}
+	if maxMessages == 0 {
+		maxMessages = defaultMaxPublishMessages
+	}
+	if len(req.Messages) > maxMessages {
+		return status.Errorf(codes.InvalidArgument,
+			"request has %d messages, more than the maximum of %d",
+			len(req.Messages), maxMessages)
+	}
+	for i, pm := range req.Messages {
+		size := len(pm.Data)
+		for k, v := range pm.Attributes {
+			size += len(k) + len(v)
+		}
+		if size > maxBytes {
+			return status.Errorf(codes.InvalidArgument,
+				"message %d is %d bytes, more than the maximum of %d",
+				i, size, maxBytes)
+		}
+	}
+	return nil
+}
 
+// publish publishes the messages in req, stamped with publishTime, or with
+// the current time if publishTime is zero.
+//
+// Must be called with the lock held.
+func (s *GServer) publish(
+	req *pb.PublishRequest,
+	publishTime time.Time,
+) (*pb.PublishResponse, error) {
 	if req.Topic == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "missing topic")
 	}
@@ -631,19 +1278,31 @@ func (s *GServer) Publish(_ context.Context, req *pb.PublishRequest) (*pb.Publis
 	if top == nil {
 		return nil, status.Errorf(codes.NotFound, "topic %q", req.Topic)
 	}
+	for _, pm := range req.Messages {
+		if len(pm.OrderingKey) > maxOrderingKeyBytes {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"ordering key is %d bytes, more than the maximum of %d",
+				len(pm.OrderingKey), maxOrderingKeyBytes)
+		}
+	}
 	var ids []string
 	for _, pm := range req.Messages {
 		id := fmt.Sprintf("m%d", s.nextID)
 		s.nextID++
 		pm.MessageId = id
-		pubTime := s.timeNowFunc()
+		pubTime := publishTime
+		if pubTime.IsZero() {
+			pubTime = s.timeNowFunc()
+		}
 		tsPubTime := timestamppb.New(pubTime)
 		pm.PublishTime = tsPubTime
 		m := &Message{
+			seq:         s.nextID - 1,
 			ID:          id,
 			Data:        pm.Data,
 			Attributes:  pm.Attributes,
 			PublishTime: pubTime,
+			Topic:       req.Topic,
 			OrderingKey: pm.OrderingKey,
 		}
 		top.publish(pm, m)
@@ -651,6 +1310,7 @@ func (s *GServer) Publish(_ context.Context, req *pb.PublishRequest) (*pb.Publis
 		s.msgs = append(s.msgs, m)
 		s.msgsByID[id] = m
 	}
+	s.pruneMessages()
 	return &pb.PublishResponse{MessageIds: ids}, nil
 }
 
@@ -678,16 +1338,25 @@ func (t *topic) deleteSub(sub *subscription) {
 
 func (t *topic) publish(pm *pb.PubsubMessage, m *Message) {
 	for _, s := range t.subs {
+		if s.filter != nil && !s.filter(pm.Attributes) {
+			continue
+		}
 		s.msgs[pm.MessageId] = &message{
+			seq:         m.seq,
 			publishTime: m.PublishTime,
+			arrived:     s.timeNowFunc(),
 			proto: &pb.ReceivedMessage{
 				AckId:   pm.MessageId,
 				Message: pm,
 			},
 			deliveries:  &m.deliveries,
 			acks:        &m.acks,
+			ackedAt:     &m.ackedAt,
+			deadline:    &m.ackDeadline,
+			failures:    &m.failures,
 			streamIndex: -1,
 		}
+		s.notify()
 	}
 }
 
@@ -700,6 +1369,30 @@ type subscription struct {
 	timeNowFunc func() time.Time
 	streams     []*stream
 	ackTimeout  time.Duration
+	// deliveryDelay is how long after publication messages become
+	// deliverable, as set by WithDeliveryDelay.
+	deliveryDelay time.Duration
+	// keyAffinity is set by WithOrderingKeyAffinity.
+	keyAffinity bool
+	acked       int // acks of the subscription's messages, for AckStats
+	nacked      int // modacks to a deadline of 0, for AckStats
+	// filter is the parsed form of proto.Filter; nil if there is none.
+	filter filter
+	// pushClient is set by WithPushDelivery.  Pushes are made with
+	// pushCtx, which stop cancels, and counted in wg, which start sets.
+	pushClient *http.Client
+	pushCtx    context.Context
+	cancelPush context.CancelFunc
+	wg         *sync.WaitGroup
+	// deliveryOrder holds the ack ID of each delivery, in order, for
+	// DeliveryOrder.
+	deliveryOrder []string
+	// ackWaiters holds the channels WaitForAck is waiting on, by message
+	// ID.  wakeAckWaiters sends each the result of the wait.
+	ackWaiters map[string][]chan error
+	// available is closed, and replaced, when a message may have become
+	// available to pull, to wake up Pulls that are waiting for one.
+	available chan struct{}
 }
 
 func newSubscription(
@@ -712,6 +1405,7 @@ func newSubscription(
 	if at == 0 {
 		at = 10 * time.Second
 	}
+	pushCtx, cancelPush := context.WithCancel(context.Background())
 	return &subscription{
 		topic:       t,
 		mu:          mu,
@@ -720,10 +1414,14 @@ func newSubscription(
 		msgs:        map[string]*message{},
 		done:        make(chan struct{}),
 		timeNowFunc: timeNowFunc,
+		available:   make(chan struct{}),
+		pushCtx:     pushCtx,
+		cancelPush:  cancelPush,
 	}
 }
 
 func (s *subscription) start(wg *sync.WaitGroup) {
+	s.wg = wg
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -738,18 +1436,82 @@ func (s *subscription) start(wg *sync.WaitGroup) {
 	}()
 }
 
+// stop ends the subscription's delivery goroutine and any streams
+// attached to it.
+//
+// Must be called with the lock held.
 func (s *subscription) stop() {
 	close(s.done)
+	s.cancelPush()
+	for _, st := range s.streams {
+		st.finish()
+	}
+	for id := range s.ackWaiters {
+		s.wakeAckWaiters(id, errDropped(id))
+	}
+}
+
+// wakeAckWaiters makes the WaitForAck calls waiting on the message with
+// the given ID return err.
+//
+// Must be called with the lock held.
+func (s *subscription) wakeAckWaiters(id string, err error) {
+	for _, c := range s.ackWaiters[id] {
+		c <- err
+	}
+	delete(s.ackWaiters, id)
+}
+
+// removeAckWaiter removes c, the channel of a WaitForAck call that gave
+// up, from the waiters on the message with the given ID.
+//
+// Must be called with the lock held.
+func (s *subscription) removeAckWaiter(id string, c chan error) {
+	var cs []chan error
+	for _, w := range s.ackWaiters[id] {
+		if w != c {
+			cs = append(cs, w)
+		}
+	}
+	if len(cs) == 0 {
+		delete(s.ackWaiters, id)
+	} else {
+		s.ackWaiters[id] = cs
+	}
+}
+
+// errDropped is the error of WaitForAck when the message with the given
+// ID is dropped without an ack.
+func errDropped(id string) error {
+	return status.Errorf(codes.Aborted, "message %q was dropped without an ack", id)
+}
+
+// pruneMessages drops the oldest messages from the log of published
+// messages, if it holds more than the server's maxRetainedMessages.
+// Subscriptions keep their own references to messages, so this only
+// affects Messages, Message, FindMessagesByData and Seek.
+//
+// Must be called with the lock held.
+func (s *GServer) pruneMessages() {
+	excess := len(s.msgs) - s.maxRetainedMessages
+	if s.maxRetainedMessages <= 0 || excess <= 0 {
+		return
+	}
+	for _, m := range s.msgs[:excess] {
+		delete(s.msgsByID, m.ID)
+	}
+	// Copy, so the dropped messages can be garbage collected.
+	s.msgs = append([]*Message(nil), s.msgs[excess:]...)
 }
 
 func (s *GServer) Acknowledge(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.AcknowledgeRequest,
 ) (*emptypb.Empty, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "Acknowledge", &emptypb.Empty{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "Acknowledge", &emptypb.Empty{}); handled ||
 		err != nil {
 		return ret.(*emptypb.Empty), err
 	}
@@ -758,20 +1520,29 @@ func (s *GServer) Acknowledge(
 	if err != nil {
 		return nil, err
 	}
+	now := s.timeNowFunc()
+	failures := map[string]string{}
 	for _, id := range req.AckIds {
+		if sub.leaseExpired(id, now) {
+			failures[id] = ackFailureLeaseExpired
+			continue
+		}
 		sub.ack(id)
 	}
+	if len(failures) > 0 {
+		return nil, ackFailureError(failures)
+	}
 	return &emptypb.Empty{}, nil
 }
 
 func (s *GServer) ModifyAckDeadline(
-	_ context.Context,
+	ctx context.Context,
 	req *pb.ModifyAckDeadlineRequest,
 ) (*emptypb.Empty, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "ModifyAckDeadline", &emptypb.Empty{}); handled ||
+	if handled, ret, err := s.runReactor(ctx, req, "ModifyAckDeadline", &emptypb.Empty{}); handled ||
 		err != nil {
 		return ret.(*emptypb.Empty), err
 	}
@@ -780,12 +1551,20 @@ func (s *GServer) ModifyAckDeadline(
 	if err != nil {
 		return nil, err
 	}
+	if ads := req.AckDeadlineSeconds; ads < 0 || ads > maxAckDeadlineSecs {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"ack_deadline_seconds must be between 0 and %d, not %d", maxAckDeadlineSecs, ads)
+	}
 	now := time.Now()
+	// Like Pub/Sub, ignore ack IDs we don't know, e.g. because the
+	// message was acked, or pruned from the log.
 	for _, id := range req.AckIds {
-		s.msgsByID[id].modacks = append(
-			s.msgsByID[id].modacks,
-			Modack{AckID: id, AckDeadline: req.AckDeadlineSeconds, ReceivedAt: now},
-		)
+		if m := s.msgsByID[id]; m != nil {
+			m.modacks = append(
+				m.modacks,
+				Modack{AckID: id, AckDeadline: req.AckDeadlineSeconds, ReceivedAt: now},
+			)
+		}
 	}
 	dur := secsToDur(req.AckDeadlineSeconds)
 	for _, id := range req.AckIds {
@@ -797,7 +1576,7 @@ func (s *GServer) ModifyAckDeadline(
 func (s *GServer) Pull(ctx context.Context, req *pb.PullRequest) (*pb.PullResponse, error) {
 	s.mu.Lock()
 
-	if handled, ret, err := s.runReactor(req, "Pull", &pb.PullResponse{}); handled || err != nil {
+	if handled, ret, err := s.runReactor(ctx, req, "Pull", &pb.PullResponse{}); handled || err != nil {
 		s.mu.Unlock()
 		return ret.(*pb.PullResponse), err
 	}
@@ -816,21 +1595,33 @@ func (s *GServer) Pull(ctx context.Context, req *pb.PullRequest) (*pb.PullRespon
 		max = 1000
 	}
 	msgs := sub.pull(max)
+	wait := s.pullWait
+	available := sub.available
 	s.mu.Unlock()
 	// Implement the spec from the pubsub proto:
 	// "If ReturnImmediately set to true, the system will respond immediately even if
 	// it there are no messages available to return in the `Pull` response.
 	// Otherwise, the system may wait (for a bounded amount of time) until at
 	// least one message is available, rather than returning no messages."
-	if len(msgs) == 0 && !req.ReturnImmediately {
-		// Wait for a short amount of time for a message.
-		// TODO: signal when a message arrives, so we don't wait the whole time.
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-time.After(500 * time.Millisecond):
+	if len(msgs) == 0 && !req.ReturnImmediately && wait > 0 {
+		// Wait for a short amount of time for a message, trying again
+		// whenever one may have become available.
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for len(msgs) == 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-available:
+			case <-timer.C:
+				s.mu.Lock()
+				msgs = sub.pull(max)
+				s.mu.Unlock()
+				return &pb.PullResponse{ReceivedMessages: msgs}, nil
+			}
 			s.mu.Lock()
 			msgs = sub.pull(max)
+			available = sub.available
 			s.mu.Unlock()
 		}
 	}
@@ -845,26 +1636,23 @@ func (s *GServer) StreamingPull(sps pb.Subscriber_StreamingPullServer) error {
 	}
 	s.mu.Lock()
 	sub, err := s.findSubscription(req.Subscription)
+	maxOutstanding := s.maxOutstandingMessages
 	s.mu.Unlock()
 	if err != nil {
 		return err
 	}
 	// Create a new stream to handle the pull.
-	st := sub.newStream(sps, s.streamTimeout)
+	st := sub.newStream(sps, req, s.streamTimeout, maxOutstanding)
 	err = st.pull(&s.wg)
 	sub.deleteStream(st)
 	return err
 }
 
 func (s *GServer) Seek(ctx context.Context, req *pb.SeekRequest) (*pb.SeekResponse, error) {
-	// Only handle time-based seeking for now.
-	// This fake doesn't deal with snapshots.
-	var target time.Time
 	switch v := req.Target.(type) {
 	case nil:
 		return nil, status.Errorf(codes.InvalidArgument, "missing Seek target type")
-	case *pb.SeekRequest_Time:
-		target = v.Time.AsTime()
+	case *pb.SeekRequest_Time, *pb.SeekRequest_Snapshot:
 	default:
 		return nil, status.Errorf(codes.Unimplemented, "unhandled Seek target type %T", v)
 	}
@@ -874,7 +1662,7 @@ func (s *GServer) Seek(ctx context.Context, req *pb.SeekRequest) (*pb.SeekRespon
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if handled, ret, err := s.runReactor(req, "Seek", &pb.SeekResponse{}); handled || err != nil {
+	if handled, ret, err := s.runReactor(ctx, req, "Seek", &pb.SeekResponse{}); handled || err != nil {
 		return ret.(*pb.SeekResponse), err
 	}
 
@@ -882,34 +1670,84 @@ func (s *GServer) Seek(ctx context.Context, req *pb.SeekRequest) (*pb.SeekRespon
 	if err != nil {
 		return nil, err
 	}
+	if v, ok := req.Target.(*pb.SeekRequest_Snapshot); ok {
+		if err := s.seekToSnapshot(sub, v.Snapshot); err != nil {
+			return nil, err
+		}
+		return &pb.SeekResponse{}, nil
+	}
+
+	target := req.GetTime().AsTime()
+	// Like Pub/Sub, refuse to seek to before the retained messages.
+	retention := sub.proto.MessageRetentionDuration.AsDuration()
+	if oldest := s.timeNowFunc().Add(-retention); target.Before(oldest) {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"seek target %v is before the retention window, which starts at %v",
+			target, oldest)
+	}
 	// Drop all messages from sub that were published before the target time.
 	for id, m := range sub.msgs {
 		if m.publishTime.Before(target) {
+			m.release()
 			delete(sub.msgs, id)
 			(*m.acks)++
+			sub.wakeAckWaiters(id, nil)
 		}
 	}
 	// Un-ack any already-acked messages after this time;
 	// redelivering them to the subscription is the closest analogue here.
 	for _, m := range s.msgs {
-		if m.PublishTime.Before(target) {
+		if m.Topic != sub.topic.proto.Name || m.PublishTime.Before(target) {
 			continue
 		}
-		sub.msgs[m.ID] = &message{
-			publishTime: m.PublishTime,
-			proto: &pb.ReceivedMessage{
-				AckId: m.ID,
-				// This was not preserved!
-				// Message: pm,
-			},
-			deliveries:  &m.deliveries,
-			acks:        &m.acks,
-			streamIndex: -1,
-		}
+		sub.redeliver(m)
 	}
 	return &pb.SeekResponse{}, nil
 }
 
+// redeliver adds m, from the server's log of published messages, back to
+// the subscription, replacing any copy it has.
+//
+// Must be called with the lock held.
+func (s *subscription) redeliver(m *Message) {
+	if s.filter != nil && !s.filter(m.Attributes) {
+		return
+	}
+	if old := s.msgs[m.ID]; old != nil {
+		old.release()
+	}
+	s.msgs[m.ID] = &message{
+		seq:         m.seq,
+		publishTime: m.PublishTime,
+		arrived:     s.timeNowFunc(),
+		proto: &pb.ReceivedMessage{
+			AckId: m.ID,
+			Message: &pb.PubsubMessage{
+				Data:        m.Data,
+				Attributes:  m.Attributes,
+				MessageId:   m.ID,
+				PublishTime: timestamppb.New(m.PublishTime),
+				OrderingKey: m.OrderingKey,
+			},
+		},
+		deliveries:  &m.deliveries,
+		acks:        &m.acks,
+		ackedAt:     &m.ackedAt,
+		deadline:    &m.ackDeadline,
+		failures:    &m.failures,
+		streamIndex: -1,
+	}
+	s.notify()
+}
+
+// notify wakes up the Pulls waiting for a message.
+//
+// Must be called with the lock held.
+func (s *subscription) notify() {
+	close(s.available)
+	s.available = make(chan struct{})
+}
+
 // Gets a subscription that must exist.
 // Must be called with the lock held.
 func (s *GServer) findSubscription(name string) (*subscription, error) {
@@ -928,12 +1766,13 @@ func (s *subscription) pull(max int) []*pb.ReceivedMessage {
 	now := s.timeNowFunc()
 	s.maintainMessages(now)
 	var msgs []*pb.ReceivedMessage
-	for _, m := range s.msgs {
-		if m.outstanding() {
+	heads := map[string]bool{}
+	for _, m := range s.inOrder() {
+		if s.heldBack(m, heads) || m.outstanding() || s.pending(m, now) || s.loseDelivery(m, now) {
 			continue
 		}
-		(*m.deliveries)++
-		m.ackDeadline = now.Add(s.ackTimeout)
+		s.setDeliveryAttempt(m)
+		s.recordDelivery(m, now)
 		msgs = append(msgs, m.proto)
 		if len(msgs) >= max {
 			break
@@ -948,10 +1787,33 @@ func (s *subscription) deliver() {
 
 	now := s.timeNowFunc()
 	s.maintainMessages(now)
+	if s.pushing() {
+		s.push(now)
+		return
+	}
 	// Try to deliver each remaining message.
 	curIndex := 0
-	for _, m := range s.msgs {
-		if m.outstanding() {
+	// blocked holds the ordering keys whose stream is full, so that we
+	// don't deliver their later messages before their earlier ones.
+	blocked := map[string]bool{}
+	heads := map[string]bool{}
+	for _, m := range s.inOrder() {
+		if s.heldBack(m, heads) || m.outstanding() || s.pending(m, now) {
+			continue
+		}
+		if key := m.proto.GetMessage().GetOrderingKey(); s.keyAffinity && key != "" {
+			if blocked[key] {
+				continue
+			}
+			if s.loseDelivery(m, now) {
+				continue
+			}
+			if !s.tryDeliverToKeyStream(m, key, now) {
+				blocked[key] = true
+			}
+			continue
+		}
+		if s.loseDelivery(m, now) {
 			continue
 		}
 		// If the message was never delivered before, start with the stream at
@@ -987,14 +1849,17 @@ func (s *subscription) tryDeliverMessage(m *message, start int, now time.Time) (
 		idx := (i + start) % len(s.streams)
 
 		st := s.streams[idx]
+		if !st.hasRoomFor(m) {
+			continue
+		}
+		s.setDeliveryAttempt(m)
 		select {
 		case <-st.done:
 			s.streams = deleteStreamAt(s.streams, idx)
 			i--
 
 		case st.msgc <- m.proto:
-			(*m.deliveries)++
-			m.ackDeadline = now.Add(st.ackTimeout)
+			s.recordStreamDelivery(m, st, now)
 			return idx, true
 
 		default:
@@ -1003,6 +1868,163 @@ func (s *subscription) tryDeliverMessage(m *message, start int, now time.Time) (
 	return 0, false
 }
 
+// tryDeliverToKeyStream attempts to deliver m, whose ordering key is key,
+// to the stream the key maps to, which is the key's hash modulo the number
+// of streams.  So the mapping changes, spreading keys over the streams
+// again, when streams are opened or closed.
+//
+// It reports whether it delivered the message.
+//
+// Must be called with the lock held.
+func (s *subscription) tryDeliverToKeyStream(m *message, key string, now time.Time) bool {
+	for len(s.streams) > 0 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		idx := int(h.Sum32() % uint32(len(s.streams)))
+
+		st := s.streams[idx]
+		if !st.hasRoomFor(m) {
+			return false
+		}
+		s.setDeliveryAttempt(m)
+		select {
+		case <-st.done:
+			s.streams = deleteStreamAt(s.streams, idx)
+
+		case st.msgc <- m.proto:
+			s.recordStreamDelivery(m, st, now)
+			return true
+
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// recordDelivery records that m was delivered by Pull, or pushed.
+//
+// Must be called with the lock held.
+func (s *subscription) recordDelivery(m *message, now time.Time) {
+	(*m.deliveries)++
+	m.attempts++
+	s.deliveryOrder = append(s.deliveryOrder, m.proto.GetAckId())
+	m.ackDeadline = now.Add(s.ackTimeout)
+	m.recordDeadline(m.ackDeadline)
+}
+
+// recordStreamDelivery records that m was sent on st.
+//
+// Must be called with the lock held.
+func (s *subscription) recordStreamDelivery(m *message, st *stream, now time.Time) {
+	(*m.deliveries)++
+	m.attempts++
+	s.deliveryOrder = append(s.deliveryOrder, m.proto.GetAckId())
+	m.ackDeadline = now.Add(st.ackTimeout)
+	m.recordDeadline(m.ackDeadline)
+	m.owner = st
+	st.deliveries++
+	st.outstandingMessages++
+	st.outstandingBytes += m.size()
+}
+
+// setDeliveryAttempt sets the DeliveryAttempt of m's proto to the number of
+// the delivery about to be made, counting from 1, if the subscription has a
+// dead-letter policy, as Pub/Sub does.  Otherwise it's zero.
+//
+// Must be called with the lock held.
+func (s *subscription) setDeliveryAttempt(m *message) {
+	if s.proto.DeadLetterPolicy != nil {
+		m.proto.DeliveryAttempt = int32(m.attempts + 1)
+	} else if m.proto.GetDeliveryAttempt() != 0 {
+		m.proto.DeliveryAttempt = 0
+	}
+}
+
+// inOrder returns the subscription's messages in the order they were
+// published, which is the order we deliver them in.
+//
+// Must be called with the lock held.
+func (s *subscription) inOrder() []*message {
+	msgs := make([]*message, 0, len(s.msgs))
+	for _, m := range s.msgs {
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].seq < msgs[j].seq })
+	return msgs
+}
+
+// heldBack reports whether m must wait for an earlier message with the
+// same ordering key to be acked, because the subscription has message
+// ordering enabled.  The first unacked message for each key, its head,
+// blocks the rest, even while it's outstanding or backing off; messages
+// with different keys, or none, don't block each other.
+//
+// heads holds the keys whose head has been seen; callers pass the same map
+// for each of the subscription's messages, in the order inOrder returns.
+func (s *subscription) heldBack(m *message, heads map[string]bool) bool {
+	key := m.proto.GetMessage().GetOrderingKey()
+	if !s.proto.EnableMessageOrdering || key == "" {
+		return false
+	}
+	if heads[key] {
+		return true
+	}
+	heads[key] = true
+	return false
+}
+
+// pending reports whether m can't be delivered yet, because it's still
+// propagating (see WithDeliveryDelay) or backing off after a nack.
+func (s *subscription) pending(m *message, now time.Time) bool {
+	return now.Before(m.publishTime.Add(s.deliveryDelay)) || now.Before(m.nextDelivery)
+}
+
+// The retry policy's backoffs if it doesn't set them, as in Pub/Sub.
+const (
+	defaultMinimumBackoff = 10 * time.Second
+	defaultMaximumBackoff = 600 * time.Second
+)
+
+// backoff returns how long to wait before redelivering a message that was
+// nacked after its nth delivery: the retry policy's minimum backoff,
+// doubled for each delivery after the first, up to its maximum backoff.
+func (s *subscription) backoff(n int) time.Duration {
+	policy := s.proto.RetryPolicy
+	min, max := defaultMinimumBackoff, defaultMaximumBackoff
+	if policy.MinimumBackoff != nil {
+		min = policy.MinimumBackoff.AsDuration()
+	}
+	if policy.MaximumBackoff != nil {
+		max = policy.MaximumBackoff.AsDuration()
+	}
+	d := min
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// loseDelivery reports whether the delivery of m should be lost, as set by
+// FailDelivery.  If so, m is outstanding until its ack deadline expires,
+// as though it had been sent.
+//
+// Must be called with the lock held.
+func (s *subscription) loseDelivery(m *message, now time.Time) bool {
+	if m.failures == nil || *m.failures <= 0 {
+		return false
+	}
+	(*m.failures)--
+	(*m.deliveries)++
+	m.attempts++
+	m.ackDeadline = now.Add(s.ackTimeout)
+	m.recordDeadline(m.ackDeadline)
+	return true
+}
+
 var retentionDuration = 10 * time.Minute
 
 // Must be called with the lock held.
@@ -1012,25 +2034,35 @@ func (s *subscription) maintainMessages(now time.Time) {
 		if m.outstanding() && now.After(m.ackDeadline) {
 			m.makeAvailable()
 		}
-		pubTime := m.proto.Message.PublishTime.AsTime()
 		// Remove messages that have been undelivered for a long time.
-		if !m.outstanding() && now.Sub(pubTime) > retentionDuration {
+		// This is measured from when the message reached the
+		// subscription, since PublishAt may backdate its publish time.
+		if !m.outstanding() && now.Sub(m.arrived) > retentionDuration {
 			delete(s.msgs, id)
+			s.wakeAckWaiters(id, errDropped(id))
 		}
 	}
 }
 
 func (s *subscription) newStream(
 	gs pb.Subscriber_StreamingPullServer,
+	req *pb.StreamingPullRequest,
 	timeout time.Duration,
+	maxOutstanding int64,
 ) *stream {
 	st := &stream{
-		sub:        s,
-		done:       make(chan struct{}),
-		msgc:       make(chan *pb.ReceivedMessage),
-		gstream:    gs,
-		ackTimeout: s.ackTimeout,
-		timeout:    timeout,
+		sub:                    s,
+		done:                   make(chan struct{}),
+		msgc:                   make(chan *pb.ReceivedMessage),
+		gstream:                gs,
+		ackTimeout:             s.ackTimeout,
+		timeout:                timeout,
+		maxOutstandingMessages: req.MaxOutstandingMessages,
+		maxOutstandingBytes:    req.MaxOutstandingBytes,
+	}
+	if maxOutstanding > 0 &&
+		(st.maxOutstandingMessages <= 0 || st.maxOutstandingMessages > maxOutstanding) {
+		st.maxOutstandingMessages = maxOutstanding
 	}
 	s.mu.Lock()
 	s.streams = append(s.streams, st)
@@ -1059,11 +2091,31 @@ func deleteStreamAt(s []*stream, i int) []*stream {
 
 type message struct {
 	proto       *pb.ReceivedMessage
+	seq         int // position in publish order
 	publishTime time.Time
+	arrived     time.Time // when it was added to the subscription
 	ackDeadline time.Time
 	deliveries  *int
 	acks        *int
-	streamIndex int // index of stream that currently owns msg, for round-robin delivery
+	ackedAt     *time.Time
+	streamIndex int     // index of stream that currently owns msg, for round-robin delivery
+	owner       *stream // stream that msg is outstanding on, if any
+	deadline    *time.Time
+	failures    *int // deliveries left to lose, set by FailDelivery
+	// nextDelivery is when the message may be redelivered after a nack,
+	// under the subscription's retry policy.
+	nextDelivery time.Time
+	// attempts counts the deliveries to this subscription, which
+	// deliveries counts across all of them.
+	attempts int
+}
+
+// recordDeadline records the message's latest ack deadline on its
+// Message, for Message.EffectiveDeadline.
+func (m *message) recordDeadline(t time.Time) {
+	if m.deadline != nil {
+		*m.deadline = t
+	}
 }
 
 // A message is outstanding if it is owned by some stream.
@@ -1073,15 +2125,60 @@ func (m *message) outstanding() bool {
 
 func (m *message) makeAvailable() {
 	m.ackDeadline = time.Time{}
+	m.release()
+}
+
+// release returns m's share of its owning stream's flow control.
+func (m *message) release() {
+	if m.owner != nil {
+		m.owner.outstandingMessages--
+		m.owner.outstandingBytes -= m.size()
+		m.owner = nil
+	}
+}
+
+// size is the number of bytes of data in m, for flow control.
+func (m *message) size() int64 {
+	return int64(len(m.proto.GetMessage().GetData()))
 }
 
 type stream struct {
 	sub        *subscription
 	done       chan struct{} // closed when the stream is finished
+	doneOnce   sync.Once
 	msgc       chan *pb.ReceivedMessage
 	gstream    pb.Subscriber_StreamingPullServer
 	ackTimeout time.Duration
 	timeout    time.Duration
+
+	// Flow control from the initial StreamingPullRequest, or
+	// SetMaxOutstandingMessages if it's lower, where zero means no limit,
+	// and what's outstanding on the stream.  Guarded by the
+	// subscription's lock.
+	maxOutstandingMessages int64
+	maxOutstandingBytes    int64
+	outstandingMessages    int64
+	outstandingBytes       int64
+
+	deliveries int // messages delivered on the stream, for StreamDeliveryCounts
+}
+
+// hasRoomFor reports whether delivering m would stay within the stream's
+// flow control limits.  A stream with nothing outstanding always has room,
+// so that a message bigger than the byte limit can still be delivered.
+//
+// Must be called with the lock held.
+func (st *stream) hasRoomFor(m *message) bool {
+	if st.outstandingMessages == 0 {
+		return true
+	}
+	if st.maxOutstandingMessages > 0 && st.outstandingMessages >= st.maxOutstandingMessages {
+		return false
+	}
+	if st.maxOutstandingBytes > 0 && st.outstandingBytes+m.size() > st.maxOutstandingBytes {
+		return false
+	}
+	return true
 }
 
 // pull manages the StreamingPull interaction for the life of the stream.
@@ -1100,7 +2197,8 @@ func (st *stream) pull(wg *sync.WaitGroup) error {
 	if st.timeout > 0 {
 		tchan = time.After(st.timeout)
 	}
-	// Wait until one of the goroutines returns an error, or we time out.
+	// Wait until one of the goroutines returns an error, we time out, or
+	// the subscription is stopped.
 	var err error
 	select {
 	case err = <-errc:
@@ -1108,11 +2206,17 @@ func (st *stream) pull(wg *sync.WaitGroup) error {
 			err = nil
 		}
 	case <-tchan:
+	case <-st.done:
 	}
-	close(st.done) // stop the other goroutine
+	st.finish() // stop the other goroutine
 	return err
 }
 
+// finish closes st.done, if it isn't closed already.
+func (st *stream) finish() {
+	st.doneOnce.Do(func() { close(st.done) })
+}
+
 func (st *stream) sendLoop() error {
 	for {
 		select {
@@ -1142,8 +2246,11 @@ func (s *subscription) handleStreamingPullRequest(st *stream, req *pb.StreamingP
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := s.timeNowFunc()
 	for _, ackID := range req.AckIds {
-		s.ack(ackID)
+		if !s.leaseExpired(ackID, now) {
+			s.ack(ackID)
+		}
 	}
 	for i, id := range req.ModifyDeadlineAckIds {
 		s.modifyAckDeadline(id, secsToDur(req.ModifyDeadlineSeconds[i]))
@@ -1158,7 +2265,13 @@ func (s *subscription) ack(id string) {
 	m := s.msgs[id]
 	if m != nil {
 		(*m.acks)++
+		*m.ackedAt = s.timeNowFunc()
+		s.acked++
+		m.release()
 		delete(s.msgs, id)
+		s.wakeAckWaiters(id, nil)
+		// The ack may release the next message for its ordering key.
+		s.notify()
 	}
 }
 
@@ -1169,9 +2282,16 @@ func (s *subscription) modifyAckDeadline(id string, d time.Duration) {
 		return
 	}
 	if d == 0 { // nack
+		s.nacked++
 		m.makeAvailable()
+		m.recordDeadline(s.timeNowFunc())
+		if s.proto.RetryPolicy != nil {
+			m.nextDelivery = s.timeNowFunc().Add(s.backoff(m.attempts))
+		}
+		s.notify()
 	} else { // extend the deadline by d
 		m.ackDeadline = s.timeNowFunc().Add(d)
+		m.recordDeadline(m.ackDeadline)
 	}
 }
 
@@ -1181,14 +2301,29 @@ func secsToDur(secs int32) time.Duration {
 
 // runReactor looks up the reactors for a function, then launches them until handled=true
 // or err is returned. If the reactor returns nil, the function returns defaultObj instead.
+// Reactors that implement ContextReactor are given the RPC's context.
+//
+// Must be called with the lock held, before the RPC has looked at the
+// server's state: the lock is released while a ContextReactor runs, so
+// that one can wait without holding up other RPCs.
 func (s *GServer) runReactor(
+	ctx context.Context,
 	req interface{},
 	funcName string,
 	defaultObj interface{},
 ) (bool, interface{}, error) {
 	if val, ok := s.reactorOptions[funcName]; ok {
 		for _, reactor := range val {
-			handled, ret, err := reactor.React(req)
+			var handled bool
+			var ret interface{}
+			var err error
+			if cr, ok := reactor.(ContextReactor); ok {
+				s.mu.Unlock()
+				handled, ret, err = cr.ReactContext(ctx, req)
+				s.mu.Lock()
+			} else {
+				handled, ret, err = reactor.React(req)
+			}
 			// If handled=true, that means the reactor has successfully reacted to the request,
 			// so use the output directly. If err occurs, that means the request is invalidated
 			// by the reactor somehow.
@@ -1214,6 +2349,101 @@ func (e *errorInjectionReactor) React(_ interface{}) (handled bool, ret interfac
 	return true, nil, status.Errorf(e.code, e.msg)
 }
 
+// nthCallErrorReactor is a reactor that injects an error into one call,
+// counting from 1, and lets the others be handled as usual.
+type nthCallErrorReactor struct {
+	n     int64
+	calls int64 // accessed atomically
+	msg   string
+	code  codes.Code
+}
+
+// React returns the error if this is the nth call.
+func (e *nthCallErrorReactor) React(_ interface{}) (handled bool, ret interface{}, err error) {
+	if atomic.AddInt64(&e.calls, 1) != e.n {
+		return false, nil, nil
+	}
+	return true, nil, status.Errorf(e.code, e.msg)
+}
+
+// latencyReactor is a reactor that delays a call, then lets it be handled
+// as usual.
+type latencyReactor struct {
+	d time.Duration
+}
+
+// React waits for d.
+func (l *latencyReactor) React(req interface{}) (handled bool, ret interface{}, err error) {
+	return l.ReactContext(context.Background(), req)
+}
+
+// ReactContext waits for d, or fails the call if ctx is done first.
+func (l *latencyReactor) ReactContext(
+	ctx context.Context,
+	_ interface{},
+) (handled bool, ret interface{}, err error) {
+	timer := time.NewTimer(l.d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false, nil, nil
+	case <-ctx.Done():
+		return true, nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// WithManualStart creates a ServerReactorOption that keeps subscriptions
+// from delivering messages to streams until Server.Start is called, so that
+// a test can set up all its messages and subscriptions first.
+func WithManualStart() ServerReactorOption {
+	return ServerReactorOption{apply: func(s *GServer) { s.started = false }}
+}
+
+// WithDefaultAckDeadline creates a ServerReactorOption that gives
+// subscriptions created without an ack deadline a deadline of d, instead
+// of 10 seconds, e.g. so that unacked messages are redelivered sooner.
+// Unlike an explicit ack deadline, d isn't held to the minimum set by
+// SetMinAckDeadline.
+func WithDefaultAckDeadline(d time.Duration) ServerReactorOption {
+	return ServerReactorOption{apply: func(s *GServer) { s.defaultAckDeadline = d }}
+}
+
+// WithMaxRetainedMessages creates a ServerReactorOption that bounds the
+// server's log of published messages to the latest n, so that a long
+// load test doesn't run out of memory.  Older messages disappear from
+// Messages and Message, and can't be redelivered by Seek, but are still
+// delivered to subscriptions that haven't acked them.
+func WithMaxRetainedMessages(n int) ServerReactorOption {
+	return ServerReactorOption{apply: func(s *GServer) { s.maxRetainedMessages = n }}
+}
+
+// WithDeliveryDelay creates a ServerReactorOption that keeps each message
+// from being delivered until d after it was published, according to the
+// server's clock, to simulate propagation delay.
+func WithDeliveryDelay(d time.Duration) ServerReactorOption {
+	return ServerReactorOption{apply: func(s *GServer) { s.deliveryDelay = d }}
+}
+
+// WithOrderingKeyAffinity creates a ServerReactorOption that makes
+// subscriptions deliver all the messages with an ordering key to the same
+// stream, as Pub/Sub does, rather than sharing them between streams, so
+// that each stream sees a key's messages in order.
+func WithOrderingKeyAffinity() ServerReactorOption {
+	return ServerReactorOption{apply: func(s *GServer) { s.keyAffinity = true }}
+}
+
+// WithPushDelivery creates a ServerReactorOption that makes subscriptions
+// with a push endpoint POST their messages to it using client, or
+// http.DefaultClient if client is nil, rather than deliver them on
+// streams.  A 2xx response acks the message; otherwise it's pushed again
+// once its ack deadline has passed.
+func WithPushDelivery(client *http.Client) ServerReactorOption {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return ServerReactorOption{apply: func(s *GServer) { s.pushClient = client }}
+}
+
 // WithErrorInjection creates a ServerReactorOption that injects error with defined status code and
 // message for a certain function.
 func WithErrorInjection(funcName string, code codes.Code, msg string) ServerReactorOption {
@@ -1222,3 +2452,38 @@ func WithErrorInjection(funcName string, code codes.Code, msg string) ServerReac
 		Reactor:  &errorInjectionReactor{code: code, msg: msg},
 	}
 }
+
+// WithErrorInjectionOnCall creates a ServerReactorOption that injects an
+// error with the given status code and message into just one call of a
+// certain function, the callIndex'th, counting from 1, e.g. to check that
+// a client retries after a transient error.  The other calls are handled
+// as usual.  Calls handled or failed by an earlier reactor for the
+// function aren't counted.
+func WithErrorInjectionOnCall(
+	funcName string,
+	callIndex int,
+	code codes.Code,
+	msg string,
+) ServerReactorOption {
+	return ServerReactorOption{
+		FuncName: funcName,
+		Reactor:  &nthCallErrorReactor{n: int64(callIndex), code: code, msg: msg},
+	}
+}
+
+// WithLatencyInjection creates a ServerReactorOption that delays each call
+// of a certain function by d before handling it as usual, to simulate a
+// slow response.  If the call's context is done first, e.g. because its
+// deadline passed, the call fails with the context's error right away.
+// Other calls, including other calls of the function, aren't held up.
+//
+// The reactors for a function run in the order their options were passed
+// to NewServer, until one handles the call or fails it.  So with
+// WithLatencyInjection before WithErrorInjection, the error is delayed;
+// with it after, the error is returned right away.
+func WithLatencyInjection(funcName string, d time.Duration) ServerReactorOption {
+	return ServerReactorOption{
+		FuncName: funcName,
+		Reactor:  &latencyReactor{d: d},
+	}
+}
@@ -2,21 +2,31 @@ package pstest
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/pubsub"
 	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/genproto/protobuf/field_mask"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/Khan/districts-jobs/pkg/gcpapi/testutil"
 )
@@ -246,6 +256,96 @@ func TestPublishOrdered(t *testing.T) {
 	}
 }
 
+func TestPublishOrderingKeyTooLong(t *testing.T) {
+	pclient, _, srv, cleanup := newFake(context.TODO(), t)
+	defer cleanup()
+
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	_, err := pclient.Publish(context.TODO(), &pb.PublishRequest{
+		Topic: top.Name,
+		Messages: []*pb.PubsubMessage{
+			{Data: []byte("d1"), OrderingKey: "ok"},
+			{Data: []byte("d2"), OrderingKey: strings.Repeat("k", 1025)},
+		},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument", err)
+	}
+	if got := len(srv.Messages()); got != 0 {
+		t.Errorf("got %d messages published, want 0", got)
+	}
+
+	_, err = pclient.Publish(context.TODO(), &pb.PublishRequest{
+		Topic:    top.Name,
+		Messages: []*pb.PubsubMessage{{Data: []byte("d3"), OrderingKey: strings.Repeat("k", 1024)}},
+	})
+	if err != nil {
+		t.Errorf("Publishing with a 1024-byte ordering key: %v", err)
+	}
+}
+
+func TestFindMessagesByData(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	id1 := s.Publish("projects/p/topics/t1", []byte("event"), nil)
+	id2 := s.Publish("projects/p/topics/t2", []byte("event"), nil)
+	s.Publish("projects/p/topics/t1", []byte("other"), nil)
+
+	found := s.FindMessagesByData([]byte("event"))
+	if len(found) != 2 {
+		t.Fatalf("got messages on %d topics, want 2", len(found))
+	}
+	for topic, id := range map[string]string{
+		"projects/p/topics/t1": id1,
+		"projects/p/topics/t2": id2,
+	} {
+		msgs := found[topic]
+		if len(msgs) != 1 || msgs[0].ID != id || msgs[0].Topic != topic {
+			t.Errorf("got %v on %v, want just %v", msgs, topic, id)
+		}
+	}
+	if got := s.FindMessagesByData([]byte("missing")); len(got) != 0 {
+		t.Errorf("got %v, want no messages", got)
+	}
+}
+
+func TestMessagesByOrderingKey(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	const topic = "projects/p/topics/t"
+	want := map[string][]string{}
+	for i, key := range []string{"a", "b", "", "a", "b", "a"} {
+		id := s.PublishOrdered(topic, []byte(fmt.Sprint(i)), map[string]string{"k": "v"}, key)
+		want[key] = append(want[key], id)
+	}
+
+	byKey := s.MessagesByOrderingKey()
+	got := map[string][]string{}
+	for key, msgs := range byKey {
+		for _, m := range msgs {
+			if m.OrderingKey != key {
+				t.Errorf("message %s with key %q is under %q", m.ID, m.OrderingKey, key)
+			}
+			got[key] = append(got[key], m.ID)
+		}
+	}
+	if diff := testutil.Diff(got, want); diff != "" {
+		t.Errorf("message IDs by key (-got +want):\n%s", diff)
+	}
+
+	// The results are copies.
+	m := byKey["a"][0]
+	m.Data[0] = 'x'
+	m.Attributes["k"] = "changed"
+	m.OrderingKey = "changed"
+	orig := s.Message(m.ID)
+	if string(orig.Data) != "0" || orig.Attributes["k"] != "v" || orig.OrderingKey != "a" {
+		t.Errorf("changing a result changed the server's message to %+v", orig)
+	}
+}
+
 func TestClearMessages(t *testing.T) {
 	s := NewServer()
 	defer s.Close()
@@ -265,6 +365,102 @@ func TestClearMessages(t *testing.T) {
 	}
 }
 
+func TestClearSubscription(t *testing.T) {
+	pclient, sclient, srv, cleanup := newFake(context.TODO(), t)
+	defer cleanup()
+
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub1 := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S1",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	sub2 := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S2",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	want := publish(t, pclient, top, []*pb.PubsubMessage{
+		{Data: []byte("d1")},
+		{Data: []byte("d2")},
+	})
+
+	srv.ClearSubscription(sub1.Name)
+
+	res, err := sclient.Pull(context.TODO(),
+		&pb.PullRequest{Subscription: sub1.Name, ReturnImmediately: true, MaxMessages: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.ReceivedMessages) != 0 {
+		t.Errorf("got %d messages on the cleared subscription, want 0",
+			len(res.ReceivedMessages))
+	}
+	got := pubsubMessages(pullN(context.TODO(), t, len(want), sclient, sub2))
+	if diff := testutil.Diff(got, want); diff != "" {
+		t.Error(diff)
+	}
+	if got := len(srv.Messages()); got != 2 {
+		t.Errorf("got %d published messages, want 2", got)
+	}
+}
+
+// recordingTB records the errors reported to it instead of failing.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRequireDrained(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	publish(t, pclient, top, []*pb.PubsubMessage{{Data: []byte("d1")}, {Data: []byte("d2")}})
+	msgs := pullN(ctx, t, 1, sclient, sub)
+
+	rec := &recordingTB{}
+	srv.RequireDrained(rec)
+	if len(rec.errors) != 1 {
+		t.Fatalf("got errors %q, want 1", rec.errors)
+	}
+	for _, want := range []string{sub.Name, "m0", "m1", "(outstanding)"} {
+		if !strings.Contains(rec.errors[0], want) {
+			t.Errorf("got error %q, want it to mention %q", rec.errors[0], want)
+		}
+	}
+
+	for _, m := range pullN(ctx, t, 1, sclient, sub) {
+		msgs[m.Message.MessageId] = m
+	}
+	for _, m := range msgs {
+		_, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+			Subscription: sub.Name,
+			AckIds:       []string{m.AckId},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec = &recordingTB{}
+	srv.RequireDrained(rec)
+	if len(rec.errors) != 0 {
+		t.Errorf("got errors %q on a drained server, want none", rec.errors)
+	}
+}
+
 // Note: this sets the fake's "now" time, so it is sensitive to concurrent changes to "now".
 func publish(
 	t *testing.T,
@@ -476,6 +672,100 @@ func TestModAck(t *testing.T) {
 	}
 }
 
+func TestEffectiveDeadline(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(context.TODO(), t)
+	defer cleanup()
+
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+	if got := srv.Message(id).EffectiveDeadline(); !got.IsZero() {
+		t.Errorf("got deadline %v before delivery, want zero", got)
+	}
+
+	before := time.Now()
+	msgs := pullN(ctx, t, 1, sclient, sub)
+	after := time.Now()
+	got := srv.Message(id).EffectiveDeadline()
+	if got.Before(before.Add(10*time.Second)) || got.After(after.Add(10*time.Second)) {
+		t.Errorf("got deadline %v after delivery, want 10s after %v", got, before)
+	}
+
+	before = time.Now()
+	if _, err := sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+		Subscription:       sub.Name,
+		AckIds:             []string{msgs[id].AckId},
+		AckDeadlineSeconds: 60,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	after = time.Now()
+	got = srv.Message(id).EffectiveDeadline()
+	if got.Before(before.Add(60*time.Second)) || got.After(after.Add(60*time.Second)) {
+		t.Errorf("got deadline %v after modack, want 60s after %v", got, before)
+	}
+}
+
+func TestZeroSettings(t *testing.T) {
+	ctx := context.Background()
+	pclient, _, srv, cleanup := newFake(ctx, t,
+		WithDefaultAckDeadline(0),
+		WithMaxRetainedMessages(-1),
+		WithDeliveryDelay(0),
+	)
+	defer cleanup()
+
+	// Settings aren't reactors, whatever their values.
+	if got := len(srv.GServer.reactorOptions); got != 0 {
+		t.Errorf("got reactors for %d functions, want none", got)
+	}
+	mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+}
+
+func TestDefaultAckDeadline(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t, WithDefaultAckDeadline(2*time.Second))
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	if got, want := sub.AckDeadlineSeconds, int32(2); got != want {
+		t.Errorf("got ack deadline %ds, want %ds", got, want)
+	}
+	srv.GServer.mu.Lock()
+	got := srv.GServer.subs[sub.Name].ackTimeout
+	srv.GServer.mu.Unlock()
+	if want := 2 * time.Second; got != want {
+		t.Errorf("got ack timeout %v, want %v", got, want)
+	}
+
+	// An explicit deadline still wins, and is still checked.
+	explicit := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S2",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 30,
+	})
+	if got, want := explicit.AckDeadlineSeconds, int32(30); got != want {
+		t.Errorf("got ack deadline %ds, want %ds", got, want)
+	}
+	_, err := sclient.CreateSubscription(ctx, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S3",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 601,
+	})
+	if status.Code(err) != codes.Unknown {
+		t.Errorf("got %v for a deadline above the maximum, want Unknown", err)
+	}
+}
+
 func TestAckDeadline(t *testing.T) {
 	// Messages should be resent after they expire.
 	pclient, sclient, _, cleanup := newFake(context.TODO(), t)
@@ -631,481 +921,2635 @@ func TestStreamingPullTimeout(t *testing.T) {
 	}
 }
 
-func TestSeek(t *testing.T) {
-	pclient, sclient, _, cleanup := newFake(context.TODO(), t)
-	defer cleanup()
+func TestCloseTwice(t *testing.T) {
+	pclient, sclient, srv, cleanup := newFake(context.TODO(), t)
+	defer cleanup() // closes srv again
 
 	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
-	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
+	mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
 		Name:               "projects/P/subscriptions/S",
 		Topic:              top.Name,
 		AckDeadlineSeconds: 10,
 	})
-	ts := timestamppb.Now()
-	_, err := sclient.Seek(context.Background(), &pb.SeekRequest{
-		Subscription: sub.Name,
-		Target:       &pb.SeekRequest_Time{Time: ts},
-	})
-	if err != nil {
-		t.Errorf("Seeking: %v", err)
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestTryDeliverMessage(t *testing.T) {
-	for _, test := range []struct {
-		availStreamIdx int
-		expectedOutIdx int
-	}{
-		{availStreamIdx: 0, expectedOutIdx: 0},
-		// Stream 1 will always be marked for deletion.
-		{availStreamIdx: 2, expectedOutIdx: 1}, // s0, s1 (deleted), s2, s3 becomes s0, s2, s3. So we expect outIdx=1.
-		{availStreamIdx: 3, expectedOutIdx: 2}, // s0, s1 (deleted), s2, s3 becomes s0, s2, s3. So we expect outIdx=2.
-	} {
-		top := newTopic(&pb.Topic{Name: "some-topic"})
-		sub := newSubscription(
-			top,
-			&sync.Mutex{},
-			time.Now,
-			&pb.Subscription{Name: "some-sub", Topic: "some-topic"},
-		)
-
-		done := make(chan struct{}, 1)
-		done <- struct{}{}
-		sub.streams = []*stream{{}, {done: done}, {}, {}}
+func TestDeleteSubscriptionStopsStreams(t *testing.T) {
+	pclient, sclient, srv, cleanup := newFake(context.TODO(), t)
+	defer cleanup()
 
-		msgc := make(chan *pb.ReceivedMessage, 1)
-		sub.streams[test.availStreamIdx].msgc = msgc
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	stream := mustStartStreamingPull(context.TODO(), t, sclient, sub)
 
-		var d int
-		idx, ok := sub.tryDeliverMessage(&message{deliveries: &d}, 0, time.Now())
-		if !ok {
-			t.Fatalf(
-				"[avail=%d]: expected msg to be put on stream %d's channel, but it was not",
-				test.availStreamIdx,
-				test.expectedOutIdx,
-			)
-		}
-		if idx != test.expectedOutIdx {
-			t.Fatalf(
-				"[avail=%d]: expected msg to be put on stream %d, but it was put on %d",
-				test.availStreamIdx,
-				test.expectedOutIdx,
-				idx,
-			)
-		}
-		select {
-		case <-msgc:
-		default:
-			t.Fatalf(
-				"[avail=%d]: expected msg to be put on stream %d's channel, but it was not",
-				test.availStreamIdx,
-				idx,
-			)
-		}
+	// Wait for the stream to attach to the subscription.
+	for attached := false; !attached; {
+		srv.GServer.mu.Lock()
+		attached = len(srv.GServer.subs[sub.Name].streams) > 0
+		srv.GServer.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
 	}
-}
-
-func TestTimeNowFunc(t *testing.T) {
-	s := NewServer()
-	defer s.Close()
 
-	timeFunc := func() time.Time {
-		t, _ := time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
-		return t
+	_, err := sclient.DeleteSubscription(context.TODO(),
+		&pb.DeleteSubscriptionRequest{Subscription: sub.Name})
+	if err != nil {
+		t.Fatal(err)
 	}
-	s.SetTimeNowFunc(timeFunc)
-
-	id := s.Publish("projects/p/topics/t", []byte("hello"), nil)
-	s.Wait()
-
-	m := s.Message(id)
-	if m == nil {
-		t.Fatalf("got nil, want a message")
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("got %v, want io.EOF", err)
 	}
-	if got, want := m.PublishTime, timeFunc(); got != want {
-		t.Fatalf("got %v, want %v", got, want)
+
+	waited := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return after the subscription was deleted")
 	}
 }
 
-func TestModAck_Race(t *testing.T) {
-	ctx := context.Background()
-	pclient, sclient, server, cleanup := newFake(ctx, t)
+func TestManualStart(t *testing.T) {
+	pclient, sclient, srv, cleanup := newFake(context.TODO(), t, WithManualStart())
 	defer cleanup()
 
-	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
-	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
 		Name:               "projects/P/subscriptions/S",
 		Topic:              top.Name,
 		AckDeadlineSeconds: 10,
 	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+	stream := mustStartStreamingPull(context.TODO(), t, sclient, sub)
 
-	publish(t, pclient, top, []*pb.PubsubMessage{
-		{Data: []byte("d1")},
-		{Data: []byte("d2")},
-		{Data: []byte("d3")},
-	})
-	msgs := streamingPullN(ctx, t, 3, sclient, sub)
-	var ackIDs []string
-	for _, m := range msgs {
-		ackIDs = append(ackIDs, m.AckId)
+	time.Sleep(100 * time.Millisecond)
+	if got := srv.Message(id).Deliveries; got != 0 {
+		t.Fatalf("got %d deliveries before Start, want 0", got)
 	}
 
-	// Try to access m.Modacks while simultaneously calling ModifyAckDeadline
-	// so as to try and create a race condition.
-	// Invoke ModifyAckDeadline from the server rather than the client
-	// to increase replicability of simultaneous data access.
-	go func() {
-		req := &pb.ModifyAckDeadlineRequest{
-			Subscription:       sub.Name,
-			AckIds:             ackIDs,
-			AckDeadlineSeconds: 0,
-		}
-		server.GServer.ModifyAckDeadline(ctx, req)
-	}()
-
-	sm := server.Messages()
-	for _, m := range sm {
-		t.Logf("got modacks: %v\n", m.Modacks)
+	srv.Start()
+	res, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(res.ReceivedMessages[0].Message.Data); got != "d1" {
+		t.Errorf("got %q, want %q", got, "d1")
 	}
 }
 
-func TestUpdateDeadLetterPolicy(t *testing.T) {
-	pclient, sclient, _, cleanup := newFake(context.TODO(), t)
+func TestStreamingPullMaxOutstandingBytes(t *testing.T) {
+	pclient, sclient, srv, cleanup := newFake(context.TODO(), t)
 	defer cleanup()
 
 	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
-	deadTop := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/TD"})
 	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
-		AckDeadlineSeconds: minAckDeadlineSecs,
 		Name:               "projects/P/subscriptions/S",
 		Topic:              top.Name,
-		DeadLetterPolicy: &pb.DeadLetterPolicy{
-			DeadLetterTopic:     deadTop.Name,
-			MaxDeliveryAttempts: 5,
-		},
+		AckDeadlineSeconds: 10,
 	})
+	big := make([]byte, 600)
+	publish(t, pclient, top, []*pb.PubsubMessage{{Data: big}, {Data: big}, {Data: big}})
 
-	update := &pb.Subscription{
-		AckDeadlineSeconds: sub.AckDeadlineSeconds,
-		Name:               sub.Name,
-		Topic:              top.Name,
-		DeadLetterPolicy: &pb.DeadLetterPolicy{
-			DeadLetterTopic: deadTop.Name,
-			// update max delivery attempts
-			MaxDeliveryAttempts: 10,
-		},
+	spc, err := sclient.StreamingPull(context.TODO())
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	updated := mustUpdateSubscription(context.TODO(), t, sclient, &pb.UpdateSubscriptionRequest{
-		Subscription: update,
-		UpdateMask:   &field_mask.FieldMask{Paths: []string{"dead_letter_policy"}},
+	// The byte cap allows one message at a time, long before the count cap.
+	err = spc.Send(&pb.StreamingPullRequest{
+		Subscription:           sub.Name,
+		MaxOutstandingMessages: 10,
+		MaxOutstandingBytes:    1000,
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	if got, want := updated.DeadLetterPolicy.MaxDeliveryAttempts, update.DeadLetterPolicy.MaxDeliveryAttempts; got != want {
-		t.Fatalf("got %v, want %v", got, want)
+	outstanding := func() (msgs, bytes int64) {
+		srv.GServer.mu.Lock()
+		defer srv.GServer.mu.Unlock()
+		for _, st := range srv.GServer.subs[sub.Name].streams {
+			msgs += st.outstandingMessages
+			bytes += st.outstandingBytes
+		}
+		return msgs, bytes
+	}
+
+	for i := 0; i < 3; i++ {
+		res, err := spc.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond) // give the fake a chance to overdeliver
+		if msgs, bytes := outstanding(); msgs != 1 || bytes != 600 {
+			t.Fatalf("got %d messages (%d bytes) outstanding, want 1 (600 bytes)", msgs, bytes)
+		}
+		err = spc.Send(&pb.StreamingPullRequest{
+			AckIds: []string{res.ReceivedMessages[0].AckId},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 }
 
-func TestUpdateRetryPolicy(t *testing.T) {
-	ctx := context.Background()
-	pclient, sclient, _, cleanup := newFake(ctx, t)
+func TestStreamDeliveryCounts(t *testing.T) {
+	pclient, sclient, srv, cleanup := newFake(context.TODO(), t)
 	defer cleanup()
 
-	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
-	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
-		AckDeadlineSeconds: minAckDeadlineSecs,
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
 		Name:               "projects/P/subscriptions/S",
 		Topic:              top.Name,
-		RetryPolicy: &pb.RetryPolicy{
-			MinimumBackoff: durationpb.New(10 * time.Second),
-			MaximumBackoff: durationpb.New(60 * time.Second),
-		},
+		AckDeadlineSeconds: 10,
 	})
-
-	update := &pb.Subscription{
-		AckDeadlineSeconds: sub.AckDeadlineSeconds,
-		Name:               sub.Name,
-		Topic:              top.Name,
-		RetryPolicy: &pb.RetryPolicy{
-			MinimumBackoff: durationpb.New(20 * time.Second),
-			MaximumBackoff: durationpb.New(100 * time.Second),
-		},
+	// Neither stream acks, so the cap of two keeps either from taking more
+	// than its share, however slowly the other one sends.
+	for i := 0; i < 2; i++ {
+		spc, err := sclient.StreamingPull(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = spc.Send(&pb.StreamingPullRequest{
+			Subscription:           sub.Name,
+			MaxOutstandingMessages: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for len(srv.StreamDeliveryCounts(sub.Name)) < 2 {
+		time.Sleep(10 * time.Millisecond)
 	}
 
-	updated := mustUpdateSubscription(ctx, t, sclient, &pb.UpdateSubscriptionRequest{
-		Subscription: update,
-		UpdateMask:   &field_mask.FieldMask{Paths: []string{"retry_policy"}},
+	publish(t, pclient, top, []*pb.PubsubMessage{
+		{Data: []byte("d1")},
+		{Data: []byte("d2")},
+		{Data: []byte("d3")},
+		{Data: []byte("d4")},
 	})
-
-	if got, want := updated.RetryPolicy, update.RetryPolicy; testutil.Diff(got, want) != "" {
-		t.Fatalf("got %v, want %v", got, want)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		counts := srv.StreamDeliveryCounts(sub.Name)
+		if counts[0]+counts[1] == 4 {
+			if !reflect.DeepEqual(counts, []int{2, 2}) {
+				t.Errorf("got counts %v, want [2 2]", counts)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got counts %v, want 4 deliveries", counts)
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-func TestUpdateFilter(t *testing.T) {
-	ctx := context.Background()
-	pclient, sclient, _, cleanup := newFake(ctx, t)
+func TestSetMaxOutstandingMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
 	defer cleanup()
+	srv.SetMaxOutstandingMessages(2)
 
 	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
 	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
-		AckDeadlineSeconds: minAckDeadlineSecs,
 		Name:               "projects/P/subscriptions/S",
 		Topic:              top.Name,
-		Filter:             "some-filter",
+		AckDeadlineSeconds: 10,
 	})
-
-	update := &pb.Subscription{
-		AckDeadlineSeconds: sub.AckDeadlineSeconds,
-		Name:               sub.Name,
-		Topic:              top.Name,
-		Filter:             "new-filter",
+	// One stream never acks, so it's saturated after two messages; the
+	// other acks everything, so it gets the rest.
+	mustStartStreamingPull(ctx, t, sclient, sub)
+	spc := mustStartStreamingPull(ctx, t, sclient, sub)
+	go func() {
+		for {
+			res, err := spc.Recv()
+			if err != nil {
+				return
+			}
+			for _, rm := range res.ReceivedMessages {
+				_ = spc.Send(&pb.StreamingPullRequest{AckIds: []string{rm.AckId}})
+			}
+		}
+	}()
+	for len(srv.StreamDeliveryCounts(sub.Name)) < 2 {
+		time.Sleep(10 * time.Millisecond)
 	}
 
-	updated := mustUpdateSubscription(ctx, t, sclient, &pb.UpdateSubscriptionRequest{
-		Subscription: update,
-		UpdateMask:   &field_mask.FieldMask{Paths: []string{"filter"}},
-	})
-
-	if got, want := updated.Filter, update.Filter; got != want {
-		t.Fatalf("got %v, want %v", got, want)
+	for i := 0; i < 10; i++ {
+		srv.Publish(top.Name, []byte(fmt.Sprint(i)), nil)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		counts := srv.StreamDeliveryCounts(sub.Name)
+		if counts[0]+counts[1] == 10 {
+			sort.Ints(counts)
+			if !reflect.DeepEqual(counts, []int{2, 8}) {
+				t.Errorf("got counts %v, want 2 on the saturated stream and 8 on the other", counts)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got counts %v, want 10 deliveries", counts)
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-func mustStartStreamingPull(
-	ctx context.Context,
-	t *testing.T,
-	sc pb.SubscriberClient,
-	sub *pb.Subscription,
-) pb.Subscriber_StreamingPullClient {
-	spc, err := sc.StreamingPull(ctx)
+func TestSeek(t *testing.T) {
+	pclient, sclient, _, cleanup := newFake(context.TODO(), t)
+	defer cleanup()
+
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	ts := timestamppb.Now()
+	_, err := sclient.Seek(context.Background(), &pb.SeekRequest{
+		Subscription: sub.Name,
+		Target:       &pb.SeekRequest_Time{Time: ts},
+	})
 	if err != nil {
-		t.Fatal(err)
-	}
-	if err := spc.Send(&pb.StreamingPullRequest{Subscription: sub.Name}); err != nil {
-		t.Fatal(err)
+		t.Errorf("Seeking: %v", err)
 	}
-	return spc
 }
 
-func pullN(
-	ctx context.Context,
-	t *testing.T,
-	n int,
-	sc pb.SubscriberClient,
-	sub *pb.Subscription,
-) map[string]*pb.ReceivedMessage {
-	got := map[string]*pb.ReceivedMessage{}
-	for i := 0; len(got) < n; i++ {
-		res, err := sc.Pull(
-			ctx,
-			&pb.PullRequest{Subscription: sub.Name, MaxMessages: int32(n - len(got))},
-		)
+func TestPublishAt(t *testing.T) {
+	pclient, sclient, srv, cleanup := newFake(context.TODO(), t)
+	defer cleanup()
+
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	// Older than the ten minutes the fake keeps undelivered messages, which
+	// only counts from when they reach the subscription.
+	now := time.Now()
+	oldTime := now.Add(-time.Hour)
+	oldID := srv.PublishAt(top.Name, []byte("old"), nil, oldTime)
+	newID := srv.Publish(top.Name, []byte("new"), nil)
+
+	if got := srv.Message(oldID).PublishTime; !got.Equal(oldTime) {
+		t.Errorf("got publish time %v, want %v", got, oldTime)
+	}
+
+	seek := func(target time.Time) {
+		_, err := sclient.Seek(context.Background(), &pb.SeekRequest{
+			Subscription: sub.Name,
+			Target:       &pb.SeekRequest_Time{Time: timestamppb.New(target)},
+		})
 		if err != nil {
-			t.Fatal(err)
-		}
-		for _, m := range res.ReceivedMessages {
-			got[m.Message.MessageId] = m
+			t.Fatalf("Seeking: %v", err)
 		}
 	}
-	return got
-}
-
-func streamingPullN(
-	ctx context.Context,
-	t *testing.T,
-	n int,
-	sc pb.SubscriberClient,
-	sub *pb.Subscription,
-) map[string]*pb.ReceivedMessage {
-	spc := mustStartStreamingPull(ctx, t, sc, sub)
-	got := map[string]*pb.ReceivedMessage{}
-	for i := 0; i < n; i++ {
-		res, err := spc.Recv()
+	pulledIDs := func() map[string]bool {
+		res, err := sclient.Pull(context.TODO(),
+			&pb.PullRequest{Subscription: sub.Name, ReturnImmediately: true, MaxMessages: 10})
 		if err != nil {
 			t.Fatal(err)
 		}
-		for _, m := range res.ReceivedMessages {
-			got[m.Message.MessageId] = m
+		ids := map[string]bool{}
+		for _, rm := range res.ReceivedMessages {
+			ids[rm.AckId] = true
+			_, err := sclient.Acknowledge(context.TODO(), &pb.AcknowledgeRequest{
+				Subscription: sub.Name,
+				AckIds:       []string{rm.AckId},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
 		}
+		return ids
 	}
-	if err := spc.CloseSend(); err != nil {
-		t.Fatal(err)
+
+	if got := pulledIDs(); !got[oldID] || !got[newID] {
+		t.Errorf("got %v, want %v and %v", got, oldID, newID)
 	}
-	res, err := spc.Recv()
-	if err != io.EOF {
-		t.Fatalf("Recv returned <%v> instead of EOF; res = %v", err, res)
+	// Seeking between the two messages drops the old one.
+	seek(now.Add(-time.Minute))
+	if got, want := pulledIDs(), map[string]bool{newID: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
 	}
-	return got
-}
-
-func pubsubMessages(rms map[string]*pb.ReceivedMessage) map[string]*pb.PubsubMessage {
-	ms := map[string]*pb.PubsubMessage{}
-	for k, rm := range rms {
-		ms[k] = rm.Message
+	// Seeking to before both brings both back.
+	seek(now.Add(-2 * time.Hour))
+	got := pulledIDs()
+	if !got[oldID] || !got[newID] {
+		t.Errorf("got %v, want %v and %v", got, oldID, newID)
 	}
-	return ms
 }
 
-func mustCreateTopic(
-	ctx context.Context,
-	t *testing.T,
-	pc pb.PublisherClient,
-	topic *pb.Topic,
-) *pb.Topic {
-	top, err := pc.CreateTopic(ctx, topic)
+func TestSeekRedeliversPayload(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	before := time.Now().Add(-time.Minute)
+	id := srv.PublishOrdered(top.Name, []byte("payload"), map[string]string{"a": "b"}, "k")
+	// A message on another topic isn't redelivered to sub.
+	other := srv.Publish("projects/P/topics/T2", []byte("other"), nil)
+	published := pullN(ctx, t, 1, sclient, sub)[id]
+	_, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+		Subscription: sub.Name,
+		AckIds:       []string{published.AckId},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	return top
-}
 
-func mustCreateSubscription(
-	ctx context.Context,
-	t *testing.T,
-	sc pb.SubscriberClient,
-	sub *pb.Subscription,
-) *pb.Subscription {
-	sub, err := sc.CreateSubscription(ctx, sub)
+	_, err = sclient.Seek(ctx, &pb.SeekRequest{
+		Subscription: sub.Name,
+		Target:       &pb.SeekRequest_Time{Time: timestamppb.New(before)},
+	})
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("Seeking: %v", err)
+	}
+	redelivered := pullN(ctx, t, 1, sclient, sub)[id]
+	if redelivered == nil {
+		t.Fatalf("%s wasn't redelivered", id)
+	}
+	if !proto.Equal(redelivered.Message, published.Message) {
+		t.Errorf("got redelivered message %v, want %v", redelivered.Message, published.Message)
+	}
+
+	srv.GServer.mu.Lock()
+	_, leaked := srv.GServer.subs[sub.Name].msgs[other]
+	n := len(srv.GServer.subs[sub.Name].msgs)
+	srv.GServer.mu.Unlock()
+	if leaked || n != 1 {
+		t.Errorf("got %d messages on the subscription after seeking, want just %s", n, id)
+	}
+}
+
+func TestSeekRetentionWindow(t *testing.T) {
+	pclient, sclient, _, cleanup := newFake(context.TODO(), t)
+	defer cleanup()
+
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
+		Name:                     "projects/P/subscriptions/S",
+		Topic:                    top.Name,
+		AckDeadlineSeconds:       10,
+		MessageRetentionDuration: durationpb.New(10 * time.Minute),
+	})
+	seek := func(target time.Time) error {
+		_, err := sclient.Seek(context.Background(), &pb.SeekRequest{
+			Subscription: sub.Name,
+			Target:       &pb.SeekRequest_Time{Time: timestamppb.New(target)},
+		})
+		return err
+	}
+
+	if err := seek(time.Now().Add(-5 * time.Minute)); err != nil {
+		t.Errorf("Seeking within the retention window: %v", err)
+	}
+	err := seek(time.Now().Add(-20 * time.Minute))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v seeking before the retention window, want InvalidArgument", err)
+	}
+}
+
+func TestTryDeliverMessage(t *testing.T) {
+	for _, test := range []struct {
+		availStreamIdx int
+		expectedOutIdx int
+	}{
+		{availStreamIdx: 0, expectedOutIdx: 0},
+		// Stream 1 will always be marked for deletion.
+		{availStreamIdx: 2, expectedOutIdx: 1}, // s0, s1 (deleted), s2, s3 becomes s0, s2, s3. So we expect outIdx=1.
+		{availStreamIdx: 3, expectedOutIdx: 2}, // s0, s1 (deleted), s2, s3 becomes s0, s2, s3. So we expect outIdx=2.
+	} {
+		top := newTopic(&pb.Topic{Name: "some-topic"})
+		sub := newSubscription(
+			top,
+			&sync.Mutex{},
+			time.Now,
+			&pb.Subscription{Name: "some-sub", Topic: "some-topic"},
+		)
+
+		done := make(chan struct{}, 1)
+		done <- struct{}{}
+		sub.streams = []*stream{{}, {done: done}, {}, {}}
+
+		msgc := make(chan *pb.ReceivedMessage, 1)
+		sub.streams[test.availStreamIdx].msgc = msgc
+
+		var d int
+		idx, ok := sub.tryDeliverMessage(&message{deliveries: &d}, 0, time.Now())
+		if !ok {
+			t.Fatalf(
+				"[avail=%d]: expected msg to be put on stream %d's channel, but it was not",
+				test.availStreamIdx,
+				test.expectedOutIdx,
+			)
+		}
+		if idx != test.expectedOutIdx {
+			t.Fatalf(
+				"[avail=%d]: expected msg to be put on stream %d, but it was put on %d",
+				test.availStreamIdx,
+				test.expectedOutIdx,
+				idx,
+			)
+		}
+		select {
+		case <-msgc:
+		default:
+			t.Fatalf(
+				"[avail=%d]: expected msg to be put on stream %d's channel, but it was not",
+				test.availStreamIdx,
+				idx,
+			)
+		}
+	}
+}
+
+func TestTimeNowFunc(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	timeFunc := func() time.Time {
+		t, _ := time.Parse(time.RFC3339, "2006-01-02T15:04:05Z")
+		return t
+	}
+	s.SetTimeNowFunc(timeFunc)
+
+	id := s.Publish("projects/p/topics/t", []byte("hello"), nil)
+	s.Wait()
+
+	m := s.Message(id)
+	if m == nil {
+		t.Fatalf("got nil, want a message")
+	}
+	if got, want := m.PublishTime, timeFunc(); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestModAck_Race(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, server, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+
+	publish(t, pclient, top, []*pb.PubsubMessage{
+		{Data: []byte("d1")},
+		{Data: []byte("d2")},
+		{Data: []byte("d3")},
+	})
+	msgs := streamingPullN(ctx, t, 3, sclient, sub)
+	var ackIDs []string
+	for _, m := range msgs {
+		ackIDs = append(ackIDs, m.AckId)
+	}
+
+	// Try to access m.Modacks while simultaneously calling ModifyAckDeadline
+	// so as to try and create a race condition.
+	// Invoke ModifyAckDeadline from the server rather than the client
+	// to increase replicability of simultaneous data access.
+	go func() {
+		req := &pb.ModifyAckDeadlineRequest{
+			Subscription:       sub.Name,
+			AckIds:             ackIDs,
+			AckDeadlineSeconds: 0,
+		}
+		server.GServer.ModifyAckDeadline(ctx, req)
+	}()
+
+	sm := server.Messages()
+	for _, m := range sm {
+		t.Logf("got modacks: %v\n", m.Modacks)
+	}
+}
+
+func TestUpdateDeadLetterPolicy(t *testing.T) {
+	pclient, sclient, _, cleanup := newFake(context.TODO(), t)
+	defer cleanup()
+
+	top := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	deadTop := mustCreateTopic(context.TODO(), t, pclient, &pb.Topic{Name: "projects/P/topics/TD"})
+	sub := mustCreateSubscription(context.TODO(), t, sclient, &pb.Subscription{
+		AckDeadlineSeconds: minAckDeadlineSecs,
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		DeadLetterPolicy: &pb.DeadLetterPolicy{
+			DeadLetterTopic:     deadTop.Name,
+			MaxDeliveryAttempts: 5,
+		},
+	})
+
+	update := &pb.Subscription{
+		AckDeadlineSeconds: sub.AckDeadlineSeconds,
+		Name:               sub.Name,
+		Topic:              top.Name,
+		DeadLetterPolicy: &pb.DeadLetterPolicy{
+			DeadLetterTopic: deadTop.Name,
+			// update max delivery attempts
+			MaxDeliveryAttempts: 10,
+		},
+	}
+
+	updated := mustUpdateSubscription(context.TODO(), t, sclient, &pb.UpdateSubscriptionRequest{
+		Subscription: update,
+		UpdateMask:   &field_mask.FieldMask{Paths: []string{"dead_letter_policy"}},
+	})
+
+	if got, want := updated.DeadLetterPolicy.MaxDeliveryAttempts, update.DeadLetterPolicy.MaxDeliveryAttempts; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestUpdateRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, _, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		AckDeadlineSeconds: minAckDeadlineSecs,
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		RetryPolicy: &pb.RetryPolicy{
+			MinimumBackoff: durationpb.New(10 * time.Second),
+			MaximumBackoff: durationpb.New(60 * time.Second),
+		},
+	})
+
+	update := &pb.Subscription{
+		AckDeadlineSeconds: sub.AckDeadlineSeconds,
+		Name:               sub.Name,
+		Topic:              top.Name,
+		RetryPolicy: &pb.RetryPolicy{
+			MinimumBackoff: durationpb.New(20 * time.Second),
+			MaximumBackoff: durationpb.New(100 * time.Second),
+		},
+	}
+
+	updated := mustUpdateSubscription(ctx, t, sclient, &pb.UpdateSubscriptionRequest{
+		Subscription: update,
+		UpdateMask:   &field_mask.FieldMask{Paths: []string{"retry_policy"}},
+	})
+
+	if got, want := updated.RetryPolicy, update.RetryPolicy; testutil.Diff(got, want) != "" {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestUpdateFilter(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		AckDeadlineSeconds: minAckDeadlineSecs,
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		Filter:             `attributes:kind`,
+	})
+
+	update := &pb.Subscription{
+		AckDeadlineSeconds: sub.AckDeadlineSeconds,
+		Name:               sub.Name,
+		Topic:              top.Name,
+		Filter:             `attributes.kind = "video"`,
+	}
+
+	updated := mustUpdateSubscription(ctx, t, sclient, &pb.UpdateSubscriptionRequest{
+		Subscription: update,
+		UpdateMask:   &field_mask.FieldMask{Paths: []string{"filter"}},
+	})
+
+	if got, want := updated.Filter, update.Filter; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// The stored configuration reflects the update too.
+	config := srv.SubscriptionConfig(sub.Name)
+	if got, want := config.Filter, update.Filter; got != want {
+		t.Errorf("got config filter %v, want %v", got, want)
+	}
+	if got, want := srv.TopicConfig(top.Name).Name, top.Name; got != want {
+		t.Errorf("got topic %v, want %v", got, want)
+	}
+	// Changing the copy doesn't change the server's configuration.
+	config.Filter = "changed"
+	if got, want := srv.SubscriptionConfig(sub.Name).Filter, update.Filter; got != want {
+		t.Errorf("got config filter %v after changing the copy, want %v", got, want)
+	}
+	if srv.SubscriptionConfig("projects/P/subscriptions/missing") != nil {
+		t.Errorf("got a config for a missing subscription, want nil")
+	}
+	// An invalid filter is rejected, and leaves the filter unchanged.
+	_, err := sclient.UpdateSubscription(ctx, &pb.UpdateSubscriptionRequest{
+		Subscription: &pb.Subscription{Name: sub.Name, Filter: "new-filter"},
+		UpdateMask:   &field_mask.FieldMask{Paths: []string{"filter"}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("updating to an invalid filter: got %v, want InvalidArgument", err)
+	}
+	if got, want := srv.SubscriptionConfig(sub.Name).Filter, update.Filter; got != want {
+		t.Errorf("got config filter %v after an invalid update, want %v", got, want)
+	}
+}
+
+func mustStartStreamingPull(
+	ctx context.Context,
+	t *testing.T,
+	sc pb.SubscriberClient,
+	sub *pb.Subscription,
+) pb.Subscriber_StreamingPullClient {
+	spc, err := sc.StreamingPull(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spc.Send(&pb.StreamingPullRequest{Subscription: sub.Name}); err != nil {
+		t.Fatal(err)
+	}
+	return spc
+}
+
+func pullN(
+	ctx context.Context,
+	t *testing.T,
+	n int,
+	sc pb.SubscriberClient,
+	sub *pb.Subscription,
+) map[string]*pb.ReceivedMessage {
+	got := map[string]*pb.ReceivedMessage{}
+	for i := 0; len(got) < n; i++ {
+		res, err := sc.Pull(
+			ctx,
+			&pb.PullRequest{Subscription: sub.Name, MaxMessages: int32(n - len(got))},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range res.ReceivedMessages {
+			got[m.Message.MessageId] = m
+		}
+	}
+	return got
+}
+
+func streamingPullN(
+	ctx context.Context,
+	t *testing.T,
+	n int,
+	sc pb.SubscriberClient,
+	sub *pb.Subscription,
+) map[string]*pb.ReceivedMessage {
+	spc := mustStartStreamingPull(ctx, t, sc, sub)
+	got := map[string]*pb.ReceivedMessage{}
+	for i := 0; i < n; i++ {
+		res, err := spc.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range res.ReceivedMessages {
+			got[m.Message.MessageId] = m
+		}
+	}
+	if err := spc.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := spc.Recv()
+	if err != io.EOF {
+		t.Fatalf("Recv returned <%v> instead of EOF; res = %v", err, res)
+	}
+	return got
+}
+
+func pubsubMessages(rms map[string]*pb.ReceivedMessage) map[string]*pb.PubsubMessage {
+	ms := map[string]*pb.PubsubMessage{}
+	for k, rm := range rms {
+		ms[k] = rm.Message
+	}
+	return ms
+}
+
+func mustCreateTopic(
+	ctx context.Context,
+	t *testing.T,
+	pc pb.PublisherClient,
+	topic *pb.Topic,
+) *pb.Topic {
+	top, err := pc.CreateTopic(ctx, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return top
+}
+
+func mustCreateSubscription(
+	ctx context.Context,
+	t *testing.T,
+	sc pb.SubscriberClient,
+	sub *pb.Subscription,
+) *pb.Subscription {
+	sub, err := sc.CreateSubscription(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func mustUpdateSubscription(
+	ctx context.Context,
+	t *testing.T,
+	sc pb.SubscriberClient,
+	req *pb.UpdateSubscriptionRequest,
+) *pb.Subscription {
+	sub, err := sc.UpdateSubscription(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+// newFake creates a new fake server along  with a publisher and subscriber
+// client. Its final return is a cleanup function.
+//
+// Note: be sure to call cleanup!
+func newFake(
+	ctx context.Context,
+	t *testing.T,
+	opts ...ServerReactorOption,
+) (pb.PublisherClient, pb.SubscriberClient, *Server, func()) {
+	srv := NewServer(opts...)
+	conn, err := grpc.DialContext(ctx, srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pb.NewPublisherClient(conn), pb.NewSubscriberClient(conn), srv, func() {
+		srv.Close()
+		conn.Close()
+	}
+}
+
+func TestErrorInjection(t *testing.T) {
+	testcases := []struct {
+		funcName string
+		param    interface{}
+		code     codes.Code
+	}{
+		{
+			funcName: "CreateTopic",
+			code:     codes.Internal,
+		},
+		{
+			funcName: "GetTopic",
+			code:     codes.Aborted,
+		},
+		{
+			funcName: "UpdateTopic",
+			code:     codes.DeadlineExceeded,
+		},
+		{
+			funcName: "ListTopics",
+		},
+		{
+			funcName: "ListTopicSubscriptions",
+		},
+		{
+			funcName: "DeleteTopic",
+		},
+		{
+			funcName: "CreateSubscription",
+		},
+		{
+			funcName: "GetSubscription",
+		},
+		{
+			funcName: "UpdateSubscription",
+			param:    &pb.UpdateSubscriptionRequest{Subscription: &pb.Subscription{}},
+		},
+		{
+			funcName: "ListSubscriptions",
+		},
+		{
+			funcName: "DeleteSubscription",
+		},
+		{
+			funcName: "DetachSubscription",
+		},
+		{
+			funcName: "Publish",
+		},
+		{
+			funcName: "Acknowledge",
+		},
+		{
+			funcName: "ModifyAckDeadline",
+		},
+		{
+			funcName: "Pull",
+		},
+		{
+			funcName: "Seek",
+			param:    &pb.SeekRequest{Target: &pb.SeekRequest_Time{Time: timestamppb.Now()}},
+		},
+	}
+
+	for _, tc := range testcases {
+		ctx := context.TODO()
+		errMsg := "error-injection-" + tc.funcName
+		// set error code to unknown unless specified
+		ec := codes.Unknown
+		if tc.code != codes.OK {
+			ec = tc.code
+		}
+		opts := []ServerReactorOption{
+			WithErrorInjection(tc.funcName, ec, errMsg),
+		}
+		_, _, server, cleanup := newFake(ctx, t, opts...)
+		defer cleanup()
+
+		// We used reflection here to blindly look up the function by name and pass
+		// context and a typed nil, as all the functions under test will have such
+		// a function signature.
+		f := reflect.ValueOf(&server.GServer).MethodByName(tc.funcName)
+		if !f.IsValid() {
+			t.Fatalf("Method %v Not Found", tc.funcName)
+		}
+		// If param is provided, use the param, otherwise create a typed nil that matches the
+		// parameter type.
+		var req reflect.Value
+		if tc.param != nil {
+			req = reflect.ValueOf(tc.param)
+		} else {
+			req = reflect.New(f.Type().In(1).Elem())
+		}
+		ret := reflect.ValueOf(&server.GServer).
+			MethodByName(tc.funcName).
+			Call([]reflect.Value{reflect.ValueOf(ctx), req})
+
+		got := ret[1].Interface().(error)
+		if got == nil || status.Code(got) != ec || !strings.Contains(got.Error(), errMsg) {
+			t.Errorf("Got error does not contain the right key %v", got)
+		}
+	}
+}
+
+// cancelledReactor fails RPCs whose context has been cancelled.
+type cancelledReactor struct{}
+
+func (cancelledReactor) React(_ interface{}) (handled bool, ret interface{}, err error) {
+	return false, nil, nil
+}
+
+func (cancelledReactor) ReactContext(
+	ctx context.Context,
+	_ interface{},
+) (handled bool, ret interface{}, err error) {
+	if ctx.Err() != nil {
+		return true, nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return false, nil, nil
+}
+
+func TestContextReactor(t *testing.T) {
+	ctx := context.Background()
+	_, _, server, cleanup := newFake(ctx, t,
+		ServerReactorOption{FuncName: "CreateTopic", Reactor: cancelledReactor{}})
+	defer cleanup()
+
+	if _, err := server.GServer.CreateTopic(ctx, &pb.Topic{Name: "projects/P/topics/T"}); err != nil {
+		t.Errorf("got %v with a live context, want no error", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := server.GServer.CreateTopic(cancelled, &pb.Topic{Name: "projects/P/topics/T2"})
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("got %v with a cancelled context, want Canceled", err)
+	}
+}
+
+func TestRequireOrderedDelivery(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	for i := 0; i < 12; i++ {
+		key := "k"
+		if i%3 == 0 {
+			key = "other"
+		}
+		srv.PublishOrdered(top.Name, []byte(fmt.Sprint(i)), nil, key)
+	}
+
+	rec := &recordingTB{}
+	RequireOrderedDelivery(rec, srv, sub.Name, "k", 8)
+	if len(rec.errors) != 0 {
+		t.Errorf("got errors %q for an in-order delivery, want none", rec.errors)
+	}
+	rec = &recordingTB{}
+	RequireOrderedDelivery(rec, srv, sub.Name, "other", 4)
+	if len(rec.errors) != 0 {
+		t.Errorf("got errors %q for the other key, want none", rec.errors)
+	}
+}
+
+// reversingReactor answers the first Pull with msgs in reverse order, and
+// later ones with nothing.
+type reversingReactor struct {
+	msgs   []*pb.ReceivedMessage
+	pulled bool
+}
+
+func (r *reversingReactor) React(_ interface{}) (handled bool, ret interface{}, err error) {
+	res := &pb.PullResponse{}
+	if !r.pulled {
+		r.pulled = true
+		for i := len(r.msgs) - 1; i >= 0; i-- {
+			res.ReceivedMessages = append(res.ReceivedMessages, r.msgs[i])
+		}
+	}
+	return true, res, nil
+}
+
+func TestRequireOrderedDeliveryReordered(t *testing.T) {
+	ctx := context.Background()
+	reactor := &reversingReactor{}
+	pclient, sclient, srv, cleanup := newFake(ctx, t,
+		ServerReactorOption{FuncName: "Pull", Reactor: reactor})
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	for i := 0; i < 3; i++ {
+		id := srv.PublishOrdered(top.Name, []byte(fmt.Sprint(i)), nil, "k")
+		reactor.msgs = append(reactor.msgs, &pb.ReceivedMessage{
+			AckId:   id,
+			Message: &pb.PubsubMessage{MessageId: id, OrderingKey: "k"},
+		})
+	}
+
+	rec := &recordingTB{}
+	RequireOrderedDelivery(rec, srv, sub.Name, "k", 3)
+	if len(rec.errors) != 1 {
+		t.Fatalf("got errors %q for a reordered delivery, want 1", rec.errors)
+	}
+	for _, want := range []string{"m1 was delivered after m2", "m0 was delivered after m1"} {
+		if !strings.Contains(rec.errors[0], want) {
+			t.Errorf("got error %q, want it to mention %q", rec.errors[0], want)
+		}
+	}
+}
+
+func TestMaxRetainedMessages(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t, WithMaxRetainedMessages(3))
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, srv.Publish(top.Name, []byte(fmt.Sprint(i)), nil))
+	}
+
+	var got []string
+	for _, m := range srv.Messages() {
+		got = append(got, m.ID)
+	}
+	if diff := testutil.Diff(got, ids[2:]); diff != "" {
+		t.Errorf("got messages %v, want the latest 3: %s", got, diff)
+	}
+	if m := srv.Message(ids[0]); m != nil {
+		t.Errorf("got %v for a pruned message, want nil", m)
+	}
+
+	// The subscription still has all the messages, and nacking a pruned
+	// one is harmless.
+	msgs := pullN(ctx, t, 5, sclient, sub)
+	_, err := sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+		Subscription: sub.Name,
+		AckIds:       []string{msgs[ids[0]].AckId},
+	})
+	if err != nil {
+		t.Errorf("nacking a pruned message: %v", err)
+	}
+}
+
+func batchOf(n int) []*pb.PubsubMessage {
+	msgs := make([]*pb.PubsubMessage, n)
+	for i := range msgs {
+		msgs[i] = &pb.PubsubMessage{Data: []byte(fmt.Sprint(i))}
+	}
+	return msgs
+}
+
+func TestPublishBatch(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	const n = 10000
+	ids := srv.PublishBatch(top.Name, batchOf(n))
+	if len(ids) != n {
+		t.Fatalf("got %d IDs, want %d", len(ids), n)
+	}
+
+	got := pullN(ctx, t, n, sclient, sub)
+	for _, id := range ids {
+		if got[id] == nil {
+			t.Fatalf("message %s wasn't pulled", id)
+		}
+	}
+}
+
+func TestPublishLimits(t *testing.T) {
+	ctx := context.Background()
+	pclient, _, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	publishReq := func(msgs ...*pb.PubsubMessage) error {
+		// Call the server directly, since the messages can be bigger than
+		// gRPC allows by default.
+		_, err := srv.GServer.Publish(ctx, &pb.PublishRequest{Topic: top.Name, Messages: msgs})
+		return err
+	}
+
+	const maxBytes = 10 * 1000 * 1000
+	if err := publishReq(&pb.PubsubMessage{Data: make([]byte, maxBytes)}); err != nil {
+		t.Errorf("publishing a 10MB message: %v", err)
+	}
+	err := publishReq(&pb.PubsubMessage{
+		Data:       make([]byte, maxBytes-1),
+		Attributes: map[string]string{"k": "v"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("publishing a message with more than 10MB of data and attributes: got %v, want InvalidArgument", err)
+	}
+	if err := publishReq(batchOf(1000)...); err != nil {
+		t.Errorf("publishing 1000 messages: %v", err)
+	}
+	if err := publishReq(batchOf(1001)...); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("publishing 1001 messages: got %v, want InvalidArgument", err)
+	}
+	// PublishBatch isn't bound by the limits.
+	if got := len(srv.PublishBatch(top.Name, batchOf(1001))); got != 1001 {
+		t.Errorf("PublishBatch published %d messages, want 1001", got)
+	}
+
+	srv.SetPublishLimits(5, 2)
+	if err := publishReq(&pb.PubsubMessage{Data: []byte("123456")}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("publishing 6 bytes with a limit of 5: got %v, want InvalidArgument", err)
+	}
+	if err := publishReq(batchOf(3)...); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("publishing 3 messages with a limit of 2: got %v, want InvalidArgument", err)
+	}
+	if err := publishReq(&pb.PubsubMessage{Data: []byte("12345")}); err != nil {
+		t.Errorf("publishing 5 bytes with a limit of 5: %v", err)
+	}
+	srv.SetPublishLimits(0, 0)
+	if err := publishReq(batchOf(1000)...); err != nil {
+		t.Errorf("publishing 1000 messages after restoring the limits: %v", err)
+	}
+}
+
+func BenchmarkPublishBatch(b *testing.B) {
+	srv := NewServer()
+	defer srv.Close()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		msgs := batchOf(10000)
+		b.StartTimer()
+		srv.PublishBatch("projects/P/topics/T", msgs)
+	}
+}
+
+func TestDeliveryDelay(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t, WithDeliveryDelay(time.Minute))
+	defer cleanup()
+
+	var mu sync.Mutex
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.SetTimeNowFunc(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	})
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+
+	pull := func() []*pb.ReceivedMessage {
+		res, err := srv.GServer.Pull(ctx, &pb.PullRequest{
+			Subscription:      sub.Name,
+			ReturnImmediately: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.ReceivedMessages
+	}
+	if got := pull(); len(got) != 0 {
+		t.Errorf("got %v just after publishing, want nothing", got)
+	}
+
+	mu.Lock()
+	clock = clock.Add(time.Minute)
+	mu.Unlock()
+	got := pull()
+	if len(got) != 1 || got[0].Message.MessageId != id {
+		t.Errorf("got %v after the delay, want %s", got, id)
+	}
+}
+
+func TestAckStats(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	for i := 0; i < 5; i++ {
+		srv.Publish(top.Name, []byte(fmt.Sprint(i)), nil)
+	}
+	var ackIDs []string
+	for _, m := range pullN(ctx, t, 5, sclient, sub) {
+		ackIDs = append(ackIDs, m.AckId)
+	}
+
+	// Ack two, nack two (one of them twice), and leave one outstanding.
+	_, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+		Subscription: sub.Name,
+		AckIds:       ackIDs[:2],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+		Subscription: sub.Name,
+		AckIds:       []string{ackIDs[2], ackIDs[3], ackIDs[3]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Acking an acked message doesn't count.
+	_, err = sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+		Subscription: sub.Name,
+		AckIds:       ackIDs[:1],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acked, nacked, outstanding := srv.AckStats(sub.Name)
+	if acked != 2 || nacked != 3 || outstanding != 1 {
+		t.Errorf("got (acked, nacked, outstanding) = (%d, %d, %d), want (2, 3, 1)",
+			acked, nacked, outstanding)
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+	pullN(ctx, t, 1, sclient, sub)
+
+	pull := func() []*pb.ReceivedMessage {
+		res, err := srv.GServer.Pull(ctx, &pb.PullRequest{
+			Subscription:      sub.Name,
+			ReturnImmediately: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.ReceivedMessages
+	}
+	if got := pull(); len(got) != 0 {
+		t.Fatalf("got %v while the message is outstanding, want nothing", got)
+	}
+	if err := srv.Redeliver(sub.Name, id); err != nil {
+		t.Fatal(err)
+	}
+	if got := pull(); len(got) != 1 || got[0].Message.MessageId != id {
+		t.Errorf("got %v after Redeliver, want %s", got, id)
+	}
+	if got := srv.Message(id).Deliveries; got != 2 {
+		t.Errorf("got %d deliveries, want 2", got)
+	}
+
+	if err := srv.Redeliver(sub.Name, "nope"); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v redelivering an unknown message, want NotFound", err)
+	}
+}
+
+func TestSetPullWait(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	emptyPull := func() time.Duration {
+		start := time.Now()
+		_, err := srv.GServer.Pull(ctx, &pb.PullRequest{Subscription: sub.Name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	srv.SetPullWait(10 * time.Millisecond)
+	if got := emptyPull(); got < 10*time.Millisecond || got > 250*time.Millisecond {
+		t.Errorf("empty pull took %v with a 10ms wait", got)
+	}
+	srv.SetPullWait(0)
+	if got := emptyPull(); got > 50*time.Millisecond {
+		t.Errorf("empty pull took %v with no wait", got)
+	}
+}
+
+func TestPullWakesOnPublish(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	srv.SetPullWait(time.Minute)
+
+	// A waiting Pull returns as soon as a message is published, rather
+	// than at the end of its wait.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.Publish(top.Name, []byte("d1"), nil)
+	}()
+	start := time.Now()
+	res, err := srv.GServer.Pull(ctx, &pb.PullRequest{Subscription: sub.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(res.ReceivedMessages); got != 1 {
+		t.Errorf("got %d messages, want 1", got)
+	}
+	if got := time.Since(start); got > 5*time.Second {
+		t.Errorf("pull took %v, want it to return when the message was published", got)
+	}
+
+	// A waiting Pull returns when its context is canceled.
+	goroutines := runtime.NumGoroutine()
+	cctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := srv.GServer.Pull(cctx, &pb.PullRequest{Subscription: sub.Name})
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("got %v from a canceled pull, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pull didn't return when its context was canceled")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("got %d goroutines after the pull was canceled, want at most %d", n, goroutines)
+	}
+}
+
+func TestNumUndeliveredMessages(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	if got := srv.NumUndeliveredMessages(sub.Name); got != 0 {
+		t.Errorf("got %d undelivered messages before publishing, want 0", got)
+	}
+	for i := 0; i < 3; i++ {
+		srv.Publish(top.Name, []byte(fmt.Sprint(i)), nil)
+	}
+	if got := srv.NumUndeliveredMessages(sub.Name); got != 3 {
+		t.Errorf("got %d undelivered messages, want 3", got)
+	}
+
+	// Pulled but unacked messages still count.
+	msgs := pullN(ctx, t, 2, sclient, sub)
+	if got := srv.NumUndeliveredMessages(sub.Name); got != 3 {
+		t.Errorf("got %d undelivered messages after pulling, want 3", got)
+	}
+	for _, m := range msgs {
+		_, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+			Subscription: sub.Name,
+			AckIds:       []string{m.AckId},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.NumUndeliveredMessages(sub.Name); got != 1 {
+		t.Errorf("got %d undelivered messages after acking 2, want 1", got)
+	}
+}
+
+func TestMessagesSorted(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.PublishAt("projects/p/topics/t", []byte("late"), nil, base.Add(time.Second))
+	s.PublishAt("projects/p/topics/t", []byte("early"), nil, base)
+	s.PublishAt("projects/p/topics/u", []byte("early too"), nil, base)
+	m := s.Message("m0")
+	m.modacks = []Modack{{AckID: "m0", ReceivedAt: base.Add(2)}, {AckID: "m0", ReceivedAt: base.Add(1)}}
+
+	want := []string{"m1", "m2", "m0"}
+	for run := 0; run < 5; run++ {
+		var got []string
+		for _, m := range s.MessagesSorted() {
+			got = append(got, m.ID)
+		}
+		if diff := testutil.Diff(got, want); diff != "" {
+			t.Fatalf("run %d: got %v: %s", run, got, diff)
+		}
+	}
+	modacks := s.MessagesSorted()[2].Modacks
+	if !modacks[0].ReceivedAt.Before(modacks[1].ReceivedAt) {
+		t.Errorf("got modacks %v, want them sorted by ReceivedAt", modacks)
+	}
+	if got := s.Messages()[0].ID; got != "m0" {
+		t.Errorf("got %s first from Messages, want it to stay in publish order", got)
+	}
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	var want []string
+	for i := 0; i < 5; i++ {
+		want = append(want, srv.PublishOrdered(top.Name, []byte(fmt.Sprint(i)), nil, "k"))
+	}
+	streamingPullN(ctx, t, 5, sclient, sub)
+
+	if diff := testutil.Diff(srv.DeliveryOrder(sub.Name), want); diff != "" {
+		t.Errorf("got delivery order %v, want publish order: %s",
+			srv.DeliveryOrder(sub.Name), diff)
+	}
+}
+
+func TestWaitForAck(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := srv.WaitForAck(short, sub.Name, id); err != context.DeadlineExceeded {
+		t.Errorf("got %v waiting for an unacked message, want DeadlineExceeded", err)
+	}
+	srv.GServer.mu.Lock()
+	waiters := len(srv.GServer.subs[sub.Name].ackWaiters)
+	srv.GServer.mu.Unlock()
+	if waiters != 0 {
+		t.Errorf("got %d messages with waiters after the wait timed out, want 0", waiters)
+	}
+	if err := srv.WaitForAck(ctx, sub.Name, "nope"); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v waiting for an unknown message, want NotFound", err)
+	}
+
+	// A consumer acks the message in the background.
+	ackID := pullN(ctx, t, 1, sclient, sub)[id].AckId
+	ackErr := make(chan error, 1)
+	go func() {
+		_, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+			Subscription: sub.Name,
+			AckIds:       []string{ackID},
+		})
+		ackErr <- err
+	}()
+	long, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := srv.WaitForAck(long, sub.Name, id); err != nil {
+		t.Errorf("got %v waiting for the consumer's ack", err)
+	}
+	if err := <-ackErr; err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.WaitForAck(ctx, sub.Name, id); err != nil {
+		t.Errorf("got %v waiting for an acked message", err)
+	}
+}
+
+func TestWaitForAckDropped(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	long, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	for _, test := range []struct {
+		desc string
+		drop func()
+	}{
+		{"ClearSubscription", func() { srv.ClearSubscription(sub.Name) }},
+		{"DeleteSubscription", func() {
+			_, err := sclient.DeleteSubscription(ctx,
+				&pb.DeleteSubscriptionRequest{Subscription: sub.Name})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		id := srv.Publish(top.Name, []byte(test.desc), nil)
+		waitErr := make(chan error, 1)
+		go func() { waitErr <- srv.WaitForAck(long, sub.Name, id) }()
+		// Wait for the waiter to register before dropping the message.
+		for {
+			srv.GServer.mu.Lock()
+			n := len(srv.GServer.subs[sub.Name].ackWaiters[id])
+			srv.GServer.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		test.drop()
+		if err := <-waitErr; status.Code(err) != codes.Aborted {
+			t.Errorf("%s: got %v, want Aborted", test.desc, err)
+		}
+	}
+}
+
+func TestFailDelivery(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.SetTimeNowFunc(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	})
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+	srv.FailDelivery(id, 1)
+
+	pull := func() []*pb.ReceivedMessage {
+		res, err := srv.GServer.Pull(ctx, &pb.PullRequest{
+			Subscription:      sub.Name,
+			ReturnImmediately: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.ReceivedMessages
+	}
+	if got := pull(); len(got) != 0 {
+		t.Errorf("got %v from a lost delivery, want nothing", got)
+	}
+	if got := pull(); len(got) != 0 {
+		t.Errorf("got %v before the deadline expired, want nothing", got)
+	}
+
+	mu.Lock()
+	clock = clock.Add(11 * time.Second)
+	mu.Unlock()
+	if got := pull(); len(got) != 1 || got[0].Message.MessageId != id {
+		t.Errorf("got %v after the deadline expired, want %s", got, id)
+	}
+	if got := srv.Message(id).Deliveries; got != 2 {
+		t.Errorf("got %d deliveries, want 2", got)
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+
+	dump := srv.DumpState()
+	for _, want := range []string{
+		"  " + top.Name + "\n",
+		"  " + sub.Name + " (topic " + top.Name,
+		"    " + id + " available\n",
+		"  " + id + " on " + top.Name,
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("got dump\n%s\nwant it to contain %q", dump, want)
+		}
+	}
+}
+
+func TestSubscriptionsForTopic(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	other := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/U"})
+	for _, s := range []struct{ name, topic string }{
+		{"projects/P/subscriptions/S2", top.Name},
+		{"projects/P/subscriptions/S1", top.Name},
+		{"projects/P/subscriptions/S3", other.Name},
+	} {
+		mustCreateSubscription(ctx, t, sclient, &pb.Subscription{Name: s.name, Topic: s.topic})
+	}
+
+	subs := srv.SubscriptionsForTopic(top.Name)
+	var got []string
+	for _, sub := range subs {
+		got = append(got, sub.Name)
+	}
+	want := []string{"projects/P/subscriptions/S1", "projects/P/subscriptions/S2"}
+	if diff := testutil.Diff(got, want); diff != "" {
+		t.Errorf("got subscriptions %v: %s", got, diff)
+	}
+
+	// They're copies.
+	subs[0].AckDeadlineSeconds = 99
+	if got := srv.SubscriptionConfig(subs[0].Name).AckDeadlineSeconds; got == 99 {
+		t.Errorf("changing the result changed the server's subscription")
+	}
+	if got := srv.SubscriptionsForTopic("projects/P/topics/none"); got != nil {
+		t.Errorf("got %v for an unknown topic, want nil", got)
+	}
+}
+
+func TestOrderingKeyAffinity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pclient, sclient, srv, cleanup := newFake(ctx, t, WithOrderingKeyAffinity())
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:                  "projects/P/subscriptions/S",
+		Topic:                 top.Name,
+		EnableMessageOrdering: true,
+	})
+	type delivery struct {
+		stream int
+		msg    *pb.PubsubMessage
+	}
+	deliveries := make(chan delivery)
+	const numStreams = 3
+	for i := 0; i < numStreams; i++ {
+		spc := mustStartStreamingPull(ctx, t, sclient, sub)
+		go func(i int) {
+			for {
+				res, err := spc.Recv()
+				if err != nil {
+					return
+				}
+				for _, rm := range res.ReceivedMessages {
+					select {
+					case deliveries <- delivery{i, rm.Message}:
+					case <-ctx.Done():
+						return
+					}
+					// Ordering holds back each key's next message until
+					// this one is acked.
+					_, _ = sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+						Subscription: sub.Name,
+						AckIds:       []string{rm.AckId},
+					})
+				}
+			}
+		}(i)
+	}
+	for len(srv.StreamDeliveryCounts(sub.Name)) < numStreams {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	published := map[string][]string{}
+	for i := 0; i < 30; i++ {
+		key := keys[i%len(keys)]
+		id := srv.PublishOrdered(top.Name, []byte(fmt.Sprint(i)), nil, key)
+		published[key] = append(published[key], id)
+	}
+
+	streamOf := map[string]int{}
+	received := map[string][]string{}
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < 30; i++ {
+		var d delivery
+		select {
+		case d = <-deliveries:
+		case <-timeout:
+			t.Fatalf("got %d deliveries, want 30", i)
+		}
+		key := d.msg.OrderingKey
+		if stream, ok := streamOf[key]; ok && stream != d.stream {
+			t.Errorf("key %s was delivered on streams %d and %d", key, stream, d.stream)
+		}
+		streamOf[key] = d.stream
+		received[key] = append(received[key], d.msg.MessageId)
+	}
+	if diff := testutil.Diff(received, published); diff != "" {
+		t.Errorf("got deliveries by key %v, want publish order: %s", received, diff)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	other := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/U"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	otherSub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S2",
+		Topic: other.Name,
+	})
+	ack := func(ids ...string) {
+		_, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{Subscription: sub.Name, AckIds: ids})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pulledIDs := func() []string {
+		var ids []string
+		for id := range pullN(ctx, t, srv.NumUndeliveredMessages(sub.Name), sclient, sub) {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, srv.Publish(top.Name, []byte(fmt.Sprint(i)), nil))
+	}
+	pulledIDs()
+	ack(ids[0])
+	const name = "projects/P/snapshots/snap"
+	snap, err := sclient.CreateSnapshot(ctx, &pb.CreateSnapshotRequest{Name: name, Subscription: sub.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Topic != top.Name {
+		t.Errorf("got snapshot of topic %s, want %s", snap.Topic, top.Name)
+	}
+	_, err = sclient.CreateSnapshot(ctx, &pb.CreateSnapshotRequest{Name: name, Subscription: sub.Name})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("got %v creating a duplicate snapshot, want AlreadyExists", err)
+	}
+
+	// Seeking to the snapshot restores the messages unacked when it was
+	// taken, and keeps the ones published since.
+	ack(ids[1:]...)
+	ids = append(ids, srv.Publish(top.Name, []byte("3"), nil))
+	_, err = sclient.Seek(ctx, &pb.SeekRequest{
+		Subscription: sub.Name,
+		Target:       &pb.SeekRequest_Snapshot{Snapshot: name},
+	})
+	if err != nil {
+		t.Fatalf("Seeking: %v", err)
+	}
+	if diff := testutil.Diff(pulledIDs(), ids[1:]); diff != "" {
+		t.Errorf("got wrong messages after seeking to the snapshot: %s", diff)
+	}
+
+	_, err = sclient.Seek(ctx, &pb.SeekRequest{
+		Subscription: otherSub.Name,
+		Target:       &pb.SeekRequest_Snapshot{Snapshot: name},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v seeking to another topic's snapshot, want InvalidArgument", err)
+	}
+
+	// The snapshot outlives its topic.
+	if _, err := pclient.DeleteTopic(ctx, &pb.DeleteTopicRequest{Topic: top.Name}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := sclient.GetSnapshot(ctx, &pb.GetSnapshotRequest{Snapshot: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Topic != "_deleted-topic_" {
+		t.Errorf("got topic %q for a deleted topic's snapshot", got.Topic)
+	}
+	list, err := sclient.ListSnapshots(ctx, &pb.ListSnapshotsRequest{Project: "projects/P"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Snapshots) != 1 || list.Snapshots[0].Name != name {
+		t.Errorf("got snapshots %v, want %s", list.Snapshots, name)
+	}
+
+	if _, err := sclient.DeleteSnapshot(ctx, &pb.DeleteSnapshotRequest{Snapshot: name}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = sclient.GetSnapshot(ctx, &pb.GetSnapshotRequest{Snapshot: name})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v getting a deleted snapshot, want NotFound", err)
+	}
+}
+
+func TestHarness(t *testing.T) {
+	ctx := context.Background()
+	goroutines := runtime.NumGoroutine()
+	h, err := NewHarness(ctx, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic, err := h.Client.CreateTopic(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.Client.CreateSubscription(ctx, "s", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := wrapperspb.String("hello")
+	if err := h.PubSubInfo.SendPubSubMessage(ctx, "t", sent); err != nil {
+		t.Fatal(err)
+	}
+	recvCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var got wrapperspb.StringValue
+	err = h.PubSubInfo.Subscribe(recvCtx, "s", func(_ context.Context, msg *pubsub.Message) {
+		if err := proto.Unmarshal(msg.Data, &got); err != nil {
+			t.Error(err)
+		}
+		msg.Ack()
+		cancel()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(&got, sent) {
+		t.Errorf("got %v, want %v", &got, sent)
+	}
+	topic.Stop()
+	h.Close()
+
+	// Give the client's goroutines a moment to exit.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("got %d goroutines after Close, want at most %d", n, goroutines)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.SetTimeNowFunc(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	})
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		clock = clock.Add(d)
+	}
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+		RetryPolicy: &pb.RetryPolicy{
+			MinimumBackoff: durationpb.New(10 * time.Second),
+			MaximumBackoff: durationpb.New(25 * time.Second),
+		},
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+
+	pull := func() bool {
+		res, err := srv.GServer.Pull(ctx, &pb.PullRequest{
+			Subscription:      sub.Name,
+			ReturnImmediately: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res.ReceivedMessages) == 1
+	}
+	nack := func() {
+		_, err := sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+			Subscription: sub.Name,
+			AckIds:       []string{id},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !pull() {
+		t.Fatalf("the message wasn't delivered")
+	}
+	// The backoff doubles from 10s for each delivery, up to 25s.
+	for _, backoff := range []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second} {
+		nack()
+		advance(backoff - time.Second)
+		if pull() {
+			t.Fatalf("the message was redelivered within its %v backoff", backoff)
+		}
+		advance(time.Second)
+		if !pull() {
+			t.Fatalf("the message wasn't redelivered after its %v backoff", backoff)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffPerSubscription(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.SetTimeNowFunc(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	})
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		clock = clock.Add(d)
+	}
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+		RetryPolicy: &pb.RetryPolicy{
+			MinimumBackoff: durationpb.New(10 * time.Second),
+			MaximumBackoff: durationpb.New(600 * time.Second),
+		},
+	})
+	sibling := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/sibling",
+		Topic: top.Name,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+
+	pull := func(sub *pb.Subscription) bool {
+		res, err := srv.GServer.Pull(ctx, &pb.PullRequest{
+			Subscription:      sub.Name,
+			ReturnImmediately: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res.ReceivedMessages) == 1
+	}
+	nack := func(sub *pb.Subscription) {
+		_, err := sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+			Subscription: sub.Name,
+			AckIds:       []string{id},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deliveries to the sibling don't count towards the backoff.
+	for i := 0; i < 3; i++ {
+		if !pull(sibling) {
+			t.Fatalf("the message wasn't delivered to the sibling")
+		}
+		nack(sibling)
+	}
+	if !pull(sub) {
+		t.Fatalf("the message wasn't delivered")
+	}
+	nack(sub)
+	advance(10 * time.Second)
+	if !pull(sub) {
+		t.Errorf("the message wasn't redelivered after the minimum backoff")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	attrs := map[string]string{"lang": "en-US", "kind": "exercise", "empty": ""}
+	for _, test := range []struct {
+		filter string
+		want   bool
+	}{
+		{``, true},
+		{`attributes.lang = "en-US"`, true},
+		{`attributes.lang = "es"`, false},
+		{`attributes.lang != "es"`, true},
+		{`attributes.missing != "es"`, true},
+		{`attributes:empty`, true},
+		{`attributes:missing`, false},
+		{`hasPrefix(attributes.lang, "en")`, true},
+		{`hasPrefix(attributes.missing, "")`, false},
+		{`NOT attributes:missing`, true},
+		{`-attributes:lang`, false},
+		{`attributes.kind = "video" OR attributes.lang = "en-US"`, true},
+		{`attributes.kind = "video" AND attributes.lang = "en-US"`, false},
+		{`attributes:kind AND (attributes.kind = "video" OR hasPrefix(attributes.lang, "en"))`, true},
+		{`attributes:missing OR attributes:kind AND attributes:lang`, true},
+		{`attributes."lang" = "en-US"`, true},
+	} {
+		f, err := parseFilter(test.filter)
+		if err != nil {
+			t.Errorf("parseFilter(%q): %v", test.filter, err)
+			continue
+		}
+		got := f == nil || f(attrs)
+		if got != test.want {
+			t.Errorf("%q matched %v, want %v", test.filter, got, test.want)
+		}
+	}
+
+	for _, filter := range []string{
+		`attributes.lang`,
+		`attributes.lang = en`,
+		`attributes.lang = "en`,
+		`attributes.lang == "en"`,
+		`attributes.lang = "en" AND`,
+		`(attributes:lang`,
+		`hasPrefix(attributes.lang)`,
+		`data = "x"`,
+		`attributes:lang attributes:kind`,
+	} {
+		_, err := parseFilter(filter)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("parseFilter(%q): got %v, want InvalidArgument", filter, err)
+		}
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	_, err := sclient.CreateSubscription(ctx, &pb.Subscription{
+		Name:   "projects/P/subscriptions/bad",
+		Topic:  top.Name,
+		Filter: `attributes.lang = `,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("creating a subscription with an invalid filter: got %v, want InvalidArgument", err)
+	}
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:   "projects/P/subscriptions/S",
+		Topic:  top.Name,
+		Filter: `hasPrefix(attributes.lang, "en") AND NOT attributes:draft`,
+	})
+
+	srv.Publish(top.Name, []byte("d1"), map[string]string{"lang": "en-US"})
+	srv.Publish(top.Name, []byte("d2"), map[string]string{"lang": "es"})
+	srv.Publish(top.Name, []byte("d3"), map[string]string{"lang": "en", "draft": "true"})
+	srv.Publish(top.Name, []byte("d4"), nil)
+	srv.Publish(top.Name, []byte("d5"), map[string]string{"lang": "en-GB"})
+
+	got := map[string]bool{}
+	for _, m := range pullN(ctx, t, 2, sclient, sub) {
+		got[string(m.Message.Data)] = true
+	}
+	if diff := testutil.Diff(got, map[string]bool{"d1": true, "d5": true}); diff != "" {
+		t.Errorf("delivered messages (-got +want):\n%s", diff)
+	}
+	// The messages the filter rejected were never queued.
+	if n := srv.NumUndeliveredMessages(sub.Name); n != 2 {
+		t.Errorf("got %d undelivered messages, want 2", n)
+	}
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:                  "projects/P/subscriptions/S",
+		Topic:                 top.Name,
+		EnableMessageOrdering: true,
+	})
+	published := map[string][]string{}
+	for i, key := range []string{"a", "b", "a", "b", "a", "b", "b", ""} {
+		id := srv.PublishOrdered(top.Name, []byte(fmt.Sprint(i)), nil, key)
+		published[key] = append(published[key], id)
+	}
+
+	pull := func() []*pb.PubsubMessage {
+		res, err := srv.GServer.Pull(ctx, &pb.PullRequest{
+			Subscription:      sub.Name,
+			ReturnImmediately: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgs []*pb.PubsubMessage
+		for _, rm := range res.ReceivedMessages {
+			msgs = append(msgs, rm.Message)
+		}
+		return msgs
+	}
+	modAck := func(id string, secs int32) {
+		_, err := sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+			Subscription:       sub.Name,
+			AckIds:             []string{id},
+			AckDeadlineSeconds: secs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the head of each key is delivered, along with the message that
+	// has no key.
+	if got := len(pull()); got != 3 {
+		t.Fatalf("got %d messages, want 3", got)
+	}
+	if got := pull(); len(got) != 0 {
+		t.Fatalf("got %d more messages before any acks, want none", len(got))
+	}
+	// A nacked head is redelivered before the next message for its key.
+	modAck(published["b"][0], 0)
+	if got := pull(); len(got) != 1 || got[0].MessageId != published["b"][0] {
+		t.Fatalf("got %v after a nack, want the nacked message again", got)
+	}
+
+	// Acking each message delivers the next for its key, while the keys
+	// are delivered independently.
+	received := map[string][]string{"a": {published["a"][0]}, "b": {published["b"][0]}}
+	heads := []string{published["a"][0], published["b"][0]}
+	for len(heads) > 0 {
+		_, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+			Subscription: sub.Name,
+			AckIds:       heads,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		heads = nil
+		for _, m := range pull() {
+			received[m.OrderingKey] = append(received[m.OrderingKey], m.MessageId)
+			heads = append(heads, m.MessageId)
+		}
+		if len(heads) > 2 {
+			t.Fatalf("got %d messages at once, want at most one per key", len(heads))
+		}
+	}
+	delete(published, "")
+	if diff := testutil.Diff(received, published); diff != "" {
+		t.Errorf("messages per key (-got +want):\n%s", diff)
 	}
-	return sub
 }
 
-func mustUpdateSubscription(
-	ctx context.Context,
-	t *testing.T,
-	sc pb.SubscriberClient,
-	req *pb.UpdateSubscriptionRequest,
-) *pb.Subscription {
-	sub, err := sc.UpdateSubscription(ctx, req)
-	if err != nil {
-		t.Fatal(err)
+func TestDeliveryAttempt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	dlq := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/DLQ"})
+	policy := &pb.DeadLetterPolicy{DeadLetterTopic: dlq.Name, MaxDeliveryAttempts: 5}
+	pullSub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:             "projects/P/subscriptions/pull",
+		Topic:            top.Name,
+		DeadLetterPolicy: policy,
+	})
+	streamSub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:             "projects/P/subscriptions/stream",
+		Topic:            top.Name,
+		DeadLetterPolicy: policy,
+	})
+	plainSub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/plain",
+		Topic: top.Name,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+
+	// The attempt counts up as the message is nacked and redelivered.
+	for want := int32(1); want <= 3; want++ {
+		got := pullN(ctx, t, 1, sclient, pullSub)[id].DeliveryAttempt
+		if got != want {
+			t.Errorf("pull: got delivery attempt %d, want %d", got, want)
+		}
+		_, err := sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+			Subscription: pullSub.Name,
+			AckIds:       []string{id},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spc := mustStartStreamingPull(ctx, t, sclient, streamSub)
+	for want := int32(1); want <= 3; want++ {
+		res, err := spc.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.ReceivedMessages[0].DeliveryAttempt; got != want {
+			t.Errorf("streaming pull: got delivery attempt %d, want %d", got, want)
+		}
+		err = spc.Send(&pb.StreamingPullRequest{
+			ModifyDeadlineAckIds:  []string{id},
+			ModifyDeadlineSeconds: []int32{0},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without a dead-letter policy, the attempt isn't set.
+	if got := pullN(ctx, t, 1, sclient, plainSub)[id].DeliveryAttempt; got != 0 {
+		t.Errorf("got delivery attempt %d without a dead-letter policy, want 0", got)
 	}
-	return sub
 }
 
-// newFake creates a new fake server along  with a publisher and subscriber
-// client. Its final return is a cleanup function.
-//
-// Note: be sure to call cleanup!
-func newFake(
-	ctx context.Context,
-	t *testing.T,
-	opts ...ServerReactorOption,
-) (pb.PublisherClient, pb.SubscriberClient, *Server, func()) {
-	srv := NewServer(opts...)
-	conn, err := grpc.DialContext(ctx, srv.Addr, grpc.WithInsecure())
+func TestExactlyOnceAckFailures(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.SetTimeNowFunc(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	})
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		clock = clock.Add(d)
+	}
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	newSub := func(name string, exactlyOnce bool) *pb.Subscription {
+		return mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+			Name:                      name,
+			Topic:                     top.Name,
+			AckDeadlineSeconds:        10,
+			EnableExactlyOnceDelivery: exactlyOnce,
+		})
+	}
+	sub := newSub("projects/P/subscriptions/S", true)
+	plainSub := newSub("projects/P/subscriptions/plain", false)
+	ids := []string{
+		srv.Publish(top.Name, []byte("d1"), nil),
+		srv.Publish(top.Name, []byte("d2"), nil),
+		srv.Publish(top.Name, []byte("d3"), nil),
+	}
+	pull := func(sub *pb.Subscription) {
+		res, err := srv.GServer.Pull(ctx, &pb.PullRequest{
+			Subscription:      sub.Name,
+			ReturnImmediately: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.ReceivedMessages) == 0 {
+			t.Fatalf("no messages were delivered on %s", sub.Name)
+		}
+	}
+	ack := func(sub *pb.Subscription, ids ...string) error {
+		_, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+			Subscription: sub.Name,
+			AckIds:       ids,
+		})
+		return err
+	}
+
+	// An ack within the deadline succeeds.
+	pull(sub)
+	pull(plainSub)
+	if err := ack(sub, ids[0]); err != nil {
+		t.Errorf("acking within the deadline: %v", err)
+	}
+
+	// Once the deadline has passed, the ack fails for the expired ack
+	// ID, but the others in the request, whose deadline was extended, are
+	// acked.
+	_, err := sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+		Subscription:       sub.Name,
+		AckIds:             []string{ids[2]},
+		AckDeadlineSeconds: 60,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	return pb.NewPublisherClient(conn), pb.NewSubscriberClient(conn), srv, func() {
-		srv.Close()
-		conn.Close()
+	advance(11 * time.Second)
+	err = ack(sub, ids[1], ids[2])
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("acking after the deadline: got %v, want Unavailable", err)
+	}
+	var failures map[string]string
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == "EXACTLY_ONCE_ACKID_FAILURE" {
+			failures = info.Metadata
+		}
+	}
+	want := map[string]string{ids[1]: "TRANSIENT_FAILURE_LEASE_EXPIRED"}
+	if diff := testutil.Diff(failures, want); diff != "" {
+		t.Errorf("ack failures (-got +want):\n%s", diff)
+	}
+	if got := srv.NumUndeliveredMessages(sub.Name); got != 1 {
+		t.Errorf("got %d undelivered messages, want just the one whose ack failed", got)
 	}
-}
 
-func TestErrorInjection(t *testing.T) {
-	testcases := []struct {
-		funcName string
-		param    interface{}
-		code     codes.Code
-	}{
-		{
-			funcName: "CreateTopic",
-			code:     codes.Internal,
-		},
-		{
-			funcName: "GetTopic",
-			code:     codes.Aborted,
-		},
-		{
-			funcName: "UpdateTopic",
-			code:     codes.DeadlineExceeded,
-		},
-		{
-			funcName: "ListTopics",
-		},
-		{
-			funcName: "ListTopicSubscriptions",
-		},
-		{
-			funcName: "DeleteTopic",
-		},
-		{
-			funcName: "CreateSubscription",
-		},
-		{
-			funcName: "GetSubscription",
-		},
-		{
-			funcName: "UpdateSubscription",
-			param:    &pb.UpdateSubscriptionRequest{Subscription: &pb.Subscription{}},
-		},
-		{
-			funcName: "ListSubscriptions",
-		},
-		{
-			funcName: "DeleteSubscription",
-		},
-		{
-			funcName: "DetachSubscription",
-		},
-		{
-			funcName: "Publish",
-		},
-		{
-			funcName: "Acknowledge",
-		},
-		{
-			funcName: "ModifyAckDeadline",
-		},
-		{
-			funcName: "Pull",
-		},
-		{
-			funcName: "Seek",
-			param:    &pb.SeekRequest{Target: &pb.SeekRequest_Time{Time: timestamppb.Now()}},
-		},
+	// After it's redelivered, the message can be acked again.
+	pull(sub)
+	if err := ack(sub, ids[1]); err != nil {
+		t.Errorf("acking after redelivery: %v", err)
 	}
 
-	for _, tc := range testcases {
-		ctx := context.TODO()
-		errMsg := "error-injection-" + tc.funcName
-		// set error code to unknown unless specified
-		ec := codes.Unknown
-		if tc.code != codes.OK {
-			ec = tc.code
+	// Without exactly-once delivery, late acks succeed.
+	if err := ack(plainSub, ids...); err != nil {
+		t.Errorf("acking late without exactly-once delivery: %v", err)
+	}
+}
+
+func TestPushDelivery(t *testing.T) {
+	ctx := context.Background()
+	pushes := make(chan *pushEnvelope, 10)
+	var mu sync.Mutex
+	failures := 1
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e pushEnvelope
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("decoding push: %v", err)
 		}
-		opts := []ServerReactorOption{
-			WithErrorInjection(tc.funcName, ec, errMsg),
+		pushes <- &e
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
 		}
-		_, _, server, cleanup := newFake(ctx, t, opts...)
-		defer cleanup()
+	}))
+	defer hs.Close()
 
-		// We used reflection here to blindly look up the function by name and pass
-		// context and a typed nil, as all the functions under test will have such
-		// a function signature.
-		f := reflect.ValueOf(&server.GServer).MethodByName(tc.funcName)
-		if !f.IsValid() {
-			t.Fatalf("Method %v Not Found", tc.funcName)
+	pclient, sclient, srv, cleanup := newFake(ctx, t, WithPushDelivery(hs.Client()))
+	defer cleanup()
+	var clockMu sync.Mutex
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.SetTimeNowFunc(func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return clock
+	})
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+		PushConfig:         &pb.PushConfig{PushEndpoint: hs.URL},
+	})
+	id := srv.Publish(top.Name, []byte("d1"), map[string]string{"k": "v"})
+
+	nextPush := func() *pushEnvelope {
+		select {
+		case e := <-pushes:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the message wasn't pushed")
+			return nil
 		}
-		// If param is provided, use the param, otherwise create a typed nil that matches the
-		// parameter type.
-		var req reflect.Value
-		if tc.param != nil {
-			req = reflect.ValueOf(tc.param)
-		} else {
-			req = reflect.New(f.Type().In(1).Elem())
+	}
+	e := nextPush()
+	if string(e.Message.Data) != "d1" || e.Message.MessageID != id ||
+		e.Message.Attributes["k"] != "v" || e.Subscription != sub.Name ||
+		!e.Message.PublishTime.Equal(clock) {
+		t.Errorf("got push %+v, want message %s on %s", e, id, sub.Name)
+	}
+
+	// The failed push is retried once the ack deadline has passed, and
+	// the successful one acks the message.
+	select {
+	case e := <-pushes:
+		t.Fatalf("got push %+v before the ack deadline", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	clockMu.Lock()
+	clock = clock.Add(11 * time.Second)
+	clockMu.Unlock()
+	if e := nextPush(); e.Message.MessageID != id {
+		t.Errorf("got push of %s, want %s", e.Message.MessageID, id)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := srv.WaitForAck(wctx, sub.Name, id); err != nil {
+		t.Fatalf("waiting for the push to ack the message: %v", err)
+	}
+	if acked, _, _ := srv.AckStats(sub.Name); acked != 1 {
+		t.Errorf("got %d acks, want 1", acked)
+	}
+}
+
+func TestLatencyInjection(t *testing.T) {
+	ctx := context.Background()
+	const latency = 200 * time.Millisecond
+	pclient, _, srv, cleanup := newFake(ctx, t,
+		WithLatencyInjection("Publish", latency),
+		WithLatencyInjection("ListTopics", latency),
+		WithErrorInjection("ListTopics", codes.Unavailable, "unavailable"))
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	start := time.Now()
+	publish(t, pclient, top, []*pb.PubsubMessage{{Data: []byte("d1")}})
+	if got := time.Since(start); got < latency {
+		t.Errorf("publish took %v, want at least %v", got, latency)
+	}
+	if got := len(srv.Messages()); got != 1 {
+		t.Errorf("got %d messages, want 1", got)
+	}
+
+	// A call whose deadline passes while it waits fails right away.
+	dctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err := srv.GServer.Publish(dctx, &pb.PublishRequest{
+		Topic:    top.Name,
+		Messages: []*pb.PubsubMessage{{Data: []byte("d2")}},
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	if got := time.Since(start); got >= latency {
+		t.Errorf("publish with a 20ms deadline took %v", got)
+	}
+	if got := len(srv.Messages()); got != 1 {
+		t.Errorf("got %d messages after the failed publish, want 1", got)
+	}
+
+	// A slow Publish doesn't hold up other calls.
+	slow := make(chan error, 1)
+	go func() {
+		_, err := pclient.Publish(ctx, &pb.PublishRequest{
+			Topic:    top.Name,
+			Messages: []*pb.PubsubMessage{{Data: []byte("d3")}},
+		})
+		slow <- err
+	}()
+	time.Sleep(latency / 4)
+	start = time.Now()
+	if _, err := pclient.GetTopic(ctx, &pb.GetTopicRequest{Topic: top.Name}); err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Since(start); got >= latency/2 {
+		t.Errorf("GetTopic during a slow Publish took %v", got)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("slow publish: %v", err)
+	}
+
+	// The reactors run in order, so the error comes after the latency.
+	start = time.Now()
+	_, err = pclient.ListTopics(ctx, &pb.ListTopicsRequest{Project: "projects/P"})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want Unavailable", err)
+	}
+	if got := time.Since(start); got < latency {
+		t.Errorf("failed ListTopics took %v, want at least %v", got, latency)
+	}
+}
+
+func TestErrorInjectionOnCall(t *testing.T) {
+	ctx := context.Background()
+	pclient, _, srv, cleanup := newFake(ctx, t,
+		WithErrorInjectionOnCall("Publish", 2, codes.Unavailable, "transient"),
+		WithErrorInjectionOnCall("GetTopic", 5, codes.Internal, "internal"))
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	for i, want := range []codes.Code{codes.OK, codes.Unavailable, codes.OK, codes.OK} {
+		_, err := pclient.Publish(ctx, &pb.PublishRequest{
+			Topic:    top.Name,
+			Messages: []*pb.PubsubMessage{{Data: []byte(fmt.Sprint(i))}},
+		})
+		if got := status.Code(err); got != want {
+			t.Errorf("publish %d: got %v, want %v", i+1, err, want)
 		}
-		ret := reflect.ValueOf(&server.GServer).
-			MethodByName(tc.funcName).
-			Call([]reflect.Value{reflect.ValueOf(ctx), req})
+	}
+	if got := len(srv.Messages()); got != 3 {
+		t.Errorf("got %d messages, want 3", got)
+	}
+
+	// Exactly one of many concurrent calls fails.
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pclient.GetTopic(ctx, &pb.GetTopicRequest{Topic: top.Name})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+			if status.Code(err) != codes.Internal {
+				t.Errorf("got %v, want Internal", err)
+			}
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d of 20 concurrent calls failed, want 1", failed)
+	}
+}
 
-		got := ret[1].Interface().(error)
-		if got == nil || status.Code(got) != ec || !strings.Contains(got.Error(), errMsg) {
-			t.Errorf("Got error does not contain the right key %v", got)
+func TestModifyAckDeadlineValidation(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+	modAck := func(secs int32, ids ...string) error {
+		_, err := sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+			Subscription:       sub.Name,
+			AckIds:             ids,
+			AckDeadlineSeconds: secs,
+		})
+		return err
+	}
+
+	// Unknown ack IDs are ignored.
+	unknown := fmt.Sprintf("m%d", rand.Int63())
+	if err := modAck(10, unknown); err != nil {
+		t.Errorf("modack of an unknown ack ID: %v", err)
+	}
+	if err := modAck(0, unknown, id); err != nil {
+		t.Errorf("nack of an unknown ack ID and a known one: %v", err)
+	}
+
+	for _, secs := range []int32{0, 600} {
+		if err := modAck(secs, id); err != nil {
+			t.Errorf("modack to %ds: %v", secs, err)
+		}
+	}
+	for _, secs := range []int32{-1, 601} {
+		if err := modAck(secs, id); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("modack to %ds: got %v, want InvalidArgument", secs, err)
 		}
 	}
 }
+
+func TestAckLatency(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	srv.SetTimeNowFunc(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	})
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:  "projects/P/subscriptions/S",
+		Topic: top.Name,
+	})
+	id := srv.Publish(top.Name, []byte("d1"), nil)
+	pullN(ctx, t, 1, sclient, sub)
+
+	m := srv.Message(id)
+	if !m.AckedAt.IsZero() || m.AckLatency() != 0 {
+		t.Errorf("got AckedAt %v and AckLatency %v before the ack, want zero", m.AckedAt, m.AckLatency())
+	}
+
+	mu.Lock()
+	clock = clock.Add(3 * time.Second)
+	mu.Unlock()
+	_, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{
+		Subscription: sub.Name,
+		AckIds:       []string{id},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = srv.Message(id)
+	if want := m.PublishTime.Add(3 * time.Second); !m.AckedAt.Equal(want) {
+		t.Errorf("got AckedAt %v, want %v", m.AckedAt, want)
+	}
+	if got, want := m.AckLatency(), 3*time.Second; got != want {
+		t.Errorf("got AckLatency %v, want %v", got, want)
+	}
+}
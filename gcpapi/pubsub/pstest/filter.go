@@ -0,0 +1,270 @@
+package pstest
+
+// This file implements subscription filters, which restrict the messages
+// delivered to a subscription by their attributes.  We support this
+// subset of Pub/Sub's filter syntax:
+//
+//	attributes.key = "value"
+//	attributes.key != "value"
+//	attributes:key                   (the attribute exists)
+//	hasPrefix(attributes.key, "value")
+//
+// combined with NOT (or -), AND, OR and parentheses.  AND binds more
+// tightly than OR.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A filter reports whether a message with the given attributes should be
+// delivered.  A nil filter accepts every message.
+type filter func(attrs map[string]string) bool
+
+// parseFilter parses a subscription's filter, returning an InvalidArgument
+// error if it's invalid or uses syntax we don't support.
+func parseFilter(s string) (filter, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+// tokenizeFilter splits s into identifiers, quoted strings (kept quoted),
+// and the symbols ( ) , . : = != and -.
+func tokenizeFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"invalid filter %q: unterminated string", s)
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(s[i:], "!="):
+			tokens = append(tokens, "!=")
+			i += 2
+		case strings.ContainsRune("(),.:=-", c):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid filter %q: unexpected %q", s, c)
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return status.Errorf(codes.InvalidArgument, "invalid filter %q: %s",
+		strings.Join(p.tokens, " "), fmt.Sprintf(format, args...))
+}
+
+// peek returns the next token, or "" at the end.
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// expect consumes the next token, which must be want.
+func (p *filterParser) expect(want string) error {
+	if got := p.peek(); got != want {
+		return p.errorf("got %q, want %q", got, want)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *filterParser) or() (filter, error) {
+	f, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.pos++
+		g, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left := f
+		f = func(attrs map[string]string) bool { return left(attrs) || g(attrs) }
+	}
+	return f, nil
+}
+
+func (p *filterParser) and() (filter, error) {
+	f, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "AND" {
+		p.pos++
+		g, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left := f
+		f = func(attrs map[string]string) bool { return left(attrs) && g(attrs) }
+	}
+	return f, nil
+}
+
+func (p *filterParser) unary() (filter, error) {
+	if tok := p.peek(); tok == "NOT" || tok == "-" {
+		p.pos++
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(attrs map[string]string) bool { return !f(attrs) }, nil
+	}
+	return p.primary()
+}
+
+func (p *filterParser) primary() (filter, error) {
+	switch p.peek() {
+	case "(":
+		p.pos++
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+
+	case "hasPrefix":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		key, err := p.attribute(".")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		prefix, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(attrs map[string]string) bool {
+			v, ok := attrs[key]
+			return ok && strings.HasPrefix(v, prefix)
+		}, nil
+
+	case "attributes":
+		if p.pos+1 < len(p.tokens) && p.tokens[p.pos+1] == ":" {
+			key, err := p.attribute(":")
+			if err != nil {
+				return nil, err
+			}
+			return func(attrs map[string]string) bool {
+				_, ok := attrs[key]
+				return ok
+			}, nil
+		}
+		key, err := p.attribute(".")
+		if err != nil {
+			return nil, err
+		}
+		op := p.peek()
+		if op != "=" && op != "!=" {
+			return nil, p.errorf("got %q after attributes.%s, want = or !=", op, key)
+		}
+		p.pos++
+		value, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if op == "=" {
+			return func(attrs map[string]string) bool {
+				v, ok := attrs[key]
+				return ok && v == value
+			}, nil
+		}
+		return func(attrs map[string]string) bool {
+			v, ok := attrs[key]
+			return !ok || v != value
+		}, nil
+	}
+	return nil, p.errorf("unexpected %q", p.peek())
+}
+
+// attribute consumes "attributes", sep and an attribute key, which may be
+// an identifier or a quoted string, and returns the key.
+func (p *filterParser) attribute(sep string) (string, error) {
+	if err := p.expect("attributes"); err != nil {
+		return "", err
+	}
+	if err := p.expect(sep); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(p.peek(), `"`) {
+		return p.str()
+	}
+	key := p.peek()
+	if key == "" || !(key[0] == '_' || unicode.IsLetter(rune(key[0])) || unicode.IsDigit(rune(key[0]))) {
+		return "", p.errorf("got %q, want an attribute key", key)
+	}
+	p.pos++
+	return key, nil
+}
+
+// str consumes a quoted string and returns its value.
+func (p *filterParser) str() (string, error) {
+	tok := p.peek()
+	if !strings.HasPrefix(tok, `"`) {
+		return "", p.errorf("got %q, want a quoted string", tok)
+	}
+	s, err := strconv.Unquote(tok)
+	if err != nil {
+		return "", p.errorf("bad string %s", tok)
+	}
+	p.pos++
+	return s, nil
+}
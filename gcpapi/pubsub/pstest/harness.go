@@ -0,0 +1,60 @@
+package pstest
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+
+	"github.com/Khan/districts-jobs/pkg/errors"
+	"github.com/StevenACoffman/gcp-emulator-pool/gcpapi"
+)
+
+// Harness is a fake server with a client and a PubSubInfo connected to
+// it, for tests that publish through PubSubInfo.
+type Harness struct {
+	// PubSubInfo publishes through Client.  Its TestServer is nil; use
+	// Server instead.
+	PubSubInfo *gcpapi.PubSubInfo
+	Client     *pubsub.Client
+	Server     *Server
+
+	conn *grpc.ClientConn
+}
+
+// NewHarness starts a fake server and connects a PubSubInfo, which signs
+// messages with secretKey, to it.  The test is responsible for calling
+// Close() at the end of the test.
+func NewHarness(ctx context.Context, secretKey string) (*Harness, error) {
+	srv := NewServer()
+	//nolint:ka-always-close // closed by Harness.Close
+	conn, err := grpc.Dial(
+		srv.Addr,
+		grpc.WithInsecure(),
+	) //nolint:staticcheck // deprecated but ok for now
+	if err != nil {
+		srv.Close()
+		return nil, errors.Wrap(err, "unable to create grpc dialer")
+	}
+	info, err := gcpapi.NewPubSubInfoForTests(ctx, secretKey, "khan-test",
+		option.WithGRPCConn(conn))
+	if err != nil {
+		conn.Close()
+		srv.Close()
+		return nil, errors.Wrap(err, "unable to get pubsub client")
+	}
+	return &Harness{
+		PubSubInfo: info,
+		Client:     info.Client,
+		Server:     srv,
+		conn:       conn,
+	}, nil
+}
+
+// Close closes the client, its connection and the server.
+func (h *Harness) Close() {
+	h.PubSubInfo.Close()
+	h.conn.Close()
+	h.Server.Close()
+}
@@ -0,0 +1,119 @@
+package pstest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+// RequireOrderedDelivery pulls the messages with the given ordering key
+// from a subscription of srv, acking them, and fails the test unless
+// expectedCount of them arrive, each exactly once, in the order they were
+// published to the subscription's topic.  Messages with other ordering
+// keys are nacked, so they're left for the rest of the test.
+func RequireOrderedDelivery(
+	t testing.TB,
+	srv *Server,
+	subscription string,
+	key string,
+	expectedCount int,
+) {
+	t.Helper()
+	ctx := context.Background()
+
+	config := srv.SubscriptionConfig(subscription)
+	if config == nil {
+		t.Errorf("pstest: no subscription %s", subscription)
+		return
+	}
+	// published maps the ID of each message with the key to its position
+	// in publish order.
+	published := map[string]int{}
+	for _, m := range srv.Messages() {
+		if m.Topic == config.Topic && m.OrderingKey == key {
+			published[m.ID] = len(published)
+		}
+	}
+
+	var delivered, others []string
+	for {
+		res, err := srv.GServer.Pull(ctx, &pb.PullRequest{
+			Subscription:      subscription,
+			ReturnImmediately: true,
+		})
+		if err != nil {
+			t.Errorf("pstest: pulling from %s: %v", subscription, err)
+			return
+		}
+		if len(res.ReceivedMessages) == 0 {
+			break
+		}
+		var acks []string
+		for _, rm := range res.ReceivedMessages {
+			if rm.Message.OrderingKey != key {
+				others = append(others, rm.AckId)
+				continue
+			}
+			delivered = append(delivered, rm.Message.MessageId)
+			acks = append(acks, rm.AckId)
+		}
+		if len(acks) == 0 {
+			continue
+		}
+		_, err = srv.GServer.Acknowledge(ctx, &pb.AcknowledgeRequest{
+			Subscription: subscription,
+			AckIds:       acks,
+		})
+		if err != nil {
+			t.Errorf("pstest: acking messages from %s: %v", subscription, err)
+			return
+		}
+	}
+	if len(others) > 0 {
+		_, err := srv.GServer.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+			Subscription: subscription,
+			AckIds:       others,
+		})
+		if err != nil {
+			t.Errorf("pstest: nacking messages from %s: %v", subscription, err)
+		}
+	}
+
+	if problems := orderingProblems(published, delivered, expectedCount); len(problems) > 0 {
+		t.Errorf("pstest: messages with ordering key %q on %s were delivered as %v:\n%s",
+			key, subscription, delivered, strings.Join(problems, "\n"))
+	}
+}
+
+// orderingProblems describes how the IDs of the delivered messages depart
+// from expectedCount messages in the order given by published.
+func orderingProblems(published map[string]int, delivered []string, expectedCount int) []string {
+	var problems []string
+	if len(delivered) != expectedCount {
+		problems = append(problems,
+			fmt.Sprintf("got %d deliveries, want %d", len(delivered), expectedCount))
+	}
+	seen := map[string]bool{}
+	last := ""
+	for _, id := range delivered {
+		if seen[id] {
+			problems = append(problems, fmt.Sprintf("%s was delivered more than once", id))
+			continue
+		}
+		seen[id] = true
+		pos, ok := published[id]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s wasn't published with the key", id))
+			continue
+		}
+		if last != "" && pos < published[last] {
+			problems = append(problems,
+				fmt.Sprintf("%s was delivered after %s, which was published later", id, last))
+		}
+		last = id
+	}
+	return problems
+}
@@ -0,0 +1,100 @@
+package pstest
+
+// This file implements push delivery, which WithPushDelivery turns on.  A
+// subscription with a push endpoint POSTs each message to it, instead of
+// sending it on a stream, in the JSON envelope Pub/Sub uses.  A 2xx
+// response acks the message; any other response, or an error, leaves it
+// outstanding, so it's pushed again once its ack deadline has passed.
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+// pushEnvelope is the JSON body of a push delivery.  encoding/json encodes
+// the data in base64, as Pub/Sub does.
+type pushEnvelope struct {
+	Message struct {
+		Data        []byte            `json:"data"`
+		Attributes  map[string]string `json:"attributes,omitempty"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+		OrderingKey string            `json:"orderingKey,omitempty"`
+	} `json:"message"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt int32  `json:"deliveryAttempt,omitempty"`
+}
+
+func newPushEnvelope(subscription string, rm *pb.ReceivedMessage) *pushEnvelope {
+	var e pushEnvelope
+	e.Message.Data = rm.Message.Data
+	e.Message.Attributes = rm.Message.Attributes
+	e.Message.MessageID = rm.Message.MessageId
+	e.Message.PublishTime = rm.Message.PublishTime.AsTime()
+	e.Message.OrderingKey = rm.Message.OrderingKey
+	e.Subscription = subscription
+	e.DeliveryAttempt = rm.DeliveryAttempt
+	return &e
+}
+
+// pushing reports whether the subscription delivers by push.
+//
+// Must be called with the lock held.
+func (s *subscription) pushing() bool {
+	return s.pushClient != nil && s.proto.PushConfig.GetPushEndpoint() != ""
+}
+
+// push POSTs each of the subscription's deliverable messages to its push
+// endpoint.
+//
+// Must be called with the lock held.
+func (s *subscription) push(now time.Time) {
+	endpoint := s.proto.PushConfig.PushEndpoint
+	heads := map[string]bool{}
+	for _, m := range s.inOrder() {
+		if s.heldBack(m, heads) || m.outstanding() || s.pending(m, now) || s.loseDelivery(m, now) {
+			continue
+		}
+		s.setDeliveryAttempt(m)
+		s.recordDelivery(m, now)
+		body, err := json.Marshal(newPushEnvelope(s.proto.Name, m.proto))
+		if err != nil {
+			// Leave the message to be pushed again, like a failed push.
+			continue
+		}
+		s.wg.Add(1)
+		go s.pushMessage(endpoint, m.proto.GetAckId(), body)
+	}
+}
+
+// pushMessage POSTs body, a push envelope, to endpoint, and acks the
+// message with the given ack ID if the endpoint accepts it.
+func (s *subscription) pushMessage(endpoint, ackID string, body []byte) {
+	defer s.wg.Done()
+
+	req, err := http.NewRequestWithContext(s.pushCtx, http.MethodPost, endpoint,
+		bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.pushClient.Do(req)
+	if err != nil {
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ack(ackID)
+}
@@ -0,0 +1,195 @@
+package pstest
+
+// This file implements snapshots, and seeking to them.  A snapshot
+// records which of a subscription's messages were unacked when it was
+// taken; seeking to it makes those messages, and every message published
+// to the topic since, unacked again.  Messages dropped from the server's
+// log by WithMaxRetainedMessages can't be restored.
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/Khan/districts-jobs/pkg/gcpapi/testutil"
+)
+
+// snapshotLifetime is how long Pub/Sub keeps a snapshot, at most.
+const snapshotLifetime = 7 * 24 * time.Hour
+
+type snapshot struct {
+	proto *pb.Snapshot
+	// topic is the name of the snapshot's topic, which proto.Topic
+	// forgets if the topic is deleted.
+	topic string
+	// unacked holds the IDs of the subscription's unacked messages when
+	// the snapshot was taken.
+	unacked []string
+	// nextSeq is the seq of the first message published after the
+	// snapshot was taken.
+	nextSeq int
+}
+
+func (s *GServer) CreateSnapshot(
+	ctx context.Context,
+	req *pb.CreateSnapshotRequest,
+) (*pb.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if handled, ret, err := s.runReactor(ctx, req, "CreateSnapshot", &pb.Snapshot{}); handled ||
+		err != nil {
+		return ret.(*pb.Snapshot), err
+	}
+
+	if req.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing name")
+	}
+	if s.snapshots[req.Name] != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %q", req.Name)
+	}
+	sub, err := s.findSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	snap := &snapshot{
+		proto: &pb.Snapshot{
+			Name:       req.Name,
+			Topic:      sub.proto.Topic,
+			ExpireTime: timestamppb.New(s.timeNowFunc().Add(snapshotLifetime)),
+			Labels:     req.Labels,
+		},
+		topic:   sub.proto.Topic,
+		nextSeq: s.nextID,
+	}
+	for id := range sub.msgs {
+		snap.unacked = append(snap.unacked, id)
+	}
+	s.snapshots[req.Name] = snap
+	return proto.Clone(snap.proto).(*pb.Snapshot), nil
+}
+
+func (s *GServer) GetSnapshot(
+	ctx context.Context,
+	req *pb.GetSnapshotRequest,
+) (*pb.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if handled, ret, err := s.runReactor(ctx, req, "GetSnapshot", &pb.Snapshot{}); handled ||
+		err != nil {
+		return ret.(*pb.Snapshot), err
+	}
+
+	snap, err := s.findSnapshot(req.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(snap.proto).(*pb.Snapshot), nil
+}
+
+func (s *GServer) ListSnapshots(
+	ctx context.Context,
+	req *pb.ListSnapshotsRequest,
+) (*pb.ListSnapshotsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if handled, ret, err := s.runReactor(ctx, req, "ListSnapshots", &pb.ListSnapshotsResponse{}); handled ||
+		err != nil {
+		return ret.(*pb.ListSnapshotsResponse), err
+	}
+
+	var names []string
+	for name := range s.snapshots {
+		if strings.HasPrefix(name, req.Project) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	from, to, nextToken, err := testutil.PageBounds(int(req.PageSize), req.PageToken, len(names))
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.ListSnapshotsResponse{NextPageToken: nextToken}
+	for i := from; i < to; i++ {
+		res.Snapshots = append(res.Snapshots, proto.Clone(s.snapshots[names[i]].proto).(*pb.Snapshot))
+	}
+	return res, nil
+}
+
+func (s *GServer) DeleteSnapshot(
+	ctx context.Context,
+	req *pb.DeleteSnapshotRequest,
+) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if handled, ret, err := s.runReactor(ctx, req, "DeleteSnapshot", &emptypb.Empty{}); handled ||
+		err != nil {
+		return ret.(*emptypb.Empty), err
+	}
+
+	if _, err := s.findSnapshot(req.Snapshot); err != nil {
+		return nil, err
+	}
+	delete(s.snapshots, req.Snapshot)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *GServer) findSnapshot(name string) (*snapshot, error) {
+	if name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing snapshot")
+	}
+	snap := s.snapshots[name]
+	if snap == nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s", name)
+	}
+	return snap, nil
+}
+
+// seekToSnapshot makes sub's unacked messages those that were unacked
+// when the named snapshot was taken, plus those published since.
+//
+// Must be called with the lock held.
+func (s *GServer) seekToSnapshot(sub *subscription, name string) error {
+	snap, err := s.findSnapshot(name)
+	if err != nil {
+		return err
+	}
+	if snap.proto.Topic != sub.proto.Topic {
+		return status.Errorf(codes.InvalidArgument,
+			"snapshot %s is of topic %s, but subscription %s is of topic %s",
+			name, snap.proto.Topic, sub.proto.Name, sub.proto.Topic)
+	}
+
+	for _, m := range sub.msgs {
+		m.release()
+	}
+	sub.msgs = map[string]*message{}
+	for _, id := range snap.unacked {
+		if m := s.msgsByID[id]; m != nil {
+			sub.redeliver(m)
+		}
+	}
+	for _, m := range s.msgs {
+		if m.Topic == snap.topic && m.seq >= snap.nextSeq {
+			sub.redeliver(m)
+		}
+	}
+	// Messages the snapshot had acked stay acked.
+	for id := range sub.ackWaiters {
+		if sub.msgs[id] == nil {
+			sub.wakeAckWaiters(id, nil)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package gcpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"go.opencensus.io/trace"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// pushBody returns the body of a push delivery of msg, modified by tamper.
+func pushBody(t *testing.T, p *PubSubInfo, msg proto.Message, tamper func(data []byte)) []byte {
+	t.Helper()
+	m, err := p.newMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(m.Data)
+	}
+	var body pushRequest
+	body.Message.Data = m.Data
+	body.Message.Attributes = m.Attributes
+	body.Message.MessageID = "1"
+	body.Subscription = "projects/p/subscriptions/s"
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestVerifyPushRequest(t *testing.T) {
+	p := &PubSubInfo{SecretKey: "secret"}
+	sent := wrapperspb.String("hello")
+
+	r := httptest.NewRequest("POST", "/push", bytes.NewReader(pushBody(t, p, sent, nil)))
+	got, err := p.VerifyPushRequest(r)
+	if err != nil {
+		t.Fatalf("Got error %v verifying a signed push", err)
+	}
+	if !proto.Equal(got, sent) {
+		t.Errorf("Got %v, want %v", got, sent)
+	}
+
+	tampered := pushBody(t, p, sent, func(data []byte) { data[len(data)-1] ^= 1 })
+	r = httptest.NewRequest("POST", "/push", bytes.NewReader(tampered))
+	if _, err := p.VerifyPushRequest(r); err == nil {
+		t.Errorf("Got no error verifying a tampered push")
+	}
+
+	other := &PubSubInfo{SecretKey: "other"}
+	r = httptest.NewRequest("POST", "/push", bytes.NewReader(pushBody(t, other, sent, nil)))
+	if _, err := p.VerifyPushRequest(r); err == nil {
+		t.Errorf("Got no error verifying a push signed with another secret")
+	}
+}
+
+func TestSubscribeContinuesTrace(t *testing.T) {
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPubSubInfoForTests(ctx, "secret", "p", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	topic, err := p.Client.CreateTopic(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Client.CreateSubscription(ctx, "s", pubsub.SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubCtx, span := trace.StartSpan(ctx, "publish", trace.WithSampler(trace.AlwaysSample()))
+	defer span.End()
+	if err := p.SendPubSubMessageWithContext(pubCtx, "t", wrapperspb.String("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SendPubSubMessageWithContext(pubCtx, "missing", wrapperspb.String("hi")); err == nil {
+		t.Errorf("Got no error sending to a missing topic")
+	}
+	if ids := p.SentMessageIDsByTopic["missing"]; len(ids) != 0 {
+		t.Errorf("Got sent message IDs %v for a failed send, want none", ids)
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	var got *trace.Span
+	err = p.Subscribe(subCtx, "s", func(ctx context.Context, msg *pubsub.Message) {
+		got = trace.FromContext(ctx)
+		msg.Ack()
+		cancel()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil {
+		t.Fatalf("Got no span in the subscriber's context")
+	}
+	if got, want := got.SpanContext().TraceID, span.SpanContext().TraceID; got != want {
+		t.Errorf("Got trace ID %v in the subscriber, want %v", got, want)
+	}
+}
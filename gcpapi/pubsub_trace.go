@@ -0,0 +1,87 @@
+package gcpapi
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"go.opencensus.io/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+// traceparentAttribute holds the trace context of the publisher, in the
+// W3C traceparent format: version-traceID-spanID-flags, all in hex.
+const traceparentAttribute = "traceparent"
+
+// SendPubSubMessageWithContext is SendPubSubMessage, but also records the
+// trace context of ctx, if any, in the message's attributes, so that
+// Subscribe can continue the trace in the subscriber.
+func (p *PubSubInfo) SendPubSubMessageWithContext(
+	ctx context.Context,
+	topicStr PubSubTopic,
+	message proto.Message,
+) error {
+	msg, err := p.newMessage(message)
+	if err != nil {
+		return err
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		msg.Attributes[traceparentAttribute] = formatTraceparent(span.SpanContext())
+	}
+	serverID, err := p.GetTopic(topicStr).Publish(ctx, msg).Get(ctx)
+	if err != nil {
+		return err
+	}
+	p.SentMessageIDsByTopic[topicStr] = append(p.SentMessageIDsByTopic[topicStr], serverID)
+	return nil
+}
+
+// Subscribe calls handler for each message received on the named
+// subscription until ctx is done, like pubsub.Subscription.Receive.  If
+// the message was published by SendPubSubMessageWithContext, the
+// handler's context carries a span that continues the publisher's trace.
+func (p *PubSubInfo) Subscribe(
+	ctx context.Context,
+	subscription string,
+	handler func(context.Context, *pubsub.Message),
+) error {
+	return p.Client.Subscription(subscription).Receive(ctx,
+		func(ctx context.Context, msg *pubsub.Message) {
+			if parent, ok := parseTraceparent(msg.Attributes[traceparentAttribute]); ok {
+				var span *trace.Span
+				ctx, span = trace.StartSpanWithRemoteParent(ctx, "pubsub.Subscribe", parent)
+				defer span.End()
+			}
+			handler(ctx, msg)
+		})
+}
+
+func formatTraceparent(sc trace.SpanContext) string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, byte(sc.TraceOptions))
+}
+
+// parseTraceparent parses a traceparent attribute, reporting whether it
+// was valid.
+func parseTraceparent(s string) (trace.SpanContext, bool) {
+	var sc trace.SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return sc, false
+	}
+	var flags [1]byte
+	for _, f := range []struct {
+		dst []byte
+		hex string
+	}{{sc.TraceID[:], parts[1]}, {sc.SpanID[:], parts[2]}, {flags[:], parts[3]}} {
+		if len(f.hex) != 2*len(f.dst) {
+			return sc, false
+		}
+		if _, err := hex.Decode(f.dst, []byte(f.hex)); err != nil {
+			return sc, false
+		}
+	}
+	sc.TraceOptions = trace.TraceOptions(flags[0])
+	return sc, true
+}
@@ -0,0 +1,47 @@
+package gcpapi
+
+import (
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Khan/districts-jobs/pkg/errors"
+)
+
+// IsRetryable reports whether err is a transient error from a GCP API,
+// i.e. whether the request that caused it is worth retrying.  gRPC errors
+// are classified by their status code and HTTP errors by their status, even
+// when they have been wrapped.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		switch grpcErr.GRPCStatus().Code() {
+		case codes.Unavailable,
+			codes.DeadlineExceeded,
+			codes.ResourceExhausted,
+			codes.Aborted:
+			return true
+		}
+		return false
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
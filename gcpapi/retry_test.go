@@ -0,0 +1,39 @@
+package gcpapi
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", fmt.Errorf("boom"), false},
+		{"unavailable", status.Error(codes.Unavailable, "x"), true},
+		{"deadline", status.Error(codes.DeadlineExceeded, "x"), true},
+		{"exhausted", status.Error(codes.ResourceExhausted, "x"), true},
+		{"aborted", status.Error(codes.Aborted, "x"), true},
+		{"not found", status.Error(codes.NotFound, "x"), false},
+		{"invalid", status.Error(codes.InvalidArgument, "x"), false},
+		{"wrapped grpc", fmt.Errorf("publish: %w", status.Error(codes.Unavailable, "x")), true},
+		{"429", &googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{"503", &googleapi.Error{Code: http.StatusServiceUnavailable}, true},
+		{"404", &googleapi.Error{Code: http.StatusNotFound}, false},
+		{"409", &googleapi.Error{Code: http.StatusConflict}, false},
+		{"wrapped http", fmt.Errorf("upload: %w", &googleapi.Error{Code: 502}), true},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
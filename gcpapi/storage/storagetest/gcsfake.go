@@ -6,10 +6,14 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googleapis/google-cloud-go-testing/storage/stiface"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -33,9 +37,16 @@ func (c *GCSClient) Close() error {
 	return nil
 }
 
-// Bucket implements stiface.Client.Bucket
+// Bucket implements stiface.Client.Bucket.  A bucket that hasn't been
+// added yet returns a handle that can Create it.
 func (c *GCSClient) Bucket(name string) stiface.BucketHandle {
-	return c.buckets[name]
+	if bh, ok := c.buckets[name]; ok {
+		return bh
+	}
+	bh := NewBucketHandle()
+	bh.client = c
+	bh.name = name
+	return bh
 }
 
 // BucketHandle provides a fake BucketHandle implementation for testing.
@@ -43,8 +54,17 @@ type BucketHandle struct {
 	stiface.BucketHandle
 	ObjAttrs       []*storage.ObjectAttrs // Objects that will be returned by iterator
 	Objs           map[string]*ObjectHandle
+	BucketAttrs    *storage.BucketAttrs // Attributes set by Create
 	WritesMustFail bool
 	ClosesMustFail bool
+
+	// mu guards Objs, so that objects can be written concurrently.
+	mu sync.Mutex
+
+	// client and name are set on handles for buckets that don't exist
+	// yet, so that Create can add them to the client.
+	client *GCSClient
+	name   string
 }
 
 // NewBucketHandle creates a new empty BucketHandle.
@@ -55,14 +75,50 @@ func NewBucketHandle() *BucketHandle {
 	}
 }
 
+// exists reports whether the bucket has been added to its client.
+func (bh *BucketHandle) exists() bool {
+	return bh.client == nil || bh.client.buckets[bh.name] == bh
+}
+
 // Attrs implements trivial stiface.BucketHandle.Attrs
 func (bh *BucketHandle) Attrs(ctx context.Context) (*storage.BucketAttrs, error) {
+	if !bh.exists() {
+		return nil, storage.ErrBucketNotExist
+	}
+	if bh.BucketAttrs != nil {
+		attrs := *bh.BucketAttrs
+		return &attrs, nil
+	}
 	return &storage.BucketAttrs{}, nil
 }
 
+// Create implements stiface.BucketHandle.Create.  Like GCS, it fails with
+// a 409 Conflict if the bucket already exists.
+func (bh *BucketHandle) Create(
+	ctx context.Context,
+	projectID string,
+	attrs *storage.BucketAttrs,
+) error {
+	if bh.exists() || bh.client.buckets[bh.name] != nil {
+		return &googleapi.Error{
+			Code:    http.StatusConflict,
+			Message: "You already own this bucket.",
+		}
+	}
+	bh.BucketAttrs = &storage.BucketAttrs{Name: bh.name}
+	if attrs != nil {
+		*bh.BucketAttrs = *attrs
+		bh.BucketAttrs.Name = bh.name
+	}
+	bh.client.AddTestBucket(bh.name, bh)
+	return nil
+}
+
 // Object returns an ObjectHandle for the specified object name if it exists
 // in this bucket, or a new ObjectHandle otherwise.
 func (bh *BucketHandle) Object(name string) stiface.ObjectHandle {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
 	if o, ok := bh.Objs[name]; ok {
 		return o
 	}
@@ -131,10 +187,87 @@ type ObjectHandle struct {
 	Name           string
 	Bucket         *BucketHandle
 	Data           *bytes.Buffer
+	ObjAttrs       *storage.ObjectAttrs // Attributes set by Update
 	WritesMustFail bool
 	ClosesMustFail bool
 }
 
+// exists reports whether the object has been written to its bucket.
+func (o *ObjectHandle) exists() bool {
+	o.Bucket.mu.Lock()
+	defer o.Bucket.mu.Unlock()
+	_, ok := o.Bucket.Objs[o.Name]
+	return ok
+}
+
+// Attrs implements stiface.ObjectHandle.Attrs
+func (o *ObjectHandle) Attrs(context.Context) (*storage.ObjectAttrs, error) {
+	if !o.exists() {
+		return nil, storage.ErrObjectNotExist
+	}
+	attrs := storage.ObjectAttrs{}
+	if o.ObjAttrs != nil {
+		attrs = *o.ObjAttrs
+	}
+	attrs.Name = o.Name
+	attrs.Size = int64(o.Data.Len())
+	if attrs.Metadata != nil {
+		metadata := make(map[string]string, len(attrs.Metadata))
+		for k, v := range attrs.Metadata {
+			metadata[k] = v
+		}
+		attrs.Metadata = metadata
+	}
+	return &attrs, nil
+}
+
+// Update implements stiface.ObjectHandle.Update for the content type,
+// content disposition, custom time, and metadata attributes.
+func (o *ObjectHandle) Update(
+	ctx context.Context,
+	uattrs storage.ObjectAttrsToUpdate,
+) (*storage.ObjectAttrs, error) {
+	if !o.exists() {
+		return nil, storage.ErrObjectNotExist
+	}
+	if o.ObjAttrs == nil {
+		o.ObjAttrs = &storage.ObjectAttrs{}
+	}
+	if v, ok := uattrs.ContentType.(string); ok {
+		o.ObjAttrs.ContentType = v
+	}
+	if v, ok := uattrs.ContentDisposition.(string); ok {
+		o.ObjAttrs.ContentDisposition = v
+	}
+	if !uattrs.CustomTime.IsZero() {
+		o.ObjAttrs.CustomTime = uattrs.CustomTime
+	}
+	if uattrs.Metadata != nil {
+		// As in GCS, an empty map deletes all the metadata, and an empty
+		// value deletes just that key.
+		if len(uattrs.Metadata) == 0 {
+			o.ObjAttrs.Metadata = nil
+		} else if o.ObjAttrs.Metadata == nil {
+			o.ObjAttrs.Metadata = make(map[string]string, len(uattrs.Metadata))
+		}
+		for k, v := range uattrs.Metadata {
+			if v == "" {
+				delete(o.ObjAttrs.Metadata, k)
+			} else {
+				o.ObjAttrs.Metadata[k] = v
+			}
+		}
+	}
+	o.ObjAttrs.Updated = time.Now()
+	return o.Attrs(ctx)
+}
+
+// CopierFrom implements stiface.ObjectHandle.CopierFrom.  The source must
+// also be a fake ObjectHandle.
+func (o *ObjectHandle) CopierFrom(src stiface.ObjectHandle) stiface.Copier {
+	return &fakeCopier{dst: o, src: src.(*ObjectHandle)}
+}
+
 // NewReader returns a fakeReader for this ObjectHandle.
 func (o *ObjectHandle) NewReader(context.Context) (stiface.Reader, error) {
 	return &fakeReader{
@@ -166,7 +299,9 @@ func (w *fakeWriter) Write(p []byte) (int, error) {
 	if w.mustFail {
 		return 0, errors.New("write failed")
 	}
+	w.object.Bucket.mu.Lock()
 	w.object.Bucket.Objs[w.object.Name] = w.object
+	w.object.Bucket.mu.Unlock()
 	return w.buf.Write(p)
 }
 
@@ -177,6 +312,46 @@ func (w *fakeWriter) Close() error {
 	return nil
 }
 
+// fakeCopier copies an object's data and attributes, overriding any
+// attributes set on its ObjectAttrs, like the real Copier.
+type fakeCopier struct {
+	stiface.Copier
+	attrs storage.ObjectAttrs
+	dst   *ObjectHandle
+	src   *ObjectHandle
+}
+
+func (c *fakeCopier) ObjectAttrs() *storage.ObjectAttrs {
+	return &c.attrs
+}
+
+func (c *fakeCopier) Run(ctx context.Context) (*storage.ObjectAttrs, error) {
+	if !c.src.exists() {
+		return nil, storage.ErrObjectNotExist
+	}
+	srcAttrs, err := c.src.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.attrs.ContentType != "" {
+		srcAttrs.ContentType = c.attrs.ContentType
+	}
+	if !c.attrs.CustomTime.IsZero() {
+		srcAttrs.CustomTime = c.attrs.CustomTime
+	}
+	if c.attrs.Metadata != nil {
+		srcAttrs.Metadata = c.attrs.Metadata
+	}
+	srcAttrs.Updated = time.Now()
+
+	c.dst.Data = bytes.NewBuffer(append([]byte(nil), c.src.Data.Bytes()...))
+	c.dst.ObjAttrs = srcAttrs
+	c.dst.Bucket.mu.Lock()
+	c.dst.Bucket.Objs[c.dst.Name] = c.dst
+	c.dst.Bucket.mu.Unlock()
+	return c.dst.Attrs(ctx)
+}
+
 type fakeReader struct {
 	stiface.Reader
 	buf *bytes.Buffer
@@ -185,3 +360,7 @@ type fakeReader struct {
 func (r *fakeReader) Read(p []byte) (int, error) {
 	return r.buf.Read(p)
 }
+
+func (r *fakeReader) Close() error {
+	return nil
+}
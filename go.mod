@@ -9,6 +9,7 @@ require (
 	github.com/Khan/districts-jobs/pkg v0.0.0-20220725220726-8fbb6f669eaa
 	github.com/google/go-cmp v0.5.8
 	github.com/googleapis/google-cloud-go-testing v0.0.0-20210719221736-1c9a4c676720
+	go.opencensus.io v0.23.0
 	golang.org/x/oauth2 v0.0.0-20220722155238-128564f6959c
 	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
 	google.golang.org/api v0.89.0